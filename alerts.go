@@ -0,0 +1,321 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertOp compares a series value with the rule threshold.
+type AlertOp string
+
+const (
+	AlertOpGreater      AlertOp = ">"
+	AlertOpGreaterEqual AlertOp = ">="
+	AlertOpLess         AlertOp = "<"
+	AlertOpLessEqual    AlertOp = "<="
+	AlertOpEqual        AlertOp = "=="
+	AlertOpNotEqual     AlertOp = "!="
+	// AlertOpIncrease holds when the series increased by more than the threshold
+	// since the previous snapshot. A series that went down is taken as
+	// starting over from zero.
+	AlertOpIncrease AlertOp = "increase"
+)
+
+var AlertOpMap = map[string]AlertOp{
+	string(AlertOpGreater):      AlertOpGreater,
+	string(AlertOpGreaterEqual): AlertOpGreaterEqual,
+	string(AlertOpLess):         AlertOpLess,
+	string(AlertOpLessEqual):    AlertOpLessEqual,
+	string(AlertOpEqual):        AlertOpEqual,
+	string(AlertOpNotEqual):     AlertOpNotEqual,
+	string(AlertOpIncrease):     AlertOpIncrease,
+}
+
+// AlertRule evaluated on each series of a snapshot metric.
+type AlertRule struct {
+	// Name of the rule, unique.
+	Name string
+	// Metric full name, like "fluentbit_output_retries_failed".
+	Metric string
+	// Labels the series must have, like {"plugin": "es.0"}.
+	// Empty matches every series of the metric.
+	Labels    map[string]string
+	Op        AlertOp
+	Threshold float64
+	// For is how long the condition must hold before the alert fires.
+	// Zero fires on the first snapshot it holds on.
+	For time.Duration
+}
+
+// Alert of a rule on a single series.
+type Alert struct {
+	Rule   string            `json:"rule"`
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Value of the series on the last evaluation,
+	// or its increase with AlertOpIncrease.
+	Value float64 `json:"value"`
+	// ActiveSince is the time of the first snapshot the condition held on.
+	ActiveSince time.Time `json:"activeSince"`
+}
+
+func validateAlertRules(rules []AlertRule) error {
+	names := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return errors.New("alert rule name required")
+		}
+
+		if names[rule.Name] {
+			return fmt.Errorf("duplicated alert rule %q", rule.Name)
+		}
+
+		names[rule.Name] = true
+
+		if rule.Metric == "" {
+			return fmt.Errorf("alert rule %q: metric required", rule.Name)
+		}
+
+		if _, ok := AlertOpMap[string(rule.Op)]; !ok {
+			return fmt.Errorf("alert rule %q: invalid op %q", rule.Name, rule.Op)
+		}
+
+		if rule.For < 0 {
+			return fmt.Errorf("alert rule %q: for cannot be negative", rule.Name)
+		}
+	}
+
+	return nil
+}
+
+// alertEvaluator keeps the active alerts between snapshots.
+// The zero value is ready to use.
+type alertEvaluator struct {
+	mu     sync.Mutex
+	active map[string]*activeAlert
+	// prev value of each series, for AlertOpIncrease.
+	prev map[string]float64
+}
+
+type activeAlert struct {
+	alert  Alert
+	firing bool
+}
+
+// evaluateAlerts evaluates the alert rules on the snapshot.
+// An alert fires once its condition held for the rule duration,
+// and resolves on the first snapshot it does not hold on,
+// or its series is gone. Pending alerts that do not hold anymore
+// are dropped silently.
+// The snapshot gets a "forwarder_alerts_firing" gauge
+// with the number of firing alerts of each rule, left out of the Cloud payload.
+func (fd *Forwarder) evaluateAlerts(settings settings, snapshot Snapshot) Snapshot {
+	e := &fd.alertEvaluator
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.active == nil {
+		e.active = map[string]*activeAlert{}
+	}
+
+	var (
+		resolved []Alert
+		fired    []Alert
+		holding  = map[string]bool{}
+	)
+	for _, rule := range settings.alertRules {
+		for _, m := range snapshot.Metrics {
+			if m.FullName() != rule.Metric {
+				continue
+			}
+
+			for _, sample := range m.Samples {
+				labels := sampleLabelMap(m, sample)
+				if !matchLabels(rule.Labels, labels) {
+					continue
+				}
+
+				value, ok := e.value(rule, m, sample)
+				if !ok || !rule.holds(value) {
+					continue
+				}
+
+				key := rule.Name + "/" + seriesKey(m, sample)
+				holding[key] = true
+
+				a, ok := e.active[key]
+				if !ok {
+					a = &activeAlert{alert: Alert{
+						Rule:        rule.Name,
+						Metric:      rule.Metric,
+						Labels:      labels,
+						ActiveSince: snapshot.Time,
+					}}
+					e.active[key] = a
+				}
+
+				a.alert.Value = value
+				if !a.firing && snapshot.Time.Sub(a.alert.ActiveSince) >= rule.For {
+					a.firing = true
+					fired = append(fired, a.alert)
+				}
+			}
+		}
+	}
+
+	e.prev = map[string]float64{}
+	for _, m := range snapshot.Metrics {
+		for _, sample := range m.Samples {
+			e.prev[seriesKey(m, sample)] = sample.Value
+		}
+	}
+
+	for _, key := range sortedAlertKeys(e.active) {
+		if holding[key] {
+			continue
+		}
+
+		if a := e.active[key]; a.firing {
+			resolved = append(resolved, a.alert)
+		}
+		delete(e.active, key)
+	}
+
+	for _, alert := range resolved {
+		alert := alert
+		fd.emit(Event{Kind: EventAlertResolved, Alert: &alert})
+	}
+	for _, alert := range fired {
+		alert := alert
+		fd.emit(Event{Kind: EventAlertFiring, Alert: &alert})
+	}
+
+	if len(settings.alertRules) == 0 {
+		return snapshot
+	}
+
+	firing := map[string]int{}
+	for _, a := range e.active {
+		if a.firing {
+			firing[a.alert.Rule]++
+		}
+	}
+
+	metric := Metric{
+		Namespace: "forwarder",
+		Subsystem: "alerts",
+		Name:      "firing",
+		Help:      "Alerts firing per rule",
+		Type:      MetricGauge,
+		LabelKeys: []string{"rule"},
+	}
+	for _, rule := range settings.alertRules {
+		metric.add(float64(firing[rule.Name]), rule.Name)
+	}
+
+	metrics := make([]Metric, 0, len(snapshot.Metrics)+1)
+	metrics = append(metrics, snapshot.Metrics...)
+	snapshot.Metrics = append(metrics, metric)
+	return snapshot
+}
+
+// value of the series to compare with the threshold.
+// With AlertOpIncrease, there is none without a previous value.
+func (e *alertEvaluator) value(rule AlertRule, m Metric, sample Sample) (float64, bool) {
+	if rule.Op != AlertOpIncrease {
+		return sample.Value, true
+	}
+
+	prev, ok := e.prev[seriesKey(m, sample)]
+	if !ok {
+		return 0, false
+	}
+
+	if sample.Value < prev {
+		return sample.Value, true
+	}
+
+	return sample.Value - prev, true
+}
+
+func (rule AlertRule) holds(v float64) bool {
+	switch rule.Op {
+	case AlertOpGreater, AlertOpIncrease:
+		return v > rule.Threshold
+	case AlertOpGreaterEqual:
+		return v >= rule.Threshold
+	case AlertOpLess:
+		return v < rule.Threshold
+	case AlertOpLessEqual:
+		return v <= rule.Threshold
+	case AlertOpEqual:
+		return v == rule.Threshold
+	case AlertOpNotEqual:
+		return v != rule.Threshold
+	}
+
+	return false
+}
+
+func sampleLabelMap(m Metric, sample Sample) map[string]string {
+	if len(m.LabelKeys) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(m.LabelKeys))
+	for i, k := range m.LabelKeys {
+		if i < len(sample.LabelValues) {
+			out[k] = sample.LabelValues[i]
+		}
+	}
+
+	return out
+}
+
+func matchLabels(want, got map[string]string) bool {
+	for k, v := range want {
+		if got[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedAlertKeys(m map[string]*activeAlert) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// String of the alert, like `output_errors{plugin="es.0"} = 3`.
+func (a Alert) String() string {
+	var sb strings.Builder
+	sb.WriteString(a.Rule)
+	if len(a.Labels) != 0 {
+		keys := make([]string, 0, len(a.Labels))
+		for k := range a.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		sb.WriteString("{")
+		for i, k := range keys {
+			if i != 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, "%s=%q", k, a.Labels[k])
+		}
+		sb.WriteString("}")
+	}
+	fmt.Fprintf(&sb, " = %v", a.Value)
+	return sb.String()
+}
@@ -0,0 +1,71 @@
+package forwarder
+
+import "sync"
+
+// snapshotBuffer keeps the snapshots that could not be pushed to a sink
+// to retry them on the next intervals.
+// When full, the oldest snapshots are dropped.
+// The zero value is ready to use.
+type snapshotBuffer struct {
+	mu        sync.Mutex
+	snapshots []Snapshot
+	dropped   uint64
+}
+
+// push appends a snapshot, dropping the oldest ones beyond limit.
+func (b *snapshotBuffer) push(snapshot Snapshot, limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.snapshots = append(b.snapshots, snapshot)
+	b.truncateLocked(limit)
+}
+
+// unshift puts back a snapshot to be the first one retried.
+func (b *snapshotBuffer) unshift(snapshot Snapshot, limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.snapshots = append([]Snapshot{snapshot}, b.snapshots...)
+	b.truncateLocked(limit)
+}
+
+// shift takes the oldest snapshot.
+func (b *snapshotBuffer) shift() (Snapshot, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.snapshots) == 0 {
+		return Snapshot{}, false
+	}
+
+	snapshot := b.snapshots[0]
+	b.snapshots[0] = Snapshot{}
+	b.snapshots = b.snapshots[1:]
+	return snapshot, true
+}
+
+func (b *snapshotBuffer) truncate(limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.truncateLocked(limit)
+}
+
+func (b *snapshotBuffer) truncateLocked(limit int) {
+	if limit < 0 {
+		limit = 0
+	}
+
+	if n := len(b.snapshots) - limit; n > 0 {
+		b.snapshots = append([]Snapshot(nil), b.snapshots[n:]...)
+		b.dropped += uint64(n)
+	}
+}
+
+func (b *snapshotBuffer) stats() (size int, dropped uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.snapshots), b.dropped
+}
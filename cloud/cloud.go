@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -59,36 +61,175 @@ type UpdateAgentOpts struct {
 	Edition   *AgentEdition `json:"edition"`
 	Flags     *[]string     `json:"flags"`
 	RawConfig *string       `json:"rawConfig"`
+	// ConfigStatus reports the outcome of applying a desired config.
+	ConfigStatus *AgentConfigStatus `json:"configStatus,omitempty"`
 }
 
-type CreatedAgentMetrics struct {
-	Total int `json:"total_inserted"`
+// AgentConfigState of a desired config on the agent.
+type AgentConfigState string
+
+const (
+	AgentConfigStateApplied    AgentConfigState = "applied"
+	AgentConfigStateFailed     AgentConfigState = "failed"
+	AgentConfigStateRolledBack AgentConfigState = "rolled_back"
+)
+
+var AgentConfigStateMap = map[string]AgentConfigState{
+	string(AgentConfigStateApplied):    AgentConfigStateApplied,
+	string(AgentConfigStateFailed):     AgentConfigStateFailed,
+	string(AgentConfigStateRolledBack): AgentConfigStateRolledBack,
+}
+
+// AgentConfigStatus of the last desired config the agent tried to apply.
+type AgentConfigStatus struct {
+	Version string           `json:"version"`
+	State   AgentConfigState `json:"state"`
+	// Error of a failed or rolled back config.
+	Error string `json:"error,omitempty"`
+}
+
+// DesiredConfig of an agent as set on Cloud.
+type DesiredConfig struct {
+	// Version changes every time the config is set.
+	Version   string    `json:"version"`
+	RawConfig string    `json:"rawConfig"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// DesiredConfigParams to long-poll the desired config.
+// Nil fields are not applied.
+type DesiredConfigParams struct {
+	// Version the agent already has.
+	// Cloud responds with ErrNotModified while it stays the same.
+	Version *string
+	// Wait for the version to change before responding.
+	// Must be shorter than the HTTP client timeout.
+	Wait *time.Duration
+}
+
+// Agent as registered on Cloud.
+type Agent struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	MachineID string       `json:"machineID"`
+	Type      AgentType    `json:"type"`
+	Version   string       `json:"version"`
+	Edition   AgentEdition `json:"edition"`
+	Flags     []string     `json:"flags"`
+	RawConfig string       `json:"rawConfig"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
 }
 
-type Error struct {
-	Msg string `json:"error"`
+// AgentsParams filters and paginates the agents of a project.
+// Nil fields are not applied.
+type AgentsParams struct {
+	MachineID *string
+	Name      *string
+	// Last is the max number of agents to return, newest first.
+	Last *uint64
+	// Before is the EndCursor of the previous page.
+	Before *string
 }
 
-func (e *Error) Error() string {
-	return e.Msg
+// Agents page.
+type Agents struct {
+	Items []Agent `json:"items"`
+	// EndCursor to pass as AgentsParams.Before to get the next page.
+	// Nil if there are no more agents.
+	EndCursor *string `json:"endCursor"`
+}
+
+type RotatedAgentToken struct {
+	Token string `json:"token"`
+}
+
+type CreatedAgentMetrics struct {
+	Total int `json:"total_inserted"`
 }
 
 type Client struct {
 	BaseURL      string
 	HTTPClient   *http.Client
 	ProjectToken string
-	agentToken   string
+	// ProjectTokenSource takes precedence over ProjectToken when set.
+	ProjectTokenSource TokenSource
+	// AgentTokenSource provides the token of a pre-provisioned agent.
+	// It takes precedence over SetAgentToken when set.
+	AgentTokenSource TokenSource
+	// Compression used for metrics payloads.
+	// Empty means no compression.
+	Compression Compression
+
+	mu         sync.Mutex
+	agentToken string
+	// compressionFallback is set once the server rejects
+	// the configured compression.
+	compressionFallback *Compression
 }
 
 func (c *Client) SetAgentToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.agentToken = token
 }
 
+func (c *Client) projectToken(ctx context.Context) (string, error) {
+	if c.ProjectTokenSource != nil {
+		token, err := c.ProjectTokenSource.Token(ctx)
+		if err != nil {
+			return "", fmt.Errorf("could not get project token: %w", err)
+		}
+
+		return token, nil
+	}
+
+	if c.ProjectToken == "" {
+		return "", errors.New("project token not set yet")
+	}
+
+	return c.ProjectToken, nil
+}
+
+func (c *Client) getAgentToken(ctx context.Context) (string, error) {
+	if c.AgentTokenSource != nil {
+		token, err := c.AgentTokenSource.Token(ctx)
+		if err != nil {
+			return "", fmt.Errorf("could not get agent token: %w", err)
+		}
+
+		return token, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.agentToken == "" {
+		return "", errors.New("agent token not set yet")
+	}
+
+	return c.agentToken, nil
+}
+
+// invalidateToken makes the token source provide a fresh token
+// once Cloud rejected the current one.
+func invalidateToken(resp *http.Response, source TokenSource) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return
+	}
+
+	if inv, ok := source.(invalidator); ok {
+		inv.Invalidate()
+	}
+}
+
 func (c *Client) CreateAgent(ctx context.Context, payload CreateAgentPayload) (CreatedAgentPayload, error) {
 	var out CreatedAgentPayload
 
-	if c.ProjectToken == "" {
-		return out, errors.New("project token not set yet")
+	projectToken, err := c.projectToken(ctx)
+	if err != nil {
+		return out, err
 	}
 
 	b, err := json.Marshal(payload)
@@ -101,7 +242,7 @@ func (c *Client) CreateAgent(ctx context.Context, payload CreateAgentPayload) (C
 		return out, fmt.Errorf("could not create request to create agent: %w", err)
 	}
 
-	req.Header.Set("X-Project-Token", c.ProjectToken)
+	req.Header.Set("X-Project-Token", projectToken)
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
@@ -111,13 +252,8 @@ func (c *Client) CreateAgent(ctx context.Context, payload CreateAgentPayload) (C
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		e := &Error{}
-		err = json.NewDecoder(resp.Body).Decode(&e)
-		if err != nil {
-			return out, fmt.Errorf("could not json decode create agent error response: %w", err)
-		}
-
-		return out, e
+		invalidateToken(resp, c.ProjectTokenSource)
+		return out, decodeError(resp)
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&out)
@@ -129,8 +265,9 @@ func (c *Client) CreateAgent(ctx context.Context, payload CreateAgentPayload) (C
 }
 
 func (c *Client) UpdateAgent(ctx context.Context, agentID string, in UpdateAgentOpts) error {
-	if c.agentToken == "" {
-		return errors.New("agent token not set yet")
+	agentToken, err := c.getAgentToken(ctx)
+	if err != nil {
+		return err
 	}
 
 	b, err := json.Marshal(in)
@@ -143,7 +280,7 @@ func (c *Client) UpdateAgent(ctx context.Context, agentID string, in UpdateAgent
 		return fmt.Errorf("could not create request to update agent: %w", err)
 	}
 
-	req.Header.Set("X-Agent-Token", c.agentToken)
+	req.Header.Set("X-Agent-Token", agentToken)
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
@@ -153,47 +290,256 @@ func (c *Client) UpdateAgent(ctx context.Context, agentID string, in UpdateAgent
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		e := &Error{}
-		err = json.NewDecoder(resp.Body).Decode(&e)
-		if err != nil {
-			return fmt.Errorf("could not json decode update agent error response: %w", err)
-		}
-
-		return e
+		invalidateToken(resp, c.AgentTokenSource)
+		return decodeError(resp)
 	}
 
 	return nil
 }
 
-func (c *Client) AddAgentMetrics(ctx context.Context, agentID string, msgPackEncoded []byte) (CreatedAgentMetrics, error) {
-	var out CreatedAgentMetrics
+// Agent fetches the agent using its own token.
+func (c *Client) Agent(ctx context.Context, agentID string) (Agent, error) {
+	var out Agent
 
-	if c.agentToken == "" {
-		return out, errors.New("agent token not set yet")
+	agentToken, err := c.getAgentToken(ctx)
+	if err != nil {
+		return out, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/v1/agents/"+url.PathEscape(agentID)+"/metrics", bytes.NewReader(msgPackEncoded))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/v1/agents/"+url.PathEscape(agentID), nil)
 	if err != nil {
-		return out, fmt.Errorf("could not create request to add agent metrics: %w", err)
+		return out, fmt.Errorf("could not create request to fetch agent: %w", err)
 	}
 
-	req.Header.Set("X-Agent-Token", c.agentToken)
+	req.Header.Set("X-Agent-Token", agentToken)
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return out, fmt.Errorf("could not do request to add agent metrics: %w", err)
+		return out, fmt.Errorf("could not do request to fetch agent: %w", err)
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		e := &Error{}
-		err = json.NewDecoder(resp.Body).Decode(&e)
+		invalidateToken(resp, c.AgentTokenSource)
+		return out, decodeError(resp)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return out, fmt.Errorf("could not json decode agent response: %w", err)
+	}
+
+	return out, nil
+}
+
+// Agents lists the project agents using the project token.
+func (c *Client) Agents(ctx context.Context, params AgentsParams) (Agents, error) {
+	var out Agents
+
+	projectToken, err := c.projectToken(ctx)
+	if err != nil {
+		return out, err
+	}
+
+	q := url.Values{}
+	if params.MachineID != nil {
+		q.Set("machineID", *params.MachineID)
+	}
+	if params.Name != nil {
+		q.Set("name", *params.Name)
+	}
+	if params.Last != nil {
+		q.Set("last", strconv.FormatUint(*params.Last, 10))
+	}
+	if params.Before != nil {
+		q.Set("before", *params.Before)
+	}
+
+	endpoint := c.BaseURL + "/v1/agents"
+	if len(q) != 0 {
+		endpoint += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return out, fmt.Errorf("could not create request to fetch agents: %w", err)
+	}
+
+	req.Header.Set("X-Project-Token", projectToken)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return out, fmt.Errorf("could not do request to fetch agents: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		invalidateToken(resp, c.ProjectTokenSource)
+		return out, decodeError(resp)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return out, fmt.Errorf("could not json decode agents response: %w", err)
+	}
+
+	return out, nil
+}
+
+// RotateAgentToken issues a new token for the agent using the project token.
+// The previous token is no longer valid.
+func (c *Client) RotateAgentToken(ctx context.Context, agentID string) (RotatedAgentToken, error) {
+	var out RotatedAgentToken
+
+	projectToken, err := c.projectToken(ctx)
+	if err != nil {
+		return out, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/v1/agents/"+url.PathEscape(agentID)+"/token", nil)
+	if err != nil {
+		return out, fmt.Errorf("could not create request to rotate agent token: %w", err)
+	}
+
+	req.Header.Set("X-Project-Token", projectToken)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return out, fmt.Errorf("could not do request to rotate agent token: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		invalidateToken(resp, c.ProjectTokenSource)
+		return out, decodeError(resp)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return out, fmt.Errorf("could not json decode rotate agent token response: %w", err)
+	}
+
+	return out, nil
+}
+
+// DesiredConfig fetches the config Cloud wants the agent to run,
+// using its own token.
+// It returns ErrNotModified if it is still the version given in params,
+// and an error matching ErrNotFound if there is none.
+func (c *Client) DesiredConfig(ctx context.Context, agentID string, params DesiredConfigParams) (DesiredConfig, error) {
+	var out DesiredConfig
+
+	agentToken, err := c.getAgentToken(ctx)
+	if err != nil {
+		return out, err
+	}
+
+	q := url.Values{}
+	if params.Version != nil {
+		q.Set("version", *params.Version)
+	}
+	if params.Wait != nil {
+		q.Set("wait", params.Wait.String())
+	}
+
+	endpoint := c.BaseURL + "/v1/agents/" + url.PathEscape(agentID) + "/desired_config"
+	if len(q) != 0 {
+		endpoint += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return out, fmt.Errorf("could not create request to fetch desired config: %w", err)
+	}
+
+	req.Header.Set("X-Agent-Token", agentToken)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return out, fmt.Errorf("could not do request to fetch desired config: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return out, ErrNotModified
+	}
+
+	if resp.StatusCode >= 400 {
+		invalidateToken(resp, c.AgentTokenSource)
+		return out, decodeError(resp)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return out, fmt.Errorf("could not json decode desired config response: %w", err)
+	}
+
+	return out, nil
+}
+
+func (c *Client) DeleteAgent(ctx context.Context, agentID string) error {
+	agentToken, err := c.getAgentToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.BaseURL+"/v1/agents/"+url.PathEscape(agentID), nil)
+	if err != nil {
+		return fmt.Errorf("could not create request to delete agent: %w", err)
+	}
+
+	req.Header.Set("X-Agent-Token", agentToken)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not do request to delete agent: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		invalidateToken(resp, c.AgentTokenSource)
+		return decodeError(resp)
+	}
+
+	return nil
+}
+
+func (c *Client) AddAgentMetrics(ctx context.Context, agentID string, msgPackEncoded []byte) (CreatedAgentMetrics, error) {
+	var out CreatedAgentMetrics
+
+	agentToken, err := c.getAgentToken(ctx)
+	if err != nil {
+		return out, err
+	}
+
+	compression := c.compression()
+	resp, err := c.postAgentMetrics(ctx, agentID, agentToken, msgPackEncoded, compression)
+	if err != nil {
+		return out, err
+	}
+
+	if resp.StatusCode == http.StatusUnsupportedMediaType && compression != CompressionNone {
+		resp.Body.Close()
+
+		fallback := negotiateCompression(compression, resp.Header.Get("Accept-Encoding"))
+		c.setCompressionFallback(fallback)
+
+		resp, err = c.postAgentMetrics(ctx, agentID, agentToken, msgPackEncoded, fallback)
 		if err != nil {
-			return out, fmt.Errorf("could not json decode add agent metrics error response: %w", err)
+			return out, err
 		}
+	}
 
-		return out, e
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		invalidateToken(resp, c.AgentTokenSource)
+		return out, decodeError(resp)
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&out)
@@ -203,3 +549,49 @@ func (c *Client) AddAgentMetrics(ctx context.Context, agentID string, msgPackEnc
 
 	return out, nil
 }
+
+func (c *Client) postAgentMetrics(ctx context.Context, agentID, agentToken string, msgPackEncoded []byte, compression Compression) (*http.Response, error) {
+	body, err := compress(compression, msgPackEncoded)
+	if err != nil {
+		return nil, fmt.Errorf("could not %s compress agent metrics: %w", compression, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/v1/agents/"+url.PathEscape(agentID)+"/metrics", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request to add agent metrics: %w", err)
+	}
+
+	req.Header.Set("X-Agent-Token", agentToken)
+	if compression != CompressionNone {
+		req.Header.Set("Content-Encoding", string(compression))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not do request to add agent metrics: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (c *Client) compression() Compression {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.compressionFallback != nil {
+		return *c.compressionFallback
+	}
+
+	if c.Compression == "" {
+		return CompressionNone
+	}
+
+	return c.Compression
+}
+
+func (c *Client) setCompressionFallback(compression Compression) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.compressionFallback = &compression
+}
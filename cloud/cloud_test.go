@@ -0,0 +1,343 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestClient_AddAgentMetrics_compression(t *testing.T) {
+	payload := []byte("msgpack payload")
+	tt := []struct {
+		name           string
+		compression    Compression
+		acceptEncoding string
+		wantEncodings  []string
+	}{
+		{
+			name:          "none",
+			compression:   "",
+			wantEncodings: []string{""},
+		},
+		{
+			name:          "gzip",
+			compression:   CompressionGzip,
+			wantEncodings: []string{"gzip"},
+		},
+		{
+			name:          "zstd",
+			compression:   CompressionZstd,
+			wantEncodings: []string{"zstd"},
+		},
+		{
+			name:           "zstd_fallback_gzip",
+			compression:    CompressionZstd,
+			acceptEncoding: "gzip",
+			wantEncodings:  []string{"zstd", "gzip", "gzip"},
+		},
+		{
+			name:          "gzip_fallback_none",
+			compression:   CompressionGzip,
+			wantEncodings: []string{"gzip", "", ""},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotEncodings []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				encoding := r.Header.Get("Content-Encoding")
+				gotEncodings = append(gotEncodings, encoding)
+
+				if encoding != "" && encoding != tc.acceptEncoding && len(tc.wantEncodings) > 1 {
+					w.Header().Set("Accept-Encoding", tc.acceptEncoding)
+					w.WriteHeader(http.StatusUnsupportedMediaType)
+					_, _ = w.Write([]byte(`{"error":"unsupported encoding"}`))
+					return
+				}
+
+				got, err := decompress(encoding, r.Body)
+				if err != nil {
+					t.Error(err)
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				if !bytes.Equal(got, payload) {
+					t.Errorf("body = %q, want %q", got, payload)
+				}
+
+				_, _ = w.Write([]byte(`{"total_inserted":1}`))
+			}))
+			defer srv.Close()
+
+			c := &Client{
+				BaseURL:     srv.URL,
+				HTTPClient:  srv.Client(),
+				Compression: tc.compression,
+			}
+			c.SetAgentToken("token")
+
+			// Send twice to check the fallback is remembered.
+			for i := 0; i < 2; i++ {
+				got, err := c.AddAgentMetrics(context.Background(), "agent", payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got.Total != 1 {
+					t.Errorf("total = %d, want 1", got.Total)
+				}
+			}
+
+			if len(tc.wantEncodings) == 1 {
+				tc.wantEncodings = append(tc.wantEncodings, tc.wantEncodings[0])
+			}
+
+			if len(gotEncodings) != len(tc.wantEncodings) {
+				t.Fatalf("encodings = %q, want %q", gotEncodings, tc.wantEncodings)
+			}
+
+			for i := range gotEncodings {
+				if gotEncodings[i] != tc.wantEncodings[i] {
+					t.Fatalf("encodings = %q, want %q", gotEncodings, tc.wantEncodings)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_UpdateAgent_error(t *testing.T) {
+	tt := []struct {
+		name          string
+		status        int
+		header        http.Header
+		body          string
+		wantMsg       string
+		wantBody      string
+		wantRetryable bool
+		wantRetry     time.Duration
+		wantIs        error
+	}{
+		{
+			name:    "json",
+			status:  http.StatusNotFound,
+			header:  http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"req-1"}},
+			body:    `{"error":"agent not found"}`,
+			wantMsg: "agent not found",
+			wantIs:  ErrNotFound,
+		},
+		{
+			name:          "html",
+			status:        http.StatusBadGateway,
+			header:        http.Header{"Content-Type": {"text/html"}, "X-Request-Id": {"req-1"}},
+			body:          "<html>502 Bad Gateway</html>",
+			wantMsg:       "unexpected status 502 Bad Gateway",
+			wantBody:      "<html>502 Bad Gateway</html>",
+			wantRetryable: true,
+		},
+		{
+			name:          "rate_limited",
+			status:        http.StatusTooManyRequests,
+			header:        http.Header{"Retry-After": {"3"}, "X-Request-Id": {"req-1"}},
+			wantMsg:       "unexpected status 429 Too Many Requests",
+			wantRetryable: true,
+			wantRetry:     time.Second * 3,
+			wantIs:        ErrRateLimited,
+		},
+		{
+			name:    "unauthorized",
+			status:  http.StatusUnauthorized,
+			header:  http.Header{"X-Request-Id": {"req-1"}},
+			body:    `{"error":"invalid token"}`,
+			wantMsg: "invalid token",
+			wantIs:  ErrUnauthorized,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tc.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			c := &Client{BaseURL: srv.URL, HTTPClient: srv.Client()}
+			c.SetAgentToken("token")
+
+			err := c.UpdateAgent(context.Background(), "agent", UpdateAgentOpts{})
+
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("err = %v, want *Error", err)
+			}
+
+			if e.Error() != tc.wantMsg {
+				t.Errorf("msg = %q, want %q", e.Error(), tc.wantMsg)
+			}
+
+			if e.StatusCode != tc.status {
+				t.Errorf("status = %d, want %d", e.StatusCode, tc.status)
+			}
+
+			if e.RequestID != "req-1" {
+				t.Errorf("request ID = %q, want %q", e.RequestID, "req-1")
+			}
+
+			if tc.wantBody != "" && e.Body != tc.wantBody {
+				t.Errorf("body = %q, want %q", e.Body, tc.wantBody)
+			}
+
+			if e.Retryable != tc.wantRetryable {
+				t.Errorf("retryable = %v, want %v", e.Retryable, tc.wantRetryable)
+			}
+
+			if e.RetryAfter != tc.wantRetry {
+				t.Errorf("retry after = %v, want %v", e.RetryAfter, tc.wantRetry)
+			}
+
+			if tc.wantIs != nil && !errors.Is(err, tc.wantIs) {
+				t.Errorf("errors.Is(%v, %v) = false", err, tc.wantIs)
+			}
+		})
+	}
+}
+
+func TestClient_tokenSources(t *testing.T) {
+	var gotTokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Agent-Token")
+		gotTokens = append(gotTokens, token)
+		if token != "rotated" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("old\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{
+		BaseURL:          srv.URL,
+		HTTPClient:       srv.Client(),
+		AgentTokenSource: &FileTokenSource{Path: tokenFile},
+	}
+	c.SetAgentToken("ignored")
+
+	ctx := context.Background()
+	err = c.UpdateAgent(ctx, "agent", UpdateAgentOpts{})
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("err = %v, want %v", err, ErrUnauthorized)
+	}
+
+	err = os.WriteFile(tokenFile, []byte("rotated\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.UpdateAgent(ctx, "agent", UpdateAgentOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"old", "rotated"}; !reflect.DeepEqual(gotTokens, want) {
+		t.Errorf("tokens = %v, want %v", gotTokens, want)
+	}
+}
+
+func TestExecTokenSource(t *testing.T) {
+	s := &ExecTokenSource{Command: []string{"echo", "token"}}
+
+	got, err := s.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "token" {
+		t.Errorf("token = %q, want %q", got, "token")
+	}
+
+	s = &ExecTokenSource{Command: []string{"false"}}
+	_, err = s.Token(context.Background())
+	if err == nil {
+		t.Error("expected error from a failing command")
+	}
+}
+
+func decompress(encoding string, r io.Reader) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(zr)
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+
+	return io.ReadAll(r)
+}
+
+func TestClient_DesiredConfig(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agents/agent/desired_config" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if want, got := "1s", r.URL.Query().Get("wait"); want != got {
+			t.Errorf("want wait %q; got %q", want, got)
+		}
+
+		if r.URL.Query().Get("version") == "2" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"version":"2","rawConfig":"[INPUT]"}`))
+	}))
+	defer srv.Close()
+
+	c := &Client{BaseURL: srv.URL, HTTPClient: srv.Client()}
+	c.SetAgentToken("token")
+
+	wait := time.Second
+	got, err := c.DesiredConfig(context.Background(), "agent", DesiredConfigParams{Wait: &wait})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (DesiredConfig{Version: "2", RawConfig: "[INPUT]"}); got != want {
+		t.Errorf("want desired config %+v; got %+v", want, got)
+	}
+
+	_, err = c.DesiredConfig(context.Background(), "agent", DesiredConfigParams{Version: &got.Version, Wait: &wait})
+	if !errors.Is(err, ErrNotModified) {
+		t.Errorf("want %v; got %v", ErrNotModified, err)
+	}
+}
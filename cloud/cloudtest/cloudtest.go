@@ -0,0 +1,757 @@
+// Package cloudtest provides an in-process stand-in for the Calyptia Cloud API
+// to be used on tests and for offline development.
+package cloudtest
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cmetrics "github.com/calyptia/cmetrics-go"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Agent registered on the fake Cloud.
+type Agent struct {
+	ID        string
+	Token     string
+	MachineID string
+	Name      string
+	Type      cloud.AgentType
+	Version   string
+	Edition   cloud.AgentEdition
+	Flags     []string
+	RawConfig string
+	// DesiredConfig set with SetDesiredConfig, if any.
+	DesiredConfig *cloud.DesiredConfig
+	// ConfigStatus last reported by the agent, if any.
+	ConfigStatus *cloud.AgentConfigStatus
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (a *Agent) cloudAgent() cloud.Agent {
+	return cloud.Agent{
+		ID:        a.ID,
+		Name:      a.Name,
+		MachineID: a.MachineID,
+		Type:      a.Type,
+		Version:   a.Version,
+		Edition:   a.Edition,
+		Flags:     a.Flags,
+		RawConfig: a.RawConfig,
+		CreatedAt: a.CreatedAt,
+		UpdatedAt: a.UpdatedAt,
+	}
+}
+
+// Metrics received from an agent.
+type Metrics struct {
+	AgentID    string
+	MsgPack    []byte
+	Text       string
+	Total      int
+	ReceivedAt time.Time
+}
+
+// Request recorded by the fake Cloud.
+// Body is already decompressed.
+type Request struct {
+	ID         string
+	Method     string
+	Path       string
+	Header     http.Header
+	Body       []byte
+	StatusCode int
+}
+
+// Failure to inject in the responses of the matching requests.
+type Failure struct {
+	// Method to match. Empty matches any.
+	Method string
+	// Path pattern to match as in path.Match. Example: "/v1/agents/*/metrics".
+	// Empty matches any.
+	Path       string
+	StatusCode int
+	Header     http.Header
+	Body       string
+	// Times the failure is injected. Zero means forever.
+	Times int
+}
+
+// Handler implementing the fake Cloud API.
+// Use NewHandler to create one.
+type Handler struct {
+	// ProjectToken expected on "X-Project-Token".
+	// If empty, any non-empty token is accepted.
+	ProjectToken string
+	// AcceptEncodings lists the supported "Content-Encoding" for metrics.
+	// Empty means gzip and zstd are supported.
+	AcceptEncodings []string
+	Logger          log.Logger
+
+	mu        sync.Mutex
+	agents    map[string]*Agent
+	metrics   []Metrics
+	requests  []Request
+	failures  []*Failure
+	requestID int
+	// configVersion of the last desired config set.
+	configVersion int
+	// configChanged is closed and replaced every time a desired config is set,
+	// waking up long-polls.
+	configChanged chan struct{}
+}
+
+func NewHandler(projectToken string) *Handler {
+	return &Handler{
+		ProjectToken:  projectToken,
+		Logger:        log.NewNopLogger(),
+		agents:        map[string]*Agent{},
+		configChanged: make(chan struct{}),
+	}
+}
+
+// Server is a fake Cloud listening on a system-chosen port on the local
+// loopback interface.
+type Server struct {
+	*Handler
+	*httptest.Server
+}
+
+// NewServer starts and returns a new fake Cloud server.
+// The caller should call Close when finished, to shut it down.
+func NewServer(projectToken string) *Server {
+	h := NewHandler(projectToken)
+	return &Server{
+		Handler: h,
+		Server:  httptest.NewServer(h),
+	}
+}
+
+// Agents registered so far.
+func (h *Handler) Agents() []Agent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make([]Agent, 0, len(h.agents))
+	for _, a := range h.agents {
+		out = append(out, *a)
+	}
+
+	return out
+}
+
+// Metrics received so far.
+func (h *Handler) Metrics() []Metrics {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]Metrics(nil), h.metrics...)
+}
+
+// Requests received so far.
+func (h *Handler) Requests() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]Request(nil), h.requests...)
+}
+
+// SetDesiredConfig for the agent, returning its new version.
+func (h *Handler) SetDesiredConfig(agentID, rawConfig string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	agent, ok := h.agents[agentID]
+	if !ok {
+		return "", errAgentNotFound
+	}
+
+	h.configVersion++
+	agent.DesiredConfig = &cloud.DesiredConfig{
+		Version:   strconv.Itoa(h.configVersion),
+		RawConfig: rawConfig,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	close(h.configChanged)
+	h.configChanged = make(chan struct{})
+
+	return agent.DesiredConfig.Version, nil
+}
+
+// InjectFailure makes the matching requests respond with the given failure.
+// Failures are matched in the order they were injected.
+func (h *Handler) InjectFailure(f Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures = append(h.failures, &f)
+}
+
+// ClearFailures removes all injected failures.
+func (h *Handler) ClearFailures() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures = nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.requestID++
+	reqID := strconv.Itoa(h.requestID)
+	h.mu.Unlock()
+
+	rec := Request{
+		ID:     reqID,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header.Clone(),
+	}
+	rw := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	rw.Header().Set("X-Request-Id", reqID)
+
+	defer func() {
+		rec.StatusCode = rw.statusCode
+
+		h.mu.Lock()
+		h.requests = append(h.requests, rec)
+		h.mu.Unlock()
+
+		_ = level.Info(h.Logger).Log("request_id", reqID, "method", rec.Method, "path", rec.Path, "status", rec.StatusCode)
+	}()
+
+	body, err := readBody(r)
+	if errors.Is(err, errUnsupportedEncoding) {
+		rw.Header().Set("Accept-Encoding", strings.Join(h.acceptEncodings(), ", "))
+		respondErr(rw, http.StatusUnsupportedMediaType, err)
+		return
+	}
+
+	if err != nil {
+		respondErr(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	rec.Body = body
+
+	if f := h.failure(r); f != nil {
+		for k, v := range f.Header {
+			rw.Header()[k] = v
+		}
+		rw.WriteHeader(f.StatusCode)
+		_, _ = io.WriteString(rw, f.Body)
+		return
+	}
+
+	if r.Header.Get("Content-Encoding") != "" && !h.accepts(r.Header.Get("Content-Encoding")) {
+		rw.Header().Set("Accept-Encoding", strings.Join(h.acceptEncodings(), ", "))
+		respondErr(rw, http.StatusUnsupportedMediaType, errUnsupportedEncoding)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "v1" && parts[1] == "agents" && r.Method == http.MethodPost:
+		h.createAgent(rw, r, body)
+	case len(parts) == 2 && parts[0] == "v1" && parts[1] == "agents" && r.Method == http.MethodGet:
+		h.listAgents(rw, r)
+	case len(parts) == 3 && parts[0] == "v1" && parts[1] == "agents" && r.Method == http.MethodGet:
+		h.getAgent(rw, r, parts[2])
+	case len(parts) == 3 && parts[0] == "v1" && parts[1] == "agents" && r.Method == http.MethodPatch:
+		h.updateAgent(rw, r, parts[2], body)
+	case len(parts) == 3 && parts[0] == "v1" && parts[1] == "agents" && r.Method == http.MethodDelete:
+		h.deleteAgent(rw, r, parts[2])
+	case len(parts) == 4 && parts[0] == "v1" && parts[1] == "agents" && parts[3] == "token" && r.Method == http.MethodPost:
+		h.rotateAgentToken(rw, r, parts[2])
+	case len(parts) == 4 && parts[0] == "v1" && parts[1] == "agents" && parts[3] == "metrics" && r.Method == http.MethodPost:
+		h.addAgentMetrics(rw, r, parts[2], body)
+	case len(parts) == 4 && parts[0] == "v1" && parts[1] == "agents" && parts[3] == "desired_config" && r.Method == http.MethodGet:
+		h.getDesiredConfig(rw, r, parts[2])
+	default:
+		respondErr(rw, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *Handler) createAgent(w http.ResponseWriter, r *http.Request, body []byte) {
+	if !h.validProjectToken(r) {
+		respondErr(w, http.StatusUnauthorized, errors.New("invalid project token"))
+		return
+	}
+
+	var in cloud.CreateAgentPayload
+	if err := json.Unmarshal(body, &in); err != nil {
+		respondErr(w, http.StatusBadRequest, fmt.Errorf("invalid create agent payload: %w", err))
+		return
+	}
+
+	if in.MachineID == "" {
+		respondErr(w, http.StatusUnprocessableEntity, errors.New("invalid machine ID"))
+		return
+	}
+
+	if _, ok := cloud.AgentTypeMap[string(in.Type)]; !ok {
+		respondErr(w, http.StatusUnprocessableEntity, errors.New("invalid agent type"))
+		return
+	}
+
+	now := time.Now().UTC()
+	agent := &Agent{
+		ID:        uuid.New().String(),
+		Token:     randomToken(),
+		MachineID: in.MachineID,
+		Name:      in.Name,
+		Type:      in.Type,
+		Version:   in.Version,
+		Edition:   in.Edition,
+		Flags:     in.Flags,
+		RawConfig: in.RawConfig,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	h.mu.Lock()
+	h.agents[agent.ID] = agent
+	h.mu.Unlock()
+
+	respondJSON(w, http.StatusCreated, cloud.CreatedAgentPayload{
+		ID:        agent.ID,
+		Token:     agent.Token,
+		Name:      agent.Name,
+		CreatedAt: agent.CreatedAt,
+	})
+}
+
+func (h *Handler) getAgent(w http.ResponseWriter, r *http.Request, agentID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	agent, err := h.authorizedAgent(r, agentID)
+	if err != nil {
+		respondErr(w, statusCode(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, agent.cloudAgent())
+}
+
+// listAgents newest first, filtered by machine ID and name,
+// paginated using the agent ID as cursor.
+func (h *Handler) listAgents(w http.ResponseWriter, r *http.Request) {
+	if !h.validProjectToken(r) {
+		respondErr(w, http.StatusUnauthorized, errors.New("invalid project token"))
+		return
+	}
+
+	q := r.URL.Query()
+
+	var last uint64
+	if s := q.Get("last"); s != "" {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			respondErr(w, http.StatusBadRequest, errors.New("invalid last"))
+			return
+		}
+
+		last = v
+	}
+
+	h.mu.Lock()
+	agents := make([]*Agent, 0, len(h.agents))
+	for _, a := range h.agents {
+		if v, ok := q["machineID"]; ok && a.MachineID != v[0] {
+			continue
+		}
+		if v, ok := q["name"]; ok && a.Name != v[0] {
+			continue
+		}
+
+		agents = append(agents, a)
+	}
+	h.mu.Unlock()
+
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].CreatedAt.Equal(agents[j].CreatedAt) {
+			return agents[i].ID > agents[j].ID
+		}
+		return agents[i].CreatedAt.After(agents[j].CreatedAt)
+	})
+
+	if before := q.Get("before"); before != "" {
+		idx := -1
+		for i, a := range agents {
+			if a.ID == before {
+				idx = i
+				break
+			}
+		}
+
+		if idx == -1 {
+			respondErr(w, http.StatusBadRequest, errors.New("invalid cursor"))
+			return
+		}
+
+		agents = agents[idx+1:]
+	}
+
+	out := cloud.Agents{Items: []cloud.Agent{}}
+	for _, a := range agents {
+		if last != 0 && uint64(len(out.Items)) == last {
+			cursor := out.Items[len(out.Items)-1].ID
+			out.EndCursor = &cursor
+			break
+		}
+
+		out.Items = append(out.Items, a.cloudAgent())
+	}
+
+	respondJSON(w, http.StatusOK, out)
+}
+
+func (h *Handler) updateAgent(w http.ResponseWriter, r *http.Request, agentID string, body []byte) {
+	var in cloud.UpdateAgentOpts
+	if err := json.Unmarshal(body, &in); err != nil {
+		respondErr(w, http.StatusBadRequest, fmt.Errorf("invalid update agent options: %w", err))
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	agent, err := h.authorizedAgent(r, agentID)
+	if err != nil {
+		respondErr(w, statusCode(err), err)
+		return
+	}
+
+	if in.Name != nil {
+		agent.Name = *in.Name
+	}
+	if in.Version != nil {
+		agent.Version = *in.Version
+	}
+	if in.Edition != nil {
+		agent.Edition = *in.Edition
+	}
+	if in.Flags != nil {
+		agent.Flags = *in.Flags
+	}
+	if in.RawConfig != nil {
+		agent.RawConfig = *in.RawConfig
+	}
+	if in.ConfigStatus != nil {
+		if _, ok := cloud.AgentConfigStateMap[string(in.ConfigStatus.State)]; !ok {
+			respondErr(w, http.StatusUnprocessableEntity, errors.New("invalid config state"))
+			return
+		}
+
+		status := *in.ConfigStatus
+		agent.ConfigStatus = &status
+	}
+	agent.UpdatedAt = time.Now().UTC()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getDesiredConfig responds with 304 while the desired config stays
+// at the given version, waiting up to the given duration for it to change.
+func (h *Handler) getDesiredConfig(w http.ResponseWriter, r *http.Request, agentID string) {
+	q := r.URL.Query()
+	_, hasVersion := q["version"]
+
+	var wait time.Duration
+	if s := q.Get("wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			respondErr(w, http.StatusBadRequest, errors.New("invalid wait"))
+			return
+		}
+
+		wait = d
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		h.mu.Lock()
+		agent, err := h.authorizedAgent(r, agentID)
+		if err != nil {
+			h.mu.Unlock()
+			respondErr(w, statusCode(err), err)
+			return
+		}
+
+		desired := agent.DesiredConfig
+		changed := h.configChanged
+		h.mu.Unlock()
+
+		if desired == nil && !hasVersion {
+			respondErr(w, http.StatusNotFound, errors.New("desired config not found"))
+			return
+		}
+
+		if desired != nil && (!hasVersion || q.Get("version") != desired.Version) {
+			respondJSON(w, http.StatusOK, desired)
+			return
+		}
+
+		select {
+		case <-changed:
+			continue
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+
+		if desired == nil {
+			respondErr(w, http.StatusNotFound, errors.New("desired config not found"))
+			return
+		}
+
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+}
+
+func (h *Handler) rotateAgentToken(w http.ResponseWriter, r *http.Request, agentID string) {
+	if !h.validProjectToken(r) {
+		respondErr(w, http.StatusUnauthorized, errors.New("invalid project token"))
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	agent, ok := h.agents[agentID]
+	if !ok {
+		respondErr(w, http.StatusNotFound, errAgentNotFound)
+		return
+	}
+
+	agent.Token = randomToken()
+	agent.UpdatedAt = time.Now().UTC()
+
+	respondJSON(w, http.StatusOK, cloud.RotatedAgentToken{Token: agent.Token})
+}
+
+func (h *Handler) deleteAgent(w http.ResponseWriter, r *http.Request, agentID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := h.authorizedAgent(r, agentID); err != nil {
+		respondErr(w, statusCode(err), err)
+		return
+	}
+
+	delete(h.agents, agentID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) addAgentMetrics(w http.ResponseWriter, r *http.Request, agentID string, body []byte) {
+	h.mu.Lock()
+	_, err := h.authorizedAgent(r, agentID)
+	h.mu.Unlock()
+	if err != nil {
+		respondErr(w, statusCode(err), err)
+		return
+	}
+
+	if len(body) == 0 {
+		respondErr(w, http.StatusBadRequest, errors.New("empty metrics payload"))
+		return
+	}
+
+	metricsContext, err := cmetrics.NewContextFromMsgPack(body, 0)
+	if err != nil {
+		respondErr(w, http.StatusBadRequest, fmt.Errorf("invalid metrics payload: %w", err))
+		return
+	}
+
+	defer metricsContext.Destroy()
+
+	text, err := metricsContext.EncodeText()
+	if err != nil {
+		respondErr(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	m := Metrics{
+		AgentID:    agentID,
+		MsgPack:    body,
+		Text:       text,
+		Total:      strings.Count(text, "\n"),
+		ReceivedAt: time.Now().UTC(),
+	}
+
+	h.mu.Lock()
+	h.metrics = append(h.metrics, m)
+	h.mu.Unlock()
+
+	respondJSON(w, http.StatusCreated, cloud.CreatedAgentMetrics{Total: m.Total})
+}
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errInvalidAgentToken   = errors.New("invalid agent token")
+	errAgentNotFound       = errors.New("agent not found")
+)
+
+// authorizedAgent must be called with the lock held.
+func (h *Handler) authorizedAgent(r *http.Request, agentID string) (*Agent, error) {
+	agent, ok := h.agents[agentID]
+	if !ok {
+		return nil, errAgentNotFound
+	}
+
+	token := r.Header.Get("X-Agent-Token")
+	if token == "" || token != agent.Token {
+		return nil, errInvalidAgentToken
+	}
+
+	return agent, nil
+}
+
+func (h *Handler) validProjectToken(r *http.Request) bool {
+	token := r.Header.Get("X-Project-Token")
+	if h.ProjectToken == "" {
+		return token != ""
+	}
+
+	return token == h.ProjectToken
+}
+
+func (h *Handler) failure(r *http.Request) *Failure {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, f := range h.failures {
+		if f.Method != "" && f.Method != r.Method {
+			continue
+		}
+
+		if f.Path != "" {
+			if ok, _ := path.Match(f.Path, r.URL.Path); !ok {
+				continue
+			}
+		}
+
+		out := *f
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				h.failures = append(h.failures[:i], h.failures[i+1:]...)
+			}
+		}
+
+		return &out
+	}
+
+	return nil
+}
+
+func (h *Handler) acceptEncodings() []string {
+	if len(h.AcceptEncodings) == 0 {
+		return []string{"gzip", "zstd"}
+	}
+
+	return h.AcceptEncodings
+}
+
+func (h *Handler) accepts(encoding string) bool {
+	for _, e := range h.acceptEncodings() {
+		if e == encoding {
+			return true
+		}
+	}
+
+	return false
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+		return io.ReadAll(r.Body)
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+
+		return io.ReadAll(zr)
+	case "zstd":
+		zr, err := zstd.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+
+	return nil, errUnsupportedEncoding
+}
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, errAgentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidAgentToken):
+		return http.StatusUnauthorized
+	}
+
+	return http.StatusInternalServerError
+}
+
+func respondJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		respondErr(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(b)
+}
+
+func respondErr(w http.ResponseWriter, statusCode int, err error) {
+	b, _ := json.Marshal(cloud.Error{Msg: err.Error()})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(b)
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusRecorder) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
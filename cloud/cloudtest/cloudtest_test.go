@@ -0,0 +1,189 @@
+package cloudtest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	cmetrics "github.com/calyptia/cmetrics-go"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+)
+
+func TestServer(t *testing.T) {
+	srv := NewServer("project-token")
+	defer srv.Close()
+
+	ctx := context.Background()
+	client := &cloud.Client{
+		BaseURL:      srv.URL,
+		HTTPClient:   srv.Client(),
+		ProjectToken: "project-token",
+		Compression:  cloud.CompressionGzip,
+	}
+
+	created, err := client.CreateAgent(ctx, cloud.CreateAgentPayload{
+		Name:      "test",
+		MachineID: "machine-id",
+		Type:      cloud.AgentTypeFluentBit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetAgentToken("invalid")
+	name := "updated"
+	err = client.UpdateAgent(ctx, created.ID, cloud.UpdateAgentOpts{Name: &name})
+	if !errors.Is(err, cloud.ErrUnauthorized) {
+		t.Fatalf("err = %v, want %v", err, cloud.ErrUnauthorized)
+	}
+
+	client.SetAgentToken(created.Token)
+	err = client.UpdateAgent(ctx, created.ID, cloud.UpdateAgentOpts{Name: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agents := srv.Agents(); len(agents) != 1 || agents[0].Name != name {
+		t.Fatalf("agents = %+v, want one named %q", agents, name)
+	}
+
+	msgPackEncoded := testMsgPack(t)
+
+	srv.InjectFailure(Failure{
+		Method:     http.MethodPost,
+		Path:       "/v1/agents/*/metrics",
+		StatusCode: http.StatusServiceUnavailable,
+		Times:      1,
+	})
+	_, err = client.AddAgentMetrics(ctx, created.ID, msgPackEncoded)
+	var e *cloud.Error
+	if !errors.As(err, &e) || !e.Retryable {
+		t.Fatalf("err = %v, want retryable cloud error", err)
+	}
+
+	got, err := client.AddAgentMetrics(ctx, created.ID, msgPackEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Total != 1 {
+		t.Errorf("total = %d, want 1", got.Total)
+	}
+
+	metrics := srv.Metrics()
+	if len(metrics) != 1 || !strings.Contains(metrics[0].Text, `fluentbit_input_records{plugin="dummy.0"} = 10`) {
+		t.Fatalf("metrics = %+v", metrics)
+	}
+
+	if reqs := srv.Requests(); len(reqs) != 5 {
+		t.Fatalf("got %d requests, want 5", len(reqs))
+	}
+}
+
+func testMsgPack(t *testing.T) []byte {
+	t.Helper()
+
+	metricsContext, err := cmetrics.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer metricsContext.Destroy()
+
+	counter, err := metricsContext.CounterCreate("fluentbit", "input", "records", "records", []string{"plugin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = counter.Set(time.Now(), 10, []string{"dummy.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := metricsContext.EncodeMsgPack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestServer_Agents(t *testing.T) {
+	srv := NewServer("project-token")
+	defer srv.Close()
+
+	ctx := context.Background()
+	client := &cloud.Client{
+		BaseURL:      srv.URL,
+		HTTPClient:   srv.Client(),
+		ProjectToken: "project-token",
+	}
+
+	var created []cloud.CreatedAgentPayload
+	for _, machineID := range []string{"a", "b", "b"} {
+		c, err := client.CreateAgent(ctx, cloud.CreateAgentPayload{
+			Name:      "agent-" + machineID,
+			MachineID: machineID,
+			Type:      cloud.AgentTypeFluentBit,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		created = append(created, c)
+	}
+
+	client.SetAgentToken(created[0].Token)
+	agent, err := client.Agent(ctx, created[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.ID != created[0].ID || agent.MachineID != "a" || agent.Name != "agent-a" {
+		t.Errorf("agent = %+v", agent)
+	}
+
+	machineID := "b"
+	last := uint64(1)
+	var ids []string
+	params := cloud.AgentsParams{MachineID: &machineID, Last: &last}
+	for page := 0; ; page++ {
+		if page > 2 {
+			t.Fatal("too many pages")
+		}
+
+		agents, err := client.Agents(ctx, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, a := range agents.Items {
+			ids = append(ids, a.ID)
+		}
+
+		if agents.EndCursor == nil {
+			break
+		}
+
+		params.Before = agents.EndCursor
+	}
+
+	if len(ids) != 2 || ids[0] == ids[1] {
+		t.Fatalf("got agent IDs %v, want the 2 agents with machine ID %q", ids, machineID)
+	}
+
+	for _, id := range ids {
+		if id == created[0].ID {
+			t.Errorf("got agent %q with another machine ID", id)
+		}
+	}
+
+	client.ProjectToken = "invalid"
+	_, err = client.Agents(ctx, cloud.AgentsParams{})
+	if !errors.Is(err, cloud.ErrUnauthorized) {
+		t.Errorf("err = %v, want %v", err, cloud.ErrUnauthorized)
+	}
+}
@@ -0,0 +1,86 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithm used to encode metrics payloads sent to Cloud.
+// It is sent as the request "Content-Encoding".
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var CompressionMap = map[string]Compression{
+	string(CompressionNone): CompressionNone,
+	string(CompressionGzip): CompressionGzip,
+	string(CompressionZstd): CompressionZstd,
+}
+
+var (
+	zstdEncoderOnce sync.Once
+	zstdEncoder     *zstd.Encoder
+	zstdEncoderErr  error
+)
+
+func compress(c Compression, b []byte) ([]byte, error) {
+	switch c {
+	case "", CompressionNone:
+		return b, nil
+	case CompressionGzip:
+		buff := &bytes.Buffer{}
+		w := gzip.NewWriter(buff)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buff.Bytes(), nil
+	case CompressionZstd:
+		zstdEncoderOnce.Do(func() {
+			zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil)
+		})
+		if zstdEncoderErr != nil {
+			return nil, zstdEncoderErr
+		}
+
+		return zstdEncoder.EncodeAll(b, make([]byte, 0, len(b))), nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression %q", c)
+}
+
+// negotiateCompression picks the compression to fallback to after the server
+// rejected the given one with a "415 Unsupported Media Type".
+// The server may list the encodings it does support in the
+// "Accept-Encoding" response header; otherwise we fallback to no compression.
+func negotiateCompression(rejected Compression, acceptEncoding string) Compression {
+	accepted := map[Compression]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		if i := strings.Index(part, ";"); i != -1 {
+			part = part[:i]
+		}
+
+		accepted[Compression(strings.ToLower(strings.TrimSpace(part)))] = true
+	}
+
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		if c != rejected && accepted[c] {
+			return c
+		}
+	}
+
+	return CompressionNone
+}
@@ -0,0 +1,271 @@
+// Package dryrun provides a Cloud client that prints what would be sent
+// to Calyptia Cloud instead of sending it.
+package dryrun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cmetrics "github.com/calyptia/cmetrics-go"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+)
+
+// Format of the printed output.
+type Format string
+
+const (
+	// FormatText prints each call as a header line followed by its payload,
+	// with metrics in cmetrics text format.
+	FormatText Format = "text"
+	// FormatJSON prints each call as a JSON object per line.
+	FormatJSON Format = "json"
+)
+
+var FormatMap = map[string]Format{
+	string(FormatText): FormatText,
+	string(FormatJSON): FormatJSON,
+}
+
+var nextLabel = regexp.MustCompile(`^,[a-zA-Z_][a-zA-Z0-9_]*="`)
+
+// Token given to agents created on dry-run.
+const Token = "dry-run"
+
+// Client implements the forwarder CloudClient without any network call.
+// Agent creation, updates and metrics are printed to Out instead.
+// Lookups find no agents, so the forwarder always creates one,
+// and no desired config.
+type Client struct {
+	Out io.Writer
+	// Format defaults to FormatText.
+	Format Format
+	// Now defaults to time.Now.
+	Now func() time.Time
+
+	mu sync.Mutex
+}
+
+// Call printed in JSON format.
+type Call struct {
+	Time    time.Time   `json:"time"`
+	Method  string      `json:"method"`
+	AgentID string      `json:"agentID,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+	Metrics []Sample    `json:"metrics,omitempty"`
+}
+
+// Sample decoded from the metrics payload.
+type Sample struct {
+	Time   time.Time         `json:"time"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+func (c *Client) SetAgentToken(token string) {}
+
+func (c *Client) CreateAgent(ctx context.Context, payload cloud.CreateAgentPayload) (cloud.CreatedAgentPayload, error) {
+	out := cloud.CreatedAgentPayload{
+		ID:        "dry-run-" + payload.MachineID,
+		Token:     Token,
+		Name:      payload.Name,
+		CreatedAt: c.now(),
+	}
+
+	return out, c.print(Call{Method: "CreateAgent", Payload: payload}, "")
+}
+
+func (c *Client) UpdateAgent(ctx context.Context, agentID string, in cloud.UpdateAgentOpts) error {
+	return c.print(Call{Method: "UpdateAgent", AgentID: agentID, Payload: in}, "")
+}
+
+func (c *Client) Agent(ctx context.Context, agentID string) (cloud.Agent, error) {
+	return cloud.Agent{ID: agentID}, nil
+}
+
+func (c *Client) Agents(ctx context.Context, params cloud.AgentsParams) (cloud.Agents, error) {
+	return cloud.Agents{Items: []cloud.Agent{}}, nil
+}
+
+func (c *Client) DesiredConfig(ctx context.Context, agentID string, params cloud.DesiredConfigParams) (cloud.DesiredConfig, error) {
+	return cloud.DesiredConfig{}, &cloud.Error{Msg: "no desired config on dry-run", StatusCode: http.StatusNotFound}
+}
+
+func (c *Client) RotateAgentToken(ctx context.Context, agentID string) (cloud.RotatedAgentToken, error) {
+	return cloud.RotatedAgentToken{Token: Token}, c.print(Call{Method: "RotateAgentToken", AgentID: agentID}, "")
+}
+
+func (c *Client) DeleteAgent(ctx context.Context, agentID string) error {
+	return c.print(Call{Method: "DeleteAgent", AgentID: agentID}, "")
+}
+
+func (c *Client) AddAgentMetrics(ctx context.Context, agentID string, msgPackEncoded []byte) (cloud.CreatedAgentMetrics, error) {
+	var out cloud.CreatedAgentMetrics
+
+	metricsContext, err := cmetrics.NewContextFromMsgPack(msgPackEncoded, 0)
+	if err != nil {
+		return out, fmt.Errorf("could not decode metrics msgpack: %w", err)
+	}
+
+	defer metricsContext.Destroy()
+
+	text, err := metricsContext.EncodeText()
+	if err != nil {
+		return out, fmt.Errorf("could not encode metrics as text: %w", err)
+	}
+
+	samples, err := ParseText(text)
+	if err != nil {
+		return out, err
+	}
+
+	out.Total = len(samples)
+	return out, c.print(Call{Method: "AddAgentMetrics", AgentID: agentID, Metrics: samples}, text)
+}
+
+// print the call. Text is printed as is instead of the metrics in text format.
+func (c *Client) print(call Call, text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	call.Time = c.now()
+
+	if c.Format == FormatJSON {
+		return json.NewEncoder(c.Out).Encode(call)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s %s", call.Time.Format(time.RFC3339), call.Method)
+	if call.AgentID != "" {
+		fmt.Fprintf(&sb, " agent_id=%s", call.AgentID)
+	}
+	sb.WriteString("\n")
+
+	if call.Payload != nil {
+		b, err := json.MarshalIndent(call.Payload, "", "  ")
+		if err != nil {
+			return fmt.Errorf("could not json marshal %s payload: %w", call.Method, err)
+		}
+
+		sb.Write(b)
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString(text)
+
+	_, err := io.WriteString(c.Out, sb.String())
+	return err
+}
+
+func (c *Client) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+
+	return time.Now()
+}
+
+// ParseText parses metrics in cmetrics text format.
+// Each line looks like:
+//
+//	2021-09-01T00:00:00.000000000Z fluentbit_input_records{name="dummy.0"} = 10
+func ParseText(text string) ([]Sample, error) {
+	var out []Sample
+	for i, line := range strings.Split(text, "\n") {
+		if line == "" {
+			continue
+		}
+
+		sample, err := parseTextLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse metrics text line %d: %w", i+1, err)
+		}
+
+		out = append(out, sample)
+	}
+
+	return out, nil
+}
+
+func parseTextLine(line string) (Sample, error) {
+	var sample Sample
+
+	sp := strings.IndexByte(line, ' ')
+	if sp == -1 {
+		return sample, fmt.Errorf("missing timestamp on %q", line)
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, line[:sp])
+	if err != nil {
+		return sample, fmt.Errorf("invalid timestamp: %w", err)
+	}
+
+	series := line[sp+1:]
+	eq := strings.LastIndex(series, " = ")
+	if eq == -1 {
+		return sample, fmt.Errorf("missing value on %q", line)
+	}
+
+	value, err := strconv.ParseFloat(series[eq+3:], 64)
+	if err != nil {
+		return sample, fmt.Errorf("invalid value: %w", err)
+	}
+
+	series = series[:eq]
+	sample.Time = ts
+	sample.Value = value
+
+	brace := strings.IndexByte(series, '{')
+	if brace == -1 {
+		sample.Name = series
+		return sample, nil
+	}
+
+	sample.Name = series[:brace]
+	sample.Labels, err = parseLabels(strings.TrimSuffix(series[brace+1:], "}"))
+	if err != nil {
+		return sample, err
+	}
+
+	return sample, nil
+}
+
+// parseLabels like `key="value",other="value"`.
+// Values are not escaped, so a value ends at the quote
+// followed by either the end or the next label key.
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return nil, fmt.Errorf("invalid labels %q", s)
+		}
+
+		key := s[:eq]
+		s = s[eq+2:]
+
+		end := -1
+		for i := 0; i < len(s); i++ {
+			if s[i] == '"' && (i == len(s)-1 || nextLabel.MatchString(s[i+1:])) {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated label value for %q", key)
+		}
+
+		labels[key] = s[:end]
+		s = strings.TrimPrefix(s[end+1:], ",")
+	}
+
+	return labels, nil
+}
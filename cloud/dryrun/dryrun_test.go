@@ -0,0 +1,115 @@
+package dryrun_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	cmetrics "github.com/calyptia/cmetrics-go"
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud/dryrun"
+)
+
+var (
+	_ forwarder.CloudClient          = (*dryrun.Client)(nil)
+	_ forwarder.AgentFetcher         = (*dryrun.Client)(nil)
+	_ forwarder.AgentDeleter         = (*dryrun.Client)(nil)
+	_ forwarder.AgentAdopter         = (*dryrun.Client)(nil)
+	_ forwarder.DesiredConfigFetcher = (*dryrun.Client)(nil)
+)
+
+func TestClient(t *testing.T) {
+	ts := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	msgPackEncoded := testMsgPack(t, ts)
+
+	t.Run("text", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		c := &dryrun.Client{Out: out, Now: func() time.Time { return ts }}
+
+		created, err := c.CreateAgent(context.Background(), cloud.CreateAgentPayload{Name: "test", MachineID: "machine-id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := c.AddAgentMetrics(context.Background(), created.ID, msgPackEncoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Total != 1 {
+			t.Errorf("total = %d, want 1", got.Total)
+		}
+
+		for _, want := range []string{
+			"# 2021-09-01T00:00:00Z CreateAgent\n",
+			`"machineID": "machine-id"`,
+			"# 2021-09-01T00:00:00Z AddAgentMetrics agent_id=dry-run-machine-id\n",
+			`2021-09-01T00:00:00.000000000Z fluentbit_input_records{name="dummy.0",tag="a "b""} = 10`,
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("output %q does not contain %q", out.String(), want)
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		c := &dryrun.Client{Out: out, Format: dryrun.FormatJSON}
+
+		_, err := c.AddAgentMetrics(context.Background(), "agent", msgPackEncoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var call dryrun.Call
+		err = json.Unmarshal(out.Bytes(), &call)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if call.Method != "AddAgentMetrics" || call.AgentID != "agent" || len(call.Metrics) != 1 {
+			t.Fatalf("unexpected call %+v", call)
+		}
+
+		sample := call.Metrics[0]
+		if sample.Name != "fluentbit_input_records" || sample.Value != 10 || !sample.Time.Equal(ts) {
+			t.Errorf("unexpected sample %+v", sample)
+		}
+
+		if sample.Labels["name"] != "dummy.0" || sample.Labels["tag"] != `a "b"` {
+			t.Errorf("unexpected labels %v", sample.Labels)
+		}
+	})
+}
+
+func testMsgPack(t *testing.T, ts time.Time) []byte {
+	t.Helper()
+
+	metricsContext, err := cmetrics.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer metricsContext.Destroy()
+
+	counter, err := metricsContext.CounterCreate("fluentbit", "input", "records", "Number of input records.", []string{"name", "tag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = counter.Set(ts, 10, []string{"dummy.0", `a "b"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := metricsContext.EncodeMsgPack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
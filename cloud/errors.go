@@ -0,0 +1,127 @@
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinel errors to match an *Error against using errors.Is.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+// ErrNotModified is returned as is when the requested resource
+// did not change since the version the client has.
+var ErrNotModified = errors.New("not modified")
+
+// maxErrorBodySize is the max number of bytes read from an error response.
+const maxErrorBodySize = 4 << 10
+
+// maxErrorBodySnippet is the max length of Error.Body.
+const maxErrorBodySnippet = 512
+
+// Error returned by Cloud when responding with a status code >= 400.
+type Error struct {
+	Msg string `json:"error"`
+
+	StatusCode int    `json:"-"`
+	RequestID  string `json:"-"`
+	// Retryable tells whether the same request may succeed if retried later.
+	Retryable bool `json:"-"`
+	// RetryAfter as requested by the server. Zero if not set.
+	RetryAfter time.Duration `json:"-"`
+	// Body is a snippet of the raw response body,
+	// useful when the response did not come from Cloud itself.
+	Body string `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Msg != "" {
+		return e.Msg
+	}
+
+	return fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+// decodeError reads an error response.
+// The body is not required to be JSON, since the response may come from
+// a proxy or load balancer in between.
+func decodeError(resp *http.Response) error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get("X-Request-Id"),
+		Retryable:  isRetryableStatus(resp.StatusCode),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		return fmt.Errorf("could not read error response with status %d: %w", resp.StatusCode, err)
+	}
+
+	e.Body = strings.TrimSpace(string(b))
+	if len(e.Body) > maxErrorBodySnippet {
+		e.Body = e.Body[:maxErrorBodySnippet]
+	}
+
+	if json.Valid(b) {
+		_ = json.Unmarshal(b, e)
+	}
+
+	return e
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// parseRetryAfter parses a "Retry-After" header value,
+// either in seconds or as an HTTP date.
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(s); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,128 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource provides a project or agent token,
+// so it does not have to be passed as a flag or env var.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// invalidator is implemented by token sources that cache the token.
+// The client invalidates the token once Cloud rejects it.
+type invalidator interface {
+	Invalidate()
+}
+
+// FileTokenSource reads the token from a file.
+// The file is read again once it changes,
+// like a Kubernetes secret mount being updated.
+type FileTokenSource struct {
+	Path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func (s *FileTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return "", fmt.Errorf("could not stat token file: %w", err)
+	}
+
+	if s.token != "" && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.token, nil
+	}
+
+	b, err := os.ReadFile(s.Path)
+	if err != nil {
+		return "", fmt.Errorf("could not read token file: %w", err)
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file %q is empty", s.Path)
+	}
+
+	s.token = token
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return token, nil
+}
+
+// Invalidate makes the next call read the file again.
+func (s *FileTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+}
+
+// ExecTokenSource runs a credential helper command
+// and takes the token from its standard output.
+// The token is kept until Cloud rejects it.
+type ExecTokenSource struct {
+	// Command and its arguments.
+	Command []string
+
+	mu    sync.Mutex
+	token string
+}
+
+func (s *ExecTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" {
+		return s.token, nil
+	}
+
+	if len(s.Command) == 0 {
+		return "", errors.New("token command not set")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("could not run token command: %w: %s", err, msg)
+		}
+
+		return "", fmt.Errorf("could not run token command: %w", err)
+	}
+
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return "", errors.New("token command printed an empty token")
+	}
+
+	s.token = token
+	return token, nil
+}
+
+// Invalidate makes the next call run the command again.
+func (s *ExecTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+}
@@ -0,0 +1,137 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	cmetrics "github.com/calyptia/cmetrics-go"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+)
+
+// cloudSink pushes snapshots to Cloud as cmetrics msgpack,
+// and then the payload to every PayloadSink.
+// It uses the cloud client current at push time, so it follows reloads.
+type cloudSink struct {
+	fd      *Forwarder
+	agentID string
+}
+
+func (s *cloudSink) Name() string {
+	return CloudSinkName
+}
+
+func (s *cloudSink) Push(ctx context.Context, snapshot Snapshot) (PushResult, error) {
+	msgPackEncoded, err := EncodeCMetrics(snapshot)
+	if err != nil {
+		return PushResult{}, &SinkError{Err: fmt.Errorf("could not transform snapshot into cmetrics msgpack: %w", err)}
+	}
+
+	created, err := s.fd.settings().cloudClient.AddAgentMetrics(ctx, s.agentID, msgPackEncoded)
+	if err != nil {
+		var e *cloud.Error
+		if errors.As(err, &e) {
+			err = &SinkError{Err: err, Retryable: e.Retryable, RetryAfter: e.RetryAfter}
+		}
+
+		return PushResult{PayloadSize: len(msgPackEncoded)}, err
+	}
+
+	s.fd.pushPayload(ctx, snapshot, msgPackEncoded)
+	return PushResult{Inserted: created.Total, PayloadSize: len(msgPackEncoded)}, nil
+}
+
+// Replay pushes a cmetrics msgpack payload, like an archived one,
+// to Cloud as the stored agent.
+// It is sent as is, compressed as configured on the cloud client.
+// Returns ErrNotRegistered if there is no stored agent.
+func (fd *Forwarder) Replay(ctx context.Context, msgPackEncoded []byte) (cloud.CreatedAgentMetrics, error) {
+	settings := fd.settings()
+	payload, err := fd.storedAgent()
+	if err != nil {
+		return cloud.CreatedAgentMetrics{}, err
+	}
+
+	if payload.AgentToken != "" {
+		settings.cloudClient.SetAgentToken(payload.AgentToken)
+	}
+
+	created, err := settings.cloudClient.AddAgentMetrics(ctx, payload.AgentID, msgPackEncoded)
+	if err != nil {
+		return created, fmt.Errorf("could not add agent metrics: %w", err)
+	}
+
+	return created, nil
+}
+
+// localMetrics only pushed to the sinks other than Cloud,
+// so the Cloud payload keeps the series it always had.
+var localMetrics = map[string]bool{
+	"fluentbit_storage_overlimit": true,
+	"forwarder_alerts_firing":     true,
+}
+
+// EncodeCMetrics encodes the snapshot as cmetrics msgpack,
+// the payload pushed to Cloud.
+// Metrics without samples or only for local sinks are left out,
+// and those without help text get their name as help.
+func EncodeCMetrics(snapshot Snapshot) ([]byte, error) {
+	metricsContext, err := cmetrics.NewContext()
+	if err != nil {
+		return nil, err
+	}
+
+	defer metricsContext.Destroy()
+
+	for _, m := range snapshot.Metrics {
+		if len(m.Samples) == 0 || localMetrics[m.FullName()] {
+			continue
+		}
+
+		// cmetrics requires a help text.
+		help := m.Help
+		if help == "" {
+			help = m.Name
+		}
+
+		switch cloudMetricType(m) {
+		case MetricGauge:
+			gauge, err := metricsContext.GaugeCreate(m.Namespace, m.Subsystem, m.Name, help, m.LabelKeys)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, sample := range m.Samples {
+				err = gauge.Set(snapshot.Time, sample.Value, sample.LabelValues)
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			counter, err := metricsContext.CounterCreate(m.Namespace, m.Subsystem, m.Name, help, m.LabelKeys)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, sample := range m.Samples {
+				err = counter.Set(snapshot.Time, sample.Value, sample.LabelValues)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return metricsContext.EncodeMsgPack()
+}
+
+// cloudMetricType of the metric on the Cloud payload.
+// Storage metrics are levels, typed as gauges on snapshots,
+// but Cloud has always received them as counters.
+func cloudMetricType(m Metric) MetricType {
+	if m.Namespace == "fluentbit" && m.Subsystem == "storage" {
+		return MetricCounter
+	}
+
+	return m.Type
+}
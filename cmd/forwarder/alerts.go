@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/notify"
+)
+
+// alertsConfig with the rules evaluated on each snapshot
+// and where to notify alerts to, besides the log.
+type alertsConfig struct {
+	// WebhookURL is notified like the notifications webhooks
+	// listing only the alert events.
+	WebhookURL string            `yaml:"webhook_url"`
+	Rules      []alertRuleConfig `yaml:"rules"`
+}
+
+type alertRuleConfig struct {
+	Name      string            `yaml:"name"`
+	Metric    string            `yaml:"metric"`
+	Labels    map[string]string `yaml:"labels"`
+	Op        string            `yaml:"op"`
+	Threshold float64           `yaml:"threshold"`
+	For       time.Duration     `yaml:"for"`
+}
+
+// validate the alerts config. Rules on the delta or rate series
+// of the plugin counters need a sink with them on its counter series,
+// as they are not derived otherwise.
+func (cfg alertsConfig) validate(path string, sinks []sinkConfig) error {
+	if cfg.WebhookURL != "" {
+		if err := validateURL(path+".webhook_url", cfg.WebhookURL); err != nil {
+			return err
+		}
+	}
+
+	names := map[string]int{}
+	for i, rule := range cfg.Rules {
+		rulePath := fmt.Sprintf("%s.rules[%d]", path, i)
+
+		if rule.Name == "" {
+			return &configError{Path: rulePath + ".name", Msg: "required"}
+		}
+
+		if j, ok := names[rule.Name]; ok {
+			return &configError{Path: rulePath + ".name", Msg: fmt.Sprintf("duplicated rule %q of %s.rules[%d]", rule.Name, path, j)}
+		}
+
+		names[rule.Name] = i
+
+		if rule.Metric == "" {
+			return &configError{Path: rulePath + ".metric", Msg: "required"}
+		}
+
+		if series, ok := derivedCounterSeries(rule.Metric); ok && !sinksCounterSeries(sinks, series) {
+			return &configError{Path: rulePath + ".metric", Msg: fmt.Sprintf("never matches: no sink has %q on its counter series", series)}
+		}
+
+		if _, ok := forwarder.AlertOpMap[rule.Op]; !ok {
+			return &configError{Path: rulePath + ".op", Msg: fmt.Sprintf("invalid op %q", rule.Op)}
+		}
+
+		if rule.For < 0 {
+			return &configError{Path: rulePath + ".for", Msg: "cannot be negative"}
+		}
+	}
+
+	return nil
+}
+
+// derivedCounterSeries tells the counter series a metric
+// like "fluentbit_input_records_per_second" is derived as.
+func derivedCounterSeries(metric string) (forwarder.CounterSeries, bool) {
+	if !strings.HasPrefix(metric, "fluentbit_input_") && !strings.HasPrefix(metric, "fluentbit_output_") {
+		return "", false
+	}
+
+	switch {
+	case strings.HasSuffix(metric, "_delta"):
+		return forwarder.CounterSeriesDelta, true
+	case strings.HasSuffix(metric, "_per_second"):
+		return forwarder.CounterSeriesRate, true
+	}
+
+	return "", false
+}
+
+// sinksCounterSeries tells whether any sink has the series on its counter series.
+func sinksCounterSeries(sinks []sinkConfig, series forwarder.CounterSeries) bool {
+	for _, sink := range sinks {
+		for _, s := range sink.CounterSeries {
+			if s == string(series) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (cfg alertsConfig) rules() []forwarder.AlertRule {
+	if len(cfg.Rules) == 0 {
+		return nil
+	}
+
+	out := make([]forwarder.AlertRule, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		out[i] = forwarder.AlertRule{
+			Name:      rule.Name,
+			Metric:    rule.Metric,
+			Labels:    rule.Labels,
+			Op:        forwarder.AlertOpMap[rule.Op],
+			Threshold: rule.Threshold,
+			For:       rule.For,
+		}
+	}
+
+	return out
+}
+
+// webhook notifying the firing and resolved alerts, if set.
+func (cfg alertsConfig) webhook() *notify.Webhook {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+
+	return &notify.Webhook{
+		URL:    cfg.WebhookURL,
+		Format: notify.FormatGeneric,
+		Events: []forwarder.EventKind{forwarder.EventAlertFiring, forwarder.EventAlertResolved},
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// runRegister registers the configured agents on Cloud and stores their credentials.
+func runRegister(ctx context.Context, logger *log.SwapLogger, args []string) error {
+	return runLifecycle(ctx, logger, args, true, func(ctx context.Context, fd *forwarder.Forwarder) (forwarder.StorePayload, string, error) {
+		payload, err := fd.Register(ctx)
+		if err != nil {
+			return payload, "", err
+		}
+
+		return payload, "registered", nil
+	})
+}
+
+// runStatus prints the stored agents and checks their tokens against Cloud.
+func runStatus(ctx context.Context, logger *log.SwapLogger, args []string) error {
+	return runLifecycle(ctx, logger, args, false, func(ctx context.Context, fd *forwarder.Forwarder) (forwarder.StorePayload, string, error) {
+		payload, err := fd.VerifyAgent(ctx)
+		if err != nil {
+			return payload, "", err
+		}
+
+		return payload, "valid", nil
+	})
+}
+
+// runUnregister deletes the configured agents from Cloud and erases them from the store.
+func runUnregister(ctx context.Context, logger *log.SwapLogger, args []string) error {
+	return runLifecycle(ctx, logger, args, false, func(ctx context.Context, fd *forwarder.Forwarder) (forwarder.StorePayload, string, error) {
+		payload, err := fd.Unregister(ctx)
+		if err != nil {
+			return payload, "", err
+		}
+
+		return payload, "unregistered", nil
+	})
+}
+
+// runLifecycle runs the given action for each configured agent
+// and prints a table with the outcome to stdout.
+// The Fluent Bit config files are only read if the action sends them to Cloud.
+// It fails if the action failed for any agent.
+func runLifecycle(ctx context.Context, logger *log.SwapLogger, args []string, sendsConfig bool, action func(context.Context, *forwarder.Forwarder) (forwarder.StorePayload, string, error)) error {
+	fds, _, err := commandForwarders(logger, args, sendsConfig)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MACHINE ID\tAGENT ID\tAGENT NAME\tSTATUS")
+
+	var failed int
+	for _, fd := range fds {
+		payload, status, err := action(ctx, fd)
+		if errors.Is(err, forwarder.ErrNotRegistered) {
+			status = "not registered"
+			failed++
+		} else if err != nil {
+			status = err.Error()
+			failed++
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", fd.MachineID, dash(payload.AgentID), dash(payload.AgentName), status)
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("failed for %d of %d agents", failed, len(fds))
+	}
+
+	return nil
+}
+
+// runReplay sends the payloads archived on a directory to Cloud again,
+// each one as the agent stored for its machine ID.
+// Payloads of machine IDs not configured are skipped.
+func runReplay(ctx context.Context, logger *log.SwapLogger, args []string) error {
+	fds, rest, err := commandForwarders(logger, args, false)
+	if err != nil {
+		return err
+	}
+
+	if len(rest) != 1 {
+		return errors.New("usage: forwarder replay [flags] <dir>")
+	}
+
+	dir := rest[0]
+
+	byMachineID := make(map[string]*forwarder.Forwarder, len(fds))
+	for _, fd := range fds {
+		byMachineID[fd.MachineID] = fd
+	}
+
+	var replayed, skipped, inserted int
+	err = sinks.ReadArchive(dir, func(record sinks.ArchiveRecord) error {
+		fd, ok := byMachineID[record.MachineID]
+		if !ok {
+			skipped++
+			return nil
+		}
+
+		created, err := fd.Replay(ctx, record.Payload)
+		if err != nil {
+			return fmt.Errorf("could not replay payload of machine ID %s at %s: %w", record.MachineID, record.Time.Format(time.RFC3339), err)
+		}
+
+		replayed++
+		inserted += created.Total
+		return nil
+	})
+
+	_ = level.Info(logger).Log("msg", "replayed archive", "replayed", replayed, "skipped", skipped, "inserted", inserted)
+	if err != nil {
+		return fmt.Errorf("could not replay archive: %w", err)
+	}
+
+	return nil
+}
+
+// commandForwarders parses the flags and config,
+// and returns the forwarders of the configured agents without running them,
+// along with the arguments left after the flags.
+// Their Fluent Bit config files are read only with readConfigFiles.
+func commandForwarders(logger *log.SwapLogger, args []string, readConfigFiles bool) ([]*forwarder.Forwarder, []string, error) {
+	readConfig, rest, err := parseFlags(logger, args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configuredLogger, err := newLogger(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger.Swap(configuredLogger)
+
+	sup := &supervisor{
+		Store:           newStore(cfg.DryRun),
+		Logger:          logger,
+		SkipConfigFiles: !readConfigFiles,
+	}
+
+	fds, err := sup.forwarders(cfg)
+	return fds, rest, err
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
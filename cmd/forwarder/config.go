@@ -0,0 +1,617 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud/dryrun"
+	"gopkg.in/yaml.v3"
+)
+
+// config of the forwarder.
+// It is built from flags and env vars, and optionally overridden by a YAML file.
+type config struct {
+	Cloud              cloudConfig         `yaml:"cloud"`
+	ListenAddr         string              `yaml:"listen_addr"`
+	IncludeSelfMetrics bool                `yaml:"include_self_metrics"`
+	ReadyPushIntervals int                 `yaml:"ready_push_intervals"`
+	BufferSize         int                 `yaml:"buffer_size"`
+	CounterResets      string              `yaml:"counter_resets"`
+	Alerts             alertsConfig        `yaml:"alerts"`
+	Notifications      notificationsConfig `yaml:"notifications"`
+	Log                logConfig           `yaml:"log"`
+	Agents             []agentConfig       `yaml:"agents"`
+	Sinks              []sinkConfig        `yaml:"sinks"`
+	// DryRun and DryRunFormat can only be set with flags.
+	DryRun       bool   `yaml:"-"`
+	DryRunFormat string `yaml:"-"`
+}
+
+type cloudConfig struct {
+	URL                 string         `yaml:"url"`
+	ProjectToken        string         `yaml:"project_token"`
+	ProjectTokenFile    string         `yaml:"project_token_file"`
+	ProjectTokenCommand string         `yaml:"project_token_command"`
+	Compression         string         `yaml:"compression"`
+	HTTP                httpClientOpts `yaml:"http"`
+}
+
+type logConfig struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+// agentConfig of each Fluent Bit agent to forward metrics from.
+// Unset fields default to the agent flags.
+type agentConfig struct {
+	URL           string            `yaml:"url"`
+	Hostname      string            `yaml:"hostname"`
+	MachineID     string            `yaml:"machine_id"`
+	AgentID       string            `yaml:"agent_id"`
+	TokenFile     string            `yaml:"agent_token_file"`
+	TokenCommand  string            `yaml:"agent_token_command"`
+	ForceRegister bool              `yaml:"force_register"`
+	ConfigFile    string            `yaml:"config_file"`
+	PullInterval  time.Duration     `yaml:"pull_interval"`
+	Labels        map[string]string `yaml:"labels"`
+	HTTP          httpClientOpts    `yaml:"http"`
+	ConfigSync    configSyncConfig  `yaml:"config_sync"`
+}
+
+// configError points at the offending key of a config file.
+type configError struct {
+	File   string
+	Line   int
+	Column int
+	Path   string
+	Msg    string
+}
+
+func (e *configError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.File)
+	if e.Line != 0 {
+		fmt.Fprintf(&sb, ":%d:%d", e.Line, e.Column)
+	}
+	if e.Path != "" {
+		sb.WriteString(": ")
+		sb.WriteString(e.Path)
+	}
+	sb.WriteString(": ")
+	sb.WriteString(e.Msg)
+	return sb.String()
+}
+
+// loadConfig reads the YAML config file at path over the given defaults.
+func loadConfig(path string, defaults config) (config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return config{}, fmt.Errorf("could not read config file: %w", err)
+	}
+
+	return parseConfig(path, b, defaults)
+}
+
+// parseConfig parses the YAML config over the given defaults.
+// Env vars are expanded on the parsed string values using "$VAR", "${VAR}"
+// or "${VAR:-default}" syntax, so their values are never parsed as YAML.
+// Use "$$" for a literal "$".
+// Agents without a setting take it from the first default agent.
+func parseConfig(file string, b []byte, defaults config) (config, error) {
+	var root yaml.Node
+	err := yaml.Unmarshal(b, &root)
+	if err != nil {
+		return config{}, yamlError(file, err)
+	}
+
+	expandEnvNodes(&root)
+
+	var defaultAgent agentConfig
+	if len(defaults.Agents) != 0 {
+		defaultAgent = defaults.Agents[0]
+	}
+
+	cfg := defaults
+	if len(root.Content) != 0 {
+		if key, t := unknownField(&root, reflect.TypeOf(cfg)); key != nil {
+			return config{}, fmt.Errorf("%s: line %d: field %s not found in type %s", file, key.Line, key.Value, t)
+		}
+
+		err = root.Decode(&cfg)
+		if err != nil {
+			return config{}, yamlError(file, err)
+		}
+	}
+
+	// A project token setting in the file takes precedence over the project token flags.
+	tokenKeys := []string{"cloud.project_token", "cloud.project_token_file", "cloud.project_token_command"}
+	tokenFields := []*string{&cfg.Cloud.ProjectToken, &cfg.Cloud.ProjectTokenFile, &cfg.Cloud.ProjectTokenCommand}
+	var tokenInFile bool
+	for _, key := range tokenKeys {
+		if nodeAt(&root, key) != nil {
+			tokenInFile = true
+		}
+	}
+	if tokenInFile {
+		for i, key := range tokenKeys {
+			if nodeAt(&root, key) == nil {
+				*tokenFields[i] = ""
+			}
+		}
+	}
+
+	if agentsNode := nodeAt(&root, "agents"); agentsNode != nil && agentsNode.Kind == yaml.SequenceNode {
+		cfg.Agents = make([]agentConfig, len(agentsNode.Content))
+		for i, n := range agentsNode.Content {
+			agent := defaultAgent
+			err = n.Decode(&agent)
+			if err != nil {
+				return config{}, yamlError(file, err)
+			}
+
+			cfg.Agents[i] = agent
+		}
+	} else if len(cfg.Agents) == 0 {
+		cfg.Agents = defaults.Agents
+	}
+
+	for i, agent := range cfg.Agents {
+		if len(cfg.Agents) == 1 || agent.URL == defaultAgent.URL {
+			continue
+		}
+
+		path := fmt.Sprintf("agents[%d]", i)
+
+		// Derive a unique machine ID for each extra agent in the same host
+		// from its URL, so it is kept when the agents get reordered.
+		// The agent on the default URL keeps the machine ID of the host.
+		if agent.MachineID == defaultAgent.MachineID && nodeAt(&root, path+".machine_id") == nil {
+			cfg.Agents[i].MachineID = derivedMachineID(defaultAgent.MachineID, agent.URL)
+		}
+
+		// Extra agents do not share the pre-provisioned agent of the flags,
+		// so each one gets registered with its own credentials.
+		identityKeys := []string{"agent_id", "agent_token_file", "agent_token_command"}
+		identityFields := []*string{&cfg.Agents[i].AgentID, &cfg.Agents[i].TokenFile, &cfg.Agents[i].TokenCommand}
+		for j, key := range identityKeys {
+			if nodeAt(&root, path+"."+key) == nil {
+				*identityFields[j] = ""
+			}
+		}
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		var cfgErr *configError
+		if errors.As(err, &cfgErr) {
+			cfgErr.File = file
+			if n := nodeAt(&root, cfgErr.Path); n != nil {
+				cfgErr.Line = n.Line
+				cfgErr.Column = n.Column
+			}
+		}
+		return config{}, err
+	}
+
+	return cfg, nil
+}
+
+// derivedMachineID of an extra agent in the same host,
+// like "machine-1a2b3c4d", stable for the agent URL.
+func derivedMachineID(machineID, agentURL string) string {
+	sum := sha256.Sum256([]byte(agentURL))
+	return machineID + "-" + hex.EncodeToString(sum[:4])
+}
+
+func (cfg config) validate() error {
+	if err := validateURL("cloud.url", cfg.Cloud.URL); err != nil {
+		return err
+	}
+
+	if cfg.Cloud.ProjectToken != "" && cfg.Cloud.ProjectTokenFile != "" {
+		return &configError{Path: "cloud.project_token_file", Msg: "cannot be set along with project_token"}
+	}
+
+	if cfg.Cloud.ProjectTokenCommand != "" && (cfg.Cloud.ProjectToken != "" || cfg.Cloud.ProjectTokenFile != "") {
+		return &configError{Path: "cloud.project_token_command", Msg: "cannot be set along with project_token or project_token_file"}
+	}
+
+	if _, ok := cloud.CompressionMap[cfg.Cloud.Compression]; !ok {
+		return &configError{Path: "cloud.compression", Msg: fmt.Sprintf("invalid compression %q", cfg.Cloud.Compression)}
+	}
+
+	if err := validateHTTP("cloud.http", cfg.Cloud.HTTP); err != nil {
+		return err
+	}
+
+	if cfg.ReadyPushIntervals < 0 {
+		return &configError{Path: "ready_push_intervals", Msg: "cannot be negative"}
+	}
+
+	if cfg.BufferSize < 0 {
+		return &configError{Path: "buffer_size", Msg: "cannot be negative"}
+	}
+
+	if _, ok := forwarder.CounterResetsMap[cfg.CounterResets]; !ok {
+		return &configError{Path: "counter_resets", Msg: fmt.Sprintf("invalid counter resets %q", cfg.CounterResets)}
+	}
+
+	if err := cfg.Alerts.validate("alerts", cfg.Sinks); err != nil {
+		return err
+	}
+
+	if err := cfg.Notifications.validate("notifications"); err != nil {
+		return err
+	}
+
+	if cfg.Log.Format != "logfmt" && cfg.Log.Format != "json" {
+		return &configError{Path: "log.format", Msg: fmt.Sprintf("invalid log format %q", cfg.Log.Format)}
+	}
+
+	if _, ok := logLevels[cfg.Log.Level]; !ok {
+		return &configError{Path: "log.level", Msg: fmt.Sprintf("invalid log level %q", cfg.Log.Level)}
+	}
+
+	if cfg.DryRun {
+		if _, ok := dryrun.FormatMap[cfg.DryRunFormat]; !ok {
+			return &configError{Path: "dry_run_format", Msg: fmt.Sprintf("invalid dry-run format %q", cfg.DryRunFormat)}
+		}
+	}
+
+	sinkNames := map[string]int{}
+	for i, sink := range cfg.Sinks {
+		if err := sink.validate(fmt.Sprintf("sinks[%d]", i)); err != nil {
+			return err
+		}
+
+		name := sink.name()
+		if j, ok := sinkNames[name]; ok {
+			return &configError{Path: fmt.Sprintf("sinks[%d]", i), Msg: fmt.Sprintf("duplicated sink %q of sinks[%d]", name, j)}
+		}
+
+		sinkNames[name] = i
+	}
+
+	if len(cfg.Agents) == 0 {
+		return &configError{Path: "agents", Msg: "at least one agent is required"}
+	}
+
+	machineIDs := map[string]int{}
+	agentIDs := map[string]int{}
+	for i, agent := range cfg.Agents {
+		path := fmt.Sprintf("agents[%d]", i)
+
+		if err := validateURL(path+".url", agent.URL); err != nil {
+			return err
+		}
+
+		if agent.PullInterval <= 0 {
+			return &configError{Path: path + ".pull_interval", Msg: "must be greater than zero"}
+		}
+
+		if agent.MachineID != "" {
+			if j, ok := machineIDs[agent.MachineID]; ok {
+				return &configError{Path: path + ".machine_id", Msg: fmt.Sprintf("duplicated machine ID %q of agents[%d]", agent.MachineID, j)}
+			}
+
+			machineIDs[agent.MachineID] = i
+		}
+
+		if agent.TokenFile != "" && agent.TokenCommand != "" {
+			return &configError{Path: path + ".agent_token_command", Msg: "cannot be set along with agent_token_file"}
+		}
+
+		if agent.AgentID == "" && (agent.TokenFile != "" || agent.TokenCommand != "") {
+			return &configError{Path: path + ".agent_id", Msg: "required with agent_token_file or agent_token_command"}
+		}
+
+		if agent.AgentID != "" {
+			if agent.TokenFile == "" && agent.TokenCommand == "" {
+				return &configError{Path: path + ".agent_id", Msg: "requires agent_token_file or agent_token_command"}
+			}
+
+			if j, ok := agentIDs[agent.AgentID]; ok {
+				return &configError{Path: path + ".agent_id", Msg: fmt.Sprintf("duplicated agent ID %q of agents[%d]", agent.AgentID, j)}
+			}
+
+			agentIDs[agent.AgentID] = i
+		}
+
+		if err := validateHTTP(path+".http", agent.HTTP); err != nil {
+			return err
+		}
+
+		if err := agent.ConfigSync.validate(path+".config_sync", agent, cfg.Cloud.HTTP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateURL(path, s string) error {
+	if s == "" {
+		return &configError{Path: path, Msg: "required"}
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return &configError{Path: path, Msg: fmt.Sprintf("invalid URL: %v", err)}
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &configError{Path: path, Msg: fmt.Sprintf("invalid URL scheme %q", u.Scheme)}
+	}
+
+	return nil
+}
+
+func validateHTTP(path string, opts httpClientOpts) error {
+	if opts.Timeout < 0 {
+		return &configError{Path: path + ".timeout", Msg: "cannot be negative"}
+	}
+
+	if opts.TLSMinVersion != "" {
+		if _, ok := tlsVersions[opts.TLSMinVersion]; !ok {
+			return &configError{Path: path + ".tls_min_version", Msg: fmt.Sprintf("invalid TLS min version %q", opts.TLSMinVersion)}
+		}
+	}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return &configError{Path: path + ".tls_cert_file", Msg: "both tls_cert_file and tls_key_file are required for mTLS"}
+	}
+
+	return nil
+}
+
+// expandEnvNodes expands env vars on the scalar values of the tree,
+// leaving keys as they are. Plain scalars get their type resolved again,
+// so "${BUFFER_SIZE}" can be a number, unless expanded to a null literal.
+func expandEnvNodes(n *yaml.Node) {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			expandEnvNodes(c)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			expandEnvNodes(n.Content[i])
+		}
+	case yaml.ScalarNode:
+		v := expandEnv(n.Value)
+		if v == n.Value {
+			return
+		}
+
+		n.Value = v
+		if n.Style == 0 && n.Tag == "!!str" {
+			switch v {
+			case "~", "null", "Null", "NULL":
+			default:
+				n.Tag = ""
+			}
+		}
+	}
+}
+
+// expandEnv replaces "$VAR", "${VAR}" and "${VAR:-default}" with env vars,
+// and "$$" with "$". Any other "$" is kept as is.
+func expandEnv(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		switch next := s[i+1]; {
+		case next == '$':
+			sb.WriteByte('$')
+			i++
+		case next == '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end == -1 || !isEnvName(strings.SplitN(s[i+2:i+2+end], ":-", 2)[0]) {
+				sb.WriteByte('$')
+				continue
+			}
+
+			sb.WriteString(lookupEnv(s[i+2 : i+2+end]))
+			i += end + 2
+		case isEnvNameStart(next):
+			end := i + 2
+			for end < len(s) && (isEnvNameStart(s[end]) || s[end] >= '0' && s[end] <= '9') {
+				end++
+			}
+
+			sb.WriteString(os.Getenv(s[i+1 : end]))
+			i = end - 1
+		default:
+			sb.WriteByte('$')
+		}
+	}
+
+	return sb.String()
+}
+
+// lookupEnv of "VAR" or "VAR:-default".
+func lookupEnv(expr string) string {
+	if i := strings.Index(expr, ":-"); i != -1 {
+		if v, ok := os.LookupEnv(expr[:i]); ok && v != "" {
+			return v
+		}
+
+		return expr[i+2:]
+	}
+
+	return os.Getenv(expr)
+}
+
+func isEnvName(s string) bool {
+	if s == "" || !isEnvNameStart(s[0]) {
+		return false
+	}
+
+	for i := 1; i < len(s); i++ {
+		if !isEnvNameStart(s[i]) && (s[i] < '0' || s[i] > '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isEnvNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// unknownField returns the first mapping key of the tree not matching
+// a field of the struct decoded into, along with the struct type.
+func unknownField(n *yaml.Node, t reflect.Type) (*yaml.Node, reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			if key, kt := unknownField(c, t); key != nil {
+				return key, kt
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return nil, nil
+		}
+
+		for _, c := range n.Content {
+			if key, kt := unknownField(c, t.Elem()); key != nil {
+				return key, kt
+			}
+		}
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Map:
+			for i := 1; i < len(n.Content); i += 2 {
+				if key, kt := unknownField(n.Content[i], t.Elem()); key != nil {
+					return key, kt
+				}
+			}
+		case reflect.Struct:
+			fields := yamlFields(t)
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				ft, ok := fields[n.Content[i].Value]
+				if !ok {
+					return n.Content[i], t
+				}
+
+				if key, kt := unknownField(n.Content[i+1], ft); key != nil {
+					return key, kt
+				}
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// yamlFields of the struct by their YAML key.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	out := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		out[name] = f.Type
+	}
+
+	return out
+}
+
+// nodeAt returns the node at the given path like "agents[0].url",
+// or nil if not found.
+func nodeAt(root *yaml.Node, path string) *yaml.Node {
+	n := root
+	if n.Kind == yaml.DocumentNode {
+		if len(n.Content) == 0 {
+			return nil
+		}
+		n = n.Content[0]
+	}
+
+	if path == "" {
+		return n
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		var indexes []int
+		if i := strings.Index(part, "["); i != -1 {
+			key = part[:i]
+			for _, idx := range strings.Split(strings.TrimSuffix(part[i+1:], "]"), "][") {
+				v, err := strconv.Atoi(idx)
+				if err != nil {
+					return nil
+				}
+				indexes = append(indexes, v)
+			}
+		}
+
+		n = mappingValue(n, key)
+		if n == nil {
+			return nil
+		}
+
+		for _, idx := range indexes {
+			if n.Kind != yaml.SequenceNode || idx < 0 || idx >= len(n.Content) {
+				return nil
+			}
+			n = n.Content[idx]
+		}
+	}
+
+	return n
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// yamlError prefixes YAML syntax and decoding errors with the file name.
+func yamlError(file string, err error) error {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("%s: %s", file, strings.Join(typeErr.Errors, "; "))
+	}
+
+	return fmt.Errorf("%s: %w", file, err)
+}
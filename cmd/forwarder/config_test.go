@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_parseConfig(t *testing.T) {
+	defaults := config{
+		Cloud: cloudConfig{
+			URL:          "https://cloud.example.org",
+			ProjectToken: "flag-token",
+			Compression:  "gzip",
+		},
+		CounterResets: "none",
+		Log:           logConfig{Format: "logfmt", Level: "info"},
+		Agents: []agentConfig{{
+			URL:          "http://localhost:2020",
+			MachineID:    "machine",
+			PullInterval: time.Second * 5,
+		}},
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		os.Setenv("TEST_CONFIG_TOKEN_FILE", "/run/secrets/token")
+		defer os.Unsetenv("TEST_CONFIG_TOKEN_FILE")
+
+		cfg, err := parseConfig("forwarder.yaml", []byte(`
+cloud:
+  project_token_file: ${TEST_CONFIG_TOKEN_FILE}
+  http:
+    timeout: 30s
+buffer_size: 10
+log:
+  level: ${TEST_CONFIG_LOG_LEVEL:-debug}
+agents:
+  - hostname: one
+    labels:
+      env: prod
+  - url: http://localhost:2021
+    pull_interval: 10s
+`), defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := "/run/secrets/token", cfg.Cloud.ProjectTokenFile; want != got {
+			t.Errorf("want project token file %q; got %q", want, got)
+		}
+		if cfg.Cloud.ProjectToken != "" {
+			t.Errorf("want project token flag to be overridden; got %q", cfg.Cloud.ProjectToken)
+		}
+		if want, got := time.Second*30, cfg.Cloud.HTTP.Timeout; want != got {
+			t.Errorf("want cloud timeout %v; got %v", want, got)
+		}
+		if want, got := "debug", cfg.Log.Level; want != got {
+			t.Errorf("want log level %q; got %q", want, got)
+		}
+		if want, got := 10, cfg.BufferSize; want != got {
+			t.Errorf("want buffer size %d; got %d", want, got)
+		}
+		if want, got := 2, len(cfg.Agents); want != got {
+			t.Fatalf("want %d agents; got %d", want, got)
+		}
+
+		first, second := cfg.Agents[0], cfg.Agents[1]
+		if want, got := "http://localhost:2020", first.URL; want != got {
+			t.Errorf("want default agent url %q; got %q", want, got)
+		}
+		if want, got := "prod", first.Labels["env"]; want != got {
+			t.Errorf("want label %q; got %q", want, got)
+		}
+		if want, got := "machine", first.MachineID; want != got {
+			t.Errorf("want machine ID %q; got %q", want, got)
+		}
+		if want, got := derivedMachineID("machine", "http://localhost:2021"), second.MachineID; want != got {
+			t.Errorf("want derived machine ID %q; got %q", want, got)
+		}
+		if want, got := time.Second*10, second.PullInterval; want != got {
+			t.Errorf("want pull interval %v; got %v", want, got)
+		}
+	})
+
+	t.Run("env", func(t *testing.T) {
+		token := "a: b # c\nlog:\n  level: debug\n'\""
+		os.Setenv("TEST_CONFIG_TOKEN", token)
+		os.Setenv("TEST_CONFIG_BUFFER_SIZE", "7")
+		defer os.Unsetenv("TEST_CONFIG_TOKEN")
+		defer os.Unsetenv("TEST_CONFIG_BUFFER_SIZE")
+
+		cfg, err := parseConfig("forwarder.yaml", []byte(`
+cloud:
+  project_token: ${TEST_CONFIG_TOKEN}
+buffer_size: ${TEST_CONFIG_BUFFER_SIZE}
+notifications:
+  webhooks:
+    - url: http://localhost/hook
+      secret: s3cr$$t$ $1
+`), defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := token, cfg.Cloud.ProjectToken; want != got {
+			t.Errorf("want project token %q; got %q", want, got)
+		}
+		if want, got := "info", cfg.Log.Level; want != got {
+			t.Errorf("want log level %q; got %q", want, got)
+		}
+		if want, got := 7, cfg.BufferSize; want != got {
+			t.Errorf("want buffer size %d; got %d", want, got)
+		}
+		if want, got := "s3cr$t$ $1", cfg.Notifications.Webhooks[0].Secret; want != got {
+			t.Errorf("want webhook secret %q; got %q", want, got)
+		}
+	})
+
+	t.Run("extra_agents_identity", func(t *testing.T) {
+		defaults := defaults
+		defaults.Agents = []agentConfig{defaults.Agents[0]}
+		defaults.Agents[0].AgentID = "flag-agent"
+		defaults.Agents[0].TokenFile = "/run/secrets/agent-token"
+
+		cfg, err := parseConfig("forwarder.yaml", []byte(`
+agents:
+  - url: http://localhost:2021
+  - url: http://localhost:2020
+  - url: http://localhost:2022
+    agent_id: sidecar
+    agent_token_command: print-token sidecar
+`), defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		extra, flagged, sidecar := cfg.Agents[0], cfg.Agents[1], cfg.Agents[2]
+		if extra.AgentID != "" || extra.TokenFile != "" {
+			t.Errorf("want extra agent without the flags agent; got ID %q and token file %q", extra.AgentID, extra.TokenFile)
+		}
+		if want, got := "flag-agent", flagged.AgentID; want != got {
+			t.Errorf("want agent ID %q; got %q", want, got)
+		}
+		if want, got := "sidecar", sidecar.AgentID; want != got {
+			t.Errorf("want agent ID %q; got %q", want, got)
+		}
+		if sidecar.TokenFile != "" {
+			t.Errorf("want sidecar agent not to inherit the flags token file; got %q", sidecar.TokenFile)
+		}
+	})
+
+	t.Run("reordered_agents", func(t *testing.T) {
+		cfg, err := parseConfig("forwarder.yaml", []byte(`
+agents:
+  - url: http://localhost:2021
+  - url: http://localhost:2022
+  - url: http://localhost:2020
+`), defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"http://localhost:2020": "machine",
+			"http://localhost:2021": derivedMachineID("machine", "http://localhost:2021"),
+			"http://localhost:2022": derivedMachineID("machine", "http://localhost:2022"),
+		}
+		for _, agent := range cfg.Agents {
+			if want, got := want[agent.URL], agent.MachineID; want != got {
+				t.Errorf("want machine ID %q for %s; got %q", want, agent.URL, got)
+			}
+		}
+	})
+
+	tt := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name:    "unknown_key",
+			yaml:    "cloud:\n  urll: http://localhost\n",
+			wantErr: "forwarder.yaml: line 2: field urll not found in type main.cloudConfig",
+		},
+		{
+			name:    "invalid_duration",
+			yaml:    "agents:\n  - pull_interval: soon\n",
+			wantErr: "forwarder.yaml: line 2: cannot unmarshal !!str `soon` into time.Duration",
+		},
+		{
+			name:    "invalid_value",
+			yaml:    "agents:\n  - url: http://localhost:2020\n  - pull_interval: -1s\n",
+			wantErr: "forwarder.yaml:3:20: agents[1].pull_interval: must be greater than zero",
+		},
+		{
+			name:    "duplicated_machine_id",
+			yaml:    "agents:\n  - machine_id: a\n  - machine_id: a\n",
+			wantErr: `forwarder.yaml:3:17: agents[1].machine_id: duplicated machine ID "a" of agents[0]`,
+		},
+		{
+			name:    "agent_id_without_token",
+			yaml:    "agents:\n  - agent_id: agent\n",
+			wantErr: "forwarder.yaml:2:15: agents[0].agent_id: requires agent_token_file or agent_token_command",
+		},
+		{
+			name:    "invalid_compression",
+			yaml:    "cloud:\n  compression: brotli\n",
+			wantErr: `forwarder.yaml:2:16: cloud.compression: invalid compression "brotli"`,
+		},
+		{
+			name:    "invalid_counter_resets",
+			yaml:    "counter_resets: reset\n",
+			wantErr: `forwarder.yaml:1:17: counter_resets: invalid counter resets "reset"`,
+		},
+		{
+			name:    "invalid_alert_op",
+			yaml:    "alerts:\n  rules:\n    - name: chunks_down\n      metric: fluentbit_storage_fs_chunks_down\n      op: =>\n",
+			wantErr: `forwarder.yaml:5:11: alerts.rules[0].op: invalid op "=>"`,
+		},
+		{
+			name:    "duplicated_alert_rule",
+			yaml:    "alerts:\n  rules:\n    - name: errors\n      metric: fluentbit_output_errors\n      op: increase\n    - name: errors\n      metric: fluentbit_output_retries_failed\n      op: increase\n",
+			wantErr: `forwarder.yaml:6:13: alerts.rules[1].name: duplicated rule "errors" of alerts.rules[0]`,
+		},
+		{
+			name:    "pagerduty_webhook_without_routing_key",
+			yaml:    "notifications:\n  webhooks:\n    - format: pagerduty\n",
+			wantErr: "forwarder.yaml: notifications.webhooks[0].routing_key: required with pagerduty format",
+		},
+		{
+			name:    "invalid_webhook_event",
+			yaml:    "notifications:\n  webhooks:\n    - url: http://localhost/hook\n      events: [registered, push_succeeded]\n",
+			wantErr: `forwarder.yaml:4:28: notifications.webhooks[0].events[1]: invalid event "push_succeeded"`,
+		},
+		{
+			name:    "invalid_config_sync_reload",
+			yaml:    "agents:\n  - config_file: fluent-bit.conf\n    config_sync:\n      enabled: true\n      reload: restart\n",
+			wantErr: `forwarder.yaml:5:15: agents[0].config_sync.reload: invalid reload "restart"`,
+		},
+		{
+			name:    "config_sync_without_config_file",
+			yaml:    "agents:\n  - config_sync:\n      enabled: true\n      reload: http\n",
+			wantErr: "forwarder.yaml:3:16: agents[0].config_sync.enabled: requires config_file",
+		},
+		{
+			name:    "alert_rule_on_series_not_derived",
+			yaml:    "alerts:\n  rules:\n    - name: slow\n      metric: fluentbit_input_records_per_second\n      op: <\n      threshold: 1\nsinks:\n  - type: file\n    path: a.ndjson\n    counter_series: [delta]\n",
+			wantErr: `forwarder.yaml:4:15: alerts.rules[0].metric: never matches: no sink has "rate" on its counter series`,
+		},
+		{
+			name:    "invalid_sink_type",
+			yaml:    "sinks:\n  - type: kafka\n",
+			wantErr: `forwarder.yaml:2:11: sinks[0].type: invalid sink type "kafka"`,
+		},
+		{
+			name:    "otlp_sink_without_url",
+			yaml:    "sinks:\n  - type: otlp\n    headers:\n      api-key: secret\n",
+			wantErr: "forwarder.yaml: sinks[0].url: required",
+		},
+		{
+			name:    "remote_write_sink_with_bearer_token_and_username",
+			yaml:    "sinks:\n  - type: remote_write\n    url: http://localhost:9009/api/v1/push\n    username: user\n    bearer_token: secret\n",
+			wantErr: "forwarder.yaml:5:19: sinks[0].bearer_token: cannot be set along with username or password",
+		},
+		{
+			name:    "statsd_sink_without_port",
+			yaml:    "sinks:\n  - type: statsd\n    address: localhost\n",
+			wantErr: "forwarder.yaml:3:14: sinks[0].address: invalid address: address localhost: missing port in address",
+		},
+		{
+			name:    "influxdb_sink_with_invalid_scheme",
+			yaml:    "sinks:\n  - type: influxdb\n    url: tcp://localhost:8089\n",
+			wantErr: `forwarder.yaml:3:10: sinks[0].url: invalid URL scheme "tcp"`,
+		},
+		{
+			name:    "invalid_counter_series",
+			yaml:    "sinks:\n  - type: file\n    path: a.ndjson\n    counter_series: [cumulative, average]\n",
+			wantErr: `forwarder.yaml:4:34: sinks[0].counter_series[1]: invalid counter series "average"`,
+		},
+		{
+			name:    "archive_sink_with_counter_series",
+			yaml:    "sinks:\n  - type: archive\n    path: archive\n    counter_series: [rate]\n",
+			wantErr: "forwarder.yaml:4:21: sinks[0].counter_series: not supported by archive sinks",
+		},
+		{
+			name:    "duplicated_sink",
+			yaml:    "sinks:\n  - type: file\n    path: a.ndjson\n  - type: file\n    path: a.ndjson\n",
+			wantErr: `forwarder.yaml:4:5: sinks[1]: duplicated sink "file:a.ndjson" of sinks[0]`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseConfig("forwarder.yaml", []byte(tc.yaml), defaults)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			if want, got := tc.wantErr, err.Error(); want != got {
+				t.Errorf("want error %q; got %q", want, got)
+			}
+		})
+	}
+
+	t.Run("invalid_dry_run_format", func(t *testing.T) {
+		defaults := defaults
+		defaults.DryRun = true
+		defaults.DryRunFormat = "xml"
+
+		_, err := parseConfig("forwarder.yaml", nil, defaults)
+		if want, got := `forwarder.yaml: dry_run_format: invalid dry-run format "xml"`, fmt.Sprint(err); want != got {
+			t.Errorf("want error %q; got %q", want, got)
+		}
+	})
+}
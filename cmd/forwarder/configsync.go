@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+const (
+	configReloadHTTP   = "http"
+	configReloadSignal = "signal"
+)
+
+// configSyncConfig of an agent, to apply the Fluent Bit config
+// desired on Cloud to its config_file.
+type configSyncConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Reload is either "http", using the Fluent Bit hot reload endpoint,
+	// or "signal", sending SIGHUP to the process on pid_file.
+	Reload          string        `yaml:"reload"`
+	PIDFile         string        `yaml:"pid_file"`
+	ValidateCommand string        `yaml:"validate_command"`
+	Interval        time.Duration `yaml:"interval"`
+	Wait            time.Duration `yaml:"wait"`
+	HealthTimeout   time.Duration `yaml:"health_timeout"`
+}
+
+func (cfg configSyncConfig) validate(path string, agent agentConfig, cloudHTTP httpClientOpts) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if agent.ConfigFile == "" {
+		return &configError{Path: path + ".enabled", Msg: "requires config_file"}
+	}
+
+	switch cfg.Reload {
+	case configReloadHTTP:
+	case configReloadSignal:
+		if cfg.PIDFile == "" {
+			return &configError{Path: path + ".pid_file", Msg: "required with signal reload"}
+		}
+	default:
+		return &configError{Path: path + ".reload", Msg: fmt.Sprintf("invalid reload %q", cfg.Reload)}
+	}
+
+	if cfg.Interval <= 0 {
+		return &configError{Path: path + ".interval", Msg: "must be greater than zero"}
+	}
+
+	if cfg.Wait < 0 {
+		return &configError{Path: path + ".wait", Msg: "cannot be negative"}
+	}
+
+	if cfg.Wait > 0 && cloudHTTP.Timeout > 0 && cfg.Wait >= cloudHTTP.Timeout {
+		return &configError{Path: path + ".wait", Msg: fmt.Sprintf("must be shorter than the cloud http timeout %s", cloudHTTP.Timeout)}
+	}
+
+	if cfg.HealthTimeout <= 0 {
+		return &configError{Path: path + ".health_timeout", Msg: "must be greater than zero"}
+	}
+
+	return nil
+}
+
+// configSync of the agent, or nil if disabled.
+func (cfg configSyncConfig) configSync(agent agentConfig, httpClient *http.Client) *forwarder.ConfigSync {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	var reloader forwarder.Reloader = &forwarder.HTTPReloader{
+		BaseURL:    agent.URL,
+		HTTPClient: httpClient,
+	}
+	if cfg.Reload == configReloadSignal {
+		reloader = &forwarder.SignalReloader{
+			PIDFile:    cfg.PIDFile,
+			BaseURL:    agent.URL,
+			HTTPClient: httpClient,
+		}
+	}
+
+	return &forwarder.ConfigSync{
+		Path:            agent.ConfigFile,
+		Reloader:        reloader,
+		ValidateCommand: strings.Fields(cfg.ValidateCommand),
+		Interval:        cfg.Interval,
+		Wait:            cfg.Wait,
+		HealthTimeout:   cfg.HealthTimeout,
+	}
+}
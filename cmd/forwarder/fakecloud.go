@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud/cloudtest"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+func runFakeCloud(ctx context.Context, logger log.Logger, args []string) error {
+	var (
+		addr         = env("FAKE_CLOUD_ADDR", ":5000")
+		projectToken = os.Getenv("PROJECT_TOKEN")
+	)
+
+	fs := flag.NewFlagSet("fake-cloud", flag.ExitOnError)
+	fs.StringVar(&addr, "addr", addr, "Address to listen on")
+	fs.StringVar(&projectToken, "project-token", projectToken, "Project token to accept. If empty, any token is accepted")
+	fs.Usage = func() {
+		fmt.Println("Runs a local stand-in of Calyptia Cloud API for tests and offline development.\nPoint the forwarder -cloud-url to it.")
+		fmt.Println("Flags:")
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("could not parse flags: %w", err)
+	}
+
+	h := cloudtest.NewHandler(projectToken)
+	h.Logger = log.With(logger, "component", "fake-cloud")
+
+	_ = level.Info(logger).Log("msg", "fake cloud listening", "addr", addr)
+	err = listenAndServe(ctx, &http.Server{
+		Addr:    addr,
+		Handler: h,
+	})
+	if err != nil {
+		return fmt.Errorf("could not serve fake cloud: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// httpClientOpts configures the HTTP client used to talk to
+// either the Fluent Bit agent or Calyptia Cloud.
+type httpClientOpts struct {
+	Timeout       time.Duration `yaml:"timeout"`
+	ProxyURL      string        `yaml:"proxy_url"`
+	CAFile        string        `yaml:"tls_ca_file"`
+	CertFile      string        `yaml:"tls_cert_file"`
+	KeyFile       string        `yaml:"tls_key_file"`
+	TLSMinVersion string        `yaml:"tls_min_version"`
+}
+
+// registerFlags registers the HTTP client flags with the given prefix,
+// using "<PREFIX>_*" env vars as defaults.
+func (opts *httpClientOpts) registerFlags(fs *flag.FlagSet, prefix, target string) {
+	envPrefix := strings.ToUpper(prefix) + "_"
+
+	opts.Timeout, _ = time.ParseDuration(env(envPrefix+"TIMEOUT", (time.Second * 10).String()))
+	opts.ProxyURL = os.Getenv(envPrefix + "PROXY_URL")
+	opts.CAFile = os.Getenv(envPrefix + "TLS_CA_FILE")
+	opts.CertFile = os.Getenv(envPrefix + "TLS_CERT_FILE")
+	opts.KeyFile = os.Getenv(envPrefix + "TLS_KEY_FILE")
+	opts.TLSMinVersion = env(envPrefix+"TLS_MIN_VERSION", "1.2")
+
+	fs.DurationVar(&opts.Timeout, prefix+"-timeout", opts.Timeout, fmt.Sprintf("Timeout for each HTTP request to %s. Zero means no timeout", target))
+	fs.StringVar(&opts.ProxyURL, prefix+"-proxy-url", opts.ProxyURL, fmt.Sprintf("Proxy URL used to reach %s. Credentials can be set as URL userinfo. If empty, HTTP_PROXY/HTTPS_PROXY env vars are used", target))
+	fs.StringVar(&opts.CAFile, prefix+"-tls-ca-file", opts.CAFile, fmt.Sprintf("PEM encoded CA bundle to verify %s certificate. If empty, the system pool is used", target))
+	fs.StringVar(&opts.CertFile, prefix+"-tls-cert-file", opts.CertFile, fmt.Sprintf("PEM encoded client certificate for mTLS with %s", target))
+	fs.StringVar(&opts.KeyFile, prefix+"-tls-key-file", opts.KeyFile, fmt.Sprintf("PEM encoded client key for mTLS with %s", target))
+	fs.StringVar(&opts.TLSMinVersion, prefix+"-tls-min-version", opts.TLSMinVersion, fmt.Sprintf(`Minimum TLS version accepted from %s. Either "1.0", "1.1", "1.2" or "1.3"`, target))
+}
+
+func newHTTPClient(opts httpClientOpts) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if opts.TLSMinVersion != "" {
+		v, ok := tlsVersions[opts.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS min version %q", opts.TLSMinVersion)
+		}
+
+		tlsConfig.MinVersion = v
+	}
+
+	if opts.CAFile != "" {
+		b, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file %q: %w", opts.CAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no valid PEM certificates found at CA file %q", opts.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, errors.New("both TLS cert file and key file are required for mTLS")
+		}
+
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse proxy URL: %w", err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: transport,
+	}, nil
+}
+
+// listenAndServe until the context is done, then shuts the server down.
+func listenAndServe(ctx context.Context, srv *http.Server) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
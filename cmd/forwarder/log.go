@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var logLevels = map[string]level.Option{
+	"debug": level.AllowDebug(),
+	"info":  level.AllowInfo(),
+	"warn":  level.AllowWarn(),
+	"error": level.AllowError(),
+}
+
+func newLogger(w io.Writer, format, lvl string) (log.Logger, error) {
+	var logger log.Logger
+	switch format {
+	case "logfmt":
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	case "json":
+		logger = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+
+	allow, ok := logLevels[lvl]
+	if !ok {
+		return nil, fmt.Errorf("invalid log level %q", lvl)
+	}
+
+	logger = level.NewFilter(logger, allow)
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+	return logger, nil
+}
+
+func logEvent(logger log.Logger, ev forwarder.Event) {
+	keyvals := []interface{}{"event", ev.Kind}
+	if ev.AgentID != "" {
+		keyvals = append(keyvals, "agent_id", ev.AgentID)
+	}
+	if ev.Stage != "" {
+		keyvals = append(keyvals, "stage", ev.Stage)
+	}
+	if ev.Sink != "" {
+		keyvals = append(keyvals, "sink", ev.Sink)
+	}
+	if ev.Attempt != 0 {
+		keyvals = append(keyvals, "attempt", ev.Attempt)
+	}
+	if ev.Kind == forwarder.EventPushSucceeded {
+		keyvals = append(keyvals, "inserted", ev.Inserted, "payload_size", ev.PayloadSize, "duration", ev.Duration)
+	}
+	if ev.ConfigVersion != "" {
+		keyvals = append(keyvals, "config_version", ev.ConfigVersion)
+	}
+	if ev.Alert != nil {
+		keyvals = append(keyvals, "rule", ev.Alert.Rule, "alert", ev.Alert)
+	}
+	if ev.Err != nil {
+		keyvals = append(keyvals, "err", ev.Err)
+	}
+
+	_ = eventLevel(logger, ev.Kind).Log(keyvals...)
+}
+
+func eventLevel(logger log.Logger, kind forwarder.EventKind) log.Logger {
+	switch kind {
+	case forwarder.EventPushSucceeded:
+		return level.Debug(logger)
+	case forwarder.EventPushFailed, forwarder.EventAlertFiring:
+		return level.Warn(logger)
+	case forwarder.EventFluentBitUnreachable, forwarder.EventPushFailing, forwarder.EventFluentBitConfigFailed:
+		return level.Error(logger)
+	}
+
+	return level.Info(logger)
+}
@@ -7,16 +7,20 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
 	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
-	fluentbit "github.com/calyptia/go-fluent-bit-metrics"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud/dryrun"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/notify"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
 	"github.com/denisbrodbeck/machineid"
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/google/uuid"
-	"github.com/lucasepe/codename"
 	"github.com/peterbourgon/diskv"
 )
 
@@ -26,105 +30,416 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
 
-	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
-	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+	defaultLogger, err := newLogger(os.Stderr, "logfmt", "info")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	err := run(ctx, logger, os.Args[1:])
+	// Swapped once the log flags are parsed.
+	logger := &log.SwapLogger{}
+	logger.Swap(defaultLogger)
+
+	err = run(ctx, logger, os.Args[1:])
 	if err != nil {
-		_ = logger.Log("err", err)
+		_ = level.Error(logger).Log("err", err)
 		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context, logger log.Logger, args []string) error {
+func run(ctx context.Context, logger *log.SwapLogger, args []string) error {
+	if len(args) != 0 {
+		switch args[0] {
+		case "run":
+			return runForward(ctx, logger, args[1:])
+		case "register":
+			return runRegister(ctx, logger, args[1:])
+		case "status":
+			return runStatus(ctx, logger, args[1:])
+		case "unregister":
+			return runUnregister(ctx, logger, args[1:])
+		case "replay":
+			return runReplay(ctx, logger, args[1:])
+		case "fake-cloud":
+			return runFakeCloud(ctx, logger, args[1:])
+		}
+	}
+
+	return runForward(ctx, logger, args)
+}
+
+// runForward forwards metrics until the context is done.
+// It reloads the config on SIGHUP.
+func runForward(ctx context.Context, logger *log.SwapLogger, args []string) error {
+	readConfig, _, err := parseFlags(logger, args)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	configuredLogger, err := newLogger(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	logger.Swap(configuredLogger)
+
+	sup := &supervisor{
+		Store:  newStore(cfg.DryRun),
+		Logger: logger,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		sup.wait()
+	}()
+
+	err = sup.apply(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.ListenAddr != "" {
+		go func() {
+			_ = level.Info(logger).Log("msg", "listening", "addr", cfg.ListenAddr)
+			err := listenAndServe(ctx, &http.Server{
+				Addr:    cfg.ListenAddr,
+				Handler: sup,
+			})
+			if err != nil {
+				_ = level.Error(logger).Log("err", fmt.Errorf("could not serve: %w", err))
+			}
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-sup.errs:
+			return err
+		case <-hup:
+			_ = level.Info(logger).Log("msg", "reloading config")
+
+			next, err := readConfig()
+			if err != nil {
+				_ = level.Error(logger).Log("msg", "invalid config; keeping the current one", "err", err)
+				continue
+			}
+
+			if next.ListenAddr != cfg.ListenAddr {
+				_ = level.Warn(logger).Log("msg", "listen address change requires a restart", "listen_addr", cfg.ListenAddr)
+			}
+
+			configuredLogger, err := newLogger(os.Stderr, next.Log.Format, next.Log.Level)
+			if err != nil {
+				_ = level.Error(logger).Log("msg", "invalid config; keeping the current one", "err", err)
+				continue
+			}
+
+			err = sup.apply(ctx, next)
+			if err != nil {
+				_ = level.Error(logger).Log("msg", "could not apply config; keeping the current one", "err", err)
+				continue
+			}
+
+			logger.Swap(configuredLogger)
+			next.ListenAddr = cfg.ListenAddr
+			cfg = next
+		}
+	}
+}
+
+// parseFlags shared by all commands.
+// The returned function reads the config from flags, env vars and the config file.
+// It also returns the arguments left after the flags.
+func parseFlags(logger log.Logger, args []string) (func() (config, error), []string, error) {
 	var (
-		cloudURL             = env("CLOUD_URL", "https://cloud-api-dev.calyptia.com/")
-		projectToken         = os.Getenv("PROJECT_TOKEN")
-		agentURL             = env("AGENT_URL", "http://localhost:2020")
-		agentPullInterval, _ = time.ParseDuration(env("AGENT_PULL_INTERVAL", (time.Second * 5).String()))
-		agentHostname        = os.Getenv("AGENT_HOSTNAME")
-		agentMachineID       = env("AGENT_MACHINE_ID", func() string { s, _ := machineid.ID(); return s }())
-		agentConfigFile      = env("AGENT_CONFIG_FILE", "fluent-bit.conf")
+		cloudURL                   = env("CLOUD_URL", "https://cloud-api-dev.calyptia.com/")
+		projectToken               = os.Getenv("PROJECT_TOKEN")
+		projectTokenFile           = os.Getenv("PROJECT_TOKEN_FILE")
+		projectTokenCommand        = os.Getenv("PROJECT_TOKEN_COMMAND")
+		cloudCompression           = env("CLOUD_COMPRESSION", string(cloud.CompressionGzip))
+		agentURL                   = env("AGENT_URL", "http://localhost:2020")
+		agentPullInterval, _       = time.ParseDuration(env("AGENT_PULL_INTERVAL", (time.Second * 5).String()))
+		agentHostname              = os.Getenv("AGENT_HOSTNAME")
+		agentMachineID             = env("AGENT_MACHINE_ID", func() string { s, _ := machineid.ID(); return s }())
+		agentConfigFile            = env("AGENT_CONFIG_FILE", "fluent-bit.conf")
+		agentID                    = os.Getenv("AGENT_ID")
+		agentTokenFile             = os.Getenv("AGENT_TOKEN_FILE")
+		agentTokenCommand          = os.Getenv("AGENT_TOKEN_COMMAND")
+		agentConfigSync            = os.Getenv("AGENT_CONFIG_SYNC") == "true"
+		agentConfigSyncReload      = env("AGENT_CONFIG_SYNC_RELOAD", configReloadHTTP)
+		agentConfigSyncPIDFile     = os.Getenv("AGENT_CONFIG_SYNC_PID_FILE")
+		agentConfigSyncValidate    = os.Getenv("AGENT_CONFIG_SYNC_VALIDATE_COMMAND")
+		agentConfigSyncInterval, _ = time.ParseDuration(env("AGENT_CONFIG_SYNC_INTERVAL", forwarder.DefaultConfigSyncInterval.String()))
+		agentConfigSyncWait, _     = time.ParseDuration(env("AGENT_CONFIG_SYNC_WAIT", "0s"))
+		agentConfigSyncHealth, _   = time.ParseDuration(env("AGENT_CONFIG_SYNC_HEALTH_TIMEOUT", forwarder.DefaultConfigHealthTimeout.String()))
+		forceRegister              = os.Getenv("FORCE_REGISTER") == "true"
+		listenAddr                 = os.Getenv("LISTEN_ADDR")
+		includeSelfMetrics         = os.Getenv("INCLUDE_SELF_METRICS") == "true"
+		readyPushIntervals, _      = strconv.Atoi(env("READY_PUSH_INTERVALS", strconv.Itoa(forwarder.DefaultReadyPushIntervals)))
+		logFormat                  = env("LOG_FORMAT", "logfmt")
+		logLevel                   = env("LOG_LEVEL", "info")
+		bufferSize, _              = strconv.Atoi(env("BUFFER_SIZE", "0"))
+		counterResets              = env("COUNTER_RESETS", string(forwarder.CounterResetsNone))
+		counterSeries              = env("COUNTER_SERIES", string(forwarder.CounterSeriesCumulative))
+		alertsWebhookURL           = os.Getenv("ALERTS_WEBHOOK_URL")
+		notifyWebhookURL           = os.Getenv("NOTIFY_WEBHOOK_URL")
+		notifyWebhookFormat        = env("NOTIFY_WEBHOOK_FORMAT", string(notify.FormatGeneric))
+		notifyWebhookSecret        = os.Getenv("NOTIFY_WEBHOOK_SECRET")
+		notifyWebhookRoutingKey    = os.Getenv("NOTIFY_WEBHOOK_ROUTING_KEY")
+		configFile                 = os.Getenv("FORWARDER_CONFIG")
+		sinkFile                   = os.Getenv("SINK_FILE")
+		sinkOTLPURL                = os.Getenv("SINK_OTLP_URL")
+		sinkOTLPHeaders            = os.Getenv("SINK_OTLP_HEADERS")
+		sinkRemoteWriteURL         = os.Getenv("SINK_REMOTE_WRITE_URL")
+		sinkRemoteWriteUsername    = os.Getenv("SINK_REMOTE_WRITE_USERNAME")
+		sinkRemoteWritePassword    = os.Getenv("SINK_REMOTE_WRITE_PASSWORD")
+		sinkRemoteWriteBearerToken = os.Getenv("SINK_REMOTE_WRITE_BEARER_TOKEN")
+		sinkRemoteWriteHeaders     = os.Getenv("SINK_REMOTE_WRITE_HEADERS")
+		sinkInfluxDBURL            = os.Getenv("SINK_INFLUXDB_URL")
+		sinkInfluxDBToken          = os.Getenv("SINK_INFLUXDB_TOKEN")
+		sinkStatsDAddress          = os.Getenv("SINK_STATSD_ADDRESS")
+		sinkDogStatsDAddress       = os.Getenv("SINK_DOGSTATSD_ADDRESS")
+		sinkArchiveDir             = os.Getenv("SINK_ARCHIVE_DIR")
+		dryRun                     = os.Getenv("DRY_RUN") == "true"
+		dryRunFormat               = env("DRY_RUN_FORMAT", string(dryrun.FormatText))
+		agentHTTP                  httpClientOpts
+		cloudHTTP                  httpClientOpts
 	)
 
 	fs := flag.NewFlagSet("forwarder", flag.ExitOnError)
 	fs.StringVar(&cloudURL, "cloud-url", cloudURL, "Calyptia Cloud API URL")
 	fs.StringVar(&projectToken, "project-token", projectToken, `Project token from Calyptia Cloud fetched from "POST /v1/tokens" or from "GET /v1/tokens?last=1"`)
+	fs.StringVar(&projectTokenFile, "project-token-file", projectTokenFile, "File to read the project token from. It is read again once it changes, like a Kubernetes secret mount")
+	fs.StringVar(&projectTokenCommand, "project-token-command", projectTokenCommand, "Credential helper command that prints the project token. Arguments are separated by spaces. It is run again once Cloud rejects the token")
+	fs.StringVar(&cloudCompression, "cloud-compression", cloudCompression, `Compression for metrics sent to Calyptia Cloud. Either "gzip", "zstd" or "none"`)
 	fs.StringVar(&agentURL, "agent-url", agentURL, "Fluent Bit agent URL")
 	fs.DurationVar(&agentPullInterval, "agent-pull-interval", agentPullInterval, "Interval to pull Fluent Bit agent and forward metrics to Cloud")
 	fs.StringVar(&agentConfigFile, "agent-config-file", agentConfigFile, "Fluentbit agent config file")
 	fs.StringVar(&agentHostname, "agent-hostname", agentHostname, "Agent hostname. If empty, a random one will be generated")
 	fs.StringVar(&agentMachineID, "agent-machine-id", agentMachineID, "Agent host machine ID. If empty, a random one will be generated")
+	fs.StringVar(&agentID, "agent-id", agentID, "ID of an agent pre-provisioned on Cloud. If set, the agent is not created and its token must be given with -agent-token-file or -agent-token-command")
+	fs.StringVar(&agentTokenFile, "agent-token-file", agentTokenFile, "File to read the pre-provisioned agent token from. It is read again once it changes")
+	fs.StringVar(&agentTokenCommand, "agent-token-command", agentTokenCommand, "Credential helper command that prints the pre-provisioned agent token. Arguments are separated by spaces. It is run again once Cloud rejects the token")
+	fs.BoolVar(&agentConfigSync, "agent-config-sync", agentConfigSync, "Apply the Fluent Bit config desired on Cloud to -agent-config-file, reloading Fluent Bit and rolling back if it becomes unhealthy")
+	fs.StringVar(&agentConfigSyncReload, "agent-config-sync-reload", agentConfigSyncReload, `How Fluent Bit is reloaded after a config sync. Either "http", using its hot reload endpoint, or "signal", sending SIGHUP to the process on -agent-config-sync-pid-file`)
+	fs.StringVar(&agentConfigSyncPIDFile, "agent-config-sync-pid-file", agentConfigSyncPIDFile, `File with the Fluent Bit process ID, required with the "signal" reload`)
+	fs.StringVar(&agentConfigSyncValidate, "agent-config-sync-validate-command", agentConfigSyncValidate, `Command run with the candidate config file path appended, rejecting the config if it fails. Arguments are separated by spaces. Example: "fluent-bit --dry-run -c"`)
+	fs.DurationVar(&agentConfigSyncInterval, "agent-config-sync-interval", agentConfigSyncInterval, "Interval to fetch the desired Fluent Bit config from Cloud")
+	fs.DurationVar(&agentConfigSyncWait, "agent-config-sync-wait", agentConfigSyncWait, "Long-poll Cloud for up to this duration on each desired config fetch. Must be shorter than -cloud-timeout. Zero disables long-polling")
+	fs.DurationVar(&agentConfigSyncHealth, "agent-config-sync-health-timeout", agentConfigSyncHealth, "How long a reload has to be confirmed, and Fluent Bit stay reachable after it, before the previous config is restored. It takes at least 3s")
+	fs.BoolVar(&forceRegister, "force-register", forceRegister, "Register a new agent when none is stored, instead of adopting an existing one with the same machine ID on Cloud. Required if the project token cannot list agents")
+	fs.StringVar(&listenAddr, "listen-addr", listenAddr, `Address to serve the forwarder own endpoints "/healthz", "/readyz", "/status" and "/metrics". If empty, it is disabled`)
+	fs.IntVar(&readyPushIntervals, "ready-push-intervals", readyPushIntervals, `Number of pull intervals without a successful push after which "/readyz" fails`)
+	fs.BoolVar(&includeSelfMetrics, "include-self-metrics", includeSelfMetrics, `Include the forwarder own metrics on the payload sent to Cloud under the "forwarder" namespace`)
+	fs.IntVar(&bufferSize, "buffer-size", bufferSize, "Max number of metrics snapshots kept in memory per sink while it is unreachable, to be pushed on the next intervals. Zero disables buffering")
+	fs.StringVar(&counterResets, "counter-resets", counterResets, `How Fluent Bit restarts zeroing its counters are handled: "none" forwards counters as they are, "marker" adds fluentbit_restarts_total and fluentbit_start_time_seconds metrics, "adjust" keeps counters monotonic`)
+	fs.StringVar(&counterSeries, "counter-series", counterSeries, `Comma separated forms in which plugin counters are pushed to the sinks set with flags, other than archives: "cumulative" totals, "delta" per interval and "rate" per second. Example: "cumulative,rate"`)
+	fs.StringVar(&alertsWebhookURL, "alerts-webhook-url", alertsWebhookURL, "URL to post firing and resolved alerts to as JSON. Alert rules are set on the config file")
+	fs.StringVar(&notifyWebhookURL, "notify-webhook-url", notifyWebhookURL, "Webhook URL to notify of registration, Fluent Bit becoming unreachable or recovering, Cloud pushes failing or recovering, config updates and Fluent Bit config syncs. If empty, it is disabled")
+	fs.StringVar(&notifyWebhookFormat, "notify-webhook-format", notifyWebhookFormat, `Notifications webhook payload format. Either "generic" JSON, "slack" or "pagerduty" Events API v2`)
+	fs.StringVar(&notifyWebhookSecret, "notify-webhook-secret", notifyWebhookSecret, `Secret to sign notifications with HMAC-SHA256 on the "X-Forwarder-Signature" header`)
+	fs.StringVar(&notifyWebhookRoutingKey, "notify-webhook-routing-key", notifyWebhookRoutingKey, `PagerDuty integration routing key, required with the "pagerduty" format`)
+	fs.StringVar(&configFile, "config", configFile, "YAML config file. Settings in the file take precedence over flags and env vars. Reloaded on SIGHUP")
+	fs.StringVar(&sinkFile, "sink-file", sinkFile, "File to append each metrics snapshot to as a JSON line, along with Cloud. If empty, it is disabled")
+	fs.StringVar(&sinkOTLPURL, "sink-otlp-url", sinkOTLPURL, `OTLP/HTTP metrics endpoint to push metrics to, along with Cloud. Example: "http://localhost:4318/v1/metrics". If empty, it is disabled`)
+	fs.StringVar(&sinkOTLPHeaders, "sink-otlp-headers", sinkOTLPHeaders, `Headers sent to the OTLP endpoint, like "api-key=secret,other=value"`)
+	fs.StringVar(&sinkRemoteWriteURL, "sink-remote-write-url", sinkRemoteWriteURL, `Prometheus remote-write endpoint to push metrics to, along with Cloud. Example: "http://localhost:9009/api/v1/push". If empty, it is disabled`)
+	fs.StringVar(&sinkRemoteWriteUsername, "sink-remote-write-username", sinkRemoteWriteUsername, "Basic auth username for the remote-write endpoint")
+	fs.StringVar(&sinkRemoteWritePassword, "sink-remote-write-password", sinkRemoteWritePassword, "Basic auth password for the remote-write endpoint")
+	fs.StringVar(&sinkRemoteWriteBearerToken, "sink-remote-write-bearer-token", sinkRemoteWriteBearerToken, "Bearer token for the remote-write endpoint")
+	fs.StringVar(&sinkRemoteWriteHeaders, "sink-remote-write-headers", sinkRemoteWriteHeaders, `Headers sent to the remote-write endpoint, like "X-Scope-OrgID=team"`)
+	fs.StringVar(&sinkInfluxDBURL, "sink-influxdb-url", sinkInfluxDBURL, `InfluxDB write endpoint to push metrics to in line protocol, along with Cloud. Example: "http://localhost:8086/api/v2/write?org=org&bucket=fluentbit" or "udp://localhost:8089". If empty, it is disabled`)
+	fs.StringVar(&sinkInfluxDBToken, "sink-influxdb-token", sinkInfluxDBToken, "InfluxDB API token")
+	fs.StringVar(&sinkStatsDAddress, "sink-statsd-address", sinkStatsDAddress, `StatsD server to send metrics to over UDP, along with Cloud. Example: "localhost:8125". If empty, it is disabled`)
+	fs.StringVar(&sinkDogStatsDAddress, "sink-dogstatsd-address", sinkDogStatsDAddress, `DogStatsD server to send metrics to over UDP, along with Cloud. Example: "localhost:8125". If empty, it is disabled`)
+	fs.StringVar(&sinkArchiveDir, "sink-archive-dir", sinkArchiveDir, "Directory to archive each payload pushed to Cloud to, as rotated msgpack files. If empty, it is disabled")
+	fs.BoolVar(&dryRun, "dry-run", dryRun, "Print what would be sent to Calyptia Cloud to stdout instead of sending it. Nothing is stored on disk")
+	fs.StringVar(&dryRunFormat, "dry-run-format", dryRunFormat, `Dry-run output format. Either "text" or "json"`)
+	fs.StringVar(&logFormat, "log-format", logFormat, `Log format. Either "logfmt" or "json"`)
+	fs.StringVar(&logLevel, "log-level", logLevel, `Log level. Either "debug", "info", "warn" or "error"`)
+	agentHTTP.registerFlags(fs, "agent", "Fluent Bit agent")
+	cloudHTTP.registerFlags(fs, "cloud", "Calyptia Cloud")
 	fs.Usage = func() {
 		fmt.Printf("Forwards metrics from Fluent Bit agent to Calyptia Cloud.\nIt stores some persisted data about Cloud registration at %q directory.\n", dataPath)
+		fmt.Println("Commands:")
+		fmt.Println("  run           Forward metrics. The default when no command is given")
+		fmt.Println("  register      Register the agents on Cloud and store their credentials, then exit")
+		fmt.Println("  status        Print the stored agents and check their tokens against Cloud")
+		fmt.Println("  unregister    Delete the agents from Cloud and erase them from the store")
+		fmt.Println("  replay <dir>  Send the payloads archived on a directory to Cloud again, then exit")
+		fmt.Println("  fake-cloud    Run a local stand-in of Calyptia Cloud API")
 		fmt.Println("Flags:")
 		fs.PrintDefaults()
 	}
 
 	err := fs.Parse(args)
 	if err != nil {
-		return fmt.Errorf("could not parse flags: %w", err)
+		return nil, nil, fmt.Errorf("could not parse flags: %w", err)
 	}
 
-	if agentHostname == "" {
-		rng, err := codename.DefaultRNG()
+	if agentMachineID == "" {
+		v, err := uuid.NewRandom()
 		if err != nil {
-			return fmt.Errorf("could not generate hostname random seed: %w", err)
+			return nil, nil, fmt.Errorf("could not generate random machine ID: %w", err)
 		}
 
-		agentHostname = codename.Generate(rng, 4)
-		_ = logger.Log("generated_hostname", agentHostname)
+		agentMachineID = v.String()
+		_ = level.Info(logger).Log("generated_machine_id", agentMachineID)
 	}
 
-	if agentMachineID == "" {
-		v, err := uuid.NewRandom()
+	defaults := config{
+		Cloud: cloudConfig{
+			URL:                 cloudURL,
+			ProjectToken:        projectToken,
+			ProjectTokenFile:    projectTokenFile,
+			ProjectTokenCommand: projectTokenCommand,
+			Compression:         cloudCompression,
+			HTTP:                cloudHTTP,
+		},
+		ListenAddr:         listenAddr,
+		IncludeSelfMetrics: includeSelfMetrics,
+		ReadyPushIntervals: readyPushIntervals,
+		BufferSize:         bufferSize,
+		CounterResets:      counterResets,
+		Alerts:             alertsConfig{WebhookURL: alertsWebhookURL},
+		DryRun:             dryRun,
+		DryRunFormat:       dryRunFormat,
+		Log: logConfig{
+			Format: logFormat,
+			Level:  logLevel,
+		},
+		Agents: []agentConfig{{
+			URL:           agentURL,
+			Hostname:      agentHostname,
+			MachineID:     agentMachineID,
+			AgentID:       agentID,
+			TokenFile:     agentTokenFile,
+			TokenCommand:  agentTokenCommand,
+			ForceRegister: forceRegister,
+			ConfigFile:    agentConfigFile,
+			PullInterval:  agentPullInterval,
+			HTTP:          agentHTTP,
+			ConfigSync: configSyncConfig{
+				Enabled:         agentConfigSync,
+				Reload:          agentConfigSyncReload,
+				PIDFile:         agentConfigSyncPIDFile,
+				ValidateCommand: agentConfigSyncValidate,
+				Interval:        agentConfigSyncInterval,
+				Wait:            agentConfigSyncWait,
+				HealthTimeout:   agentConfigSyncHealth,
+			},
+		}},
+	}
+
+	if notifyWebhookURL != "" || notifyWebhookRoutingKey != "" {
+		defaults.Notifications.Webhooks = append(defaults.Notifications.Webhooks, webhookConfig{
+			URL:        notifyWebhookURL,
+			Format:     notifyWebhookFormat,
+			Secret:     notifyWebhookSecret,
+			RoutingKey: notifyWebhookRoutingKey,
+		})
+	}
+
+	if sinkFile != "" {
+		defaults.Sinks = append(defaults.Sinks, sinkConfig{Type: sinkTypeFile, Path: sinkFile})
+	}
+
+	if sinkOTLPURL != "" {
+		headers, err := parseHeaders(sinkOTLPHeaders)
 		if err != nil {
-			return fmt.Errorf("could not generate random machine ID: %w", err)
+			return nil, nil, fmt.Errorf("could not parse otlp headers: %w", err)
 		}
 
-		agentMachineID = v.String()
-		_ = logger.Log("generated_machine_id", agentMachineID)
+		defaults.Sinks = append(defaults.Sinks, sinkConfig{Type: sinkTypeOTLP, URL: sinkOTLPURL, Headers: headers})
 	}
 
-	var rawConfig string
-	if agentConfigFile != "" {
-		b, err := os.ReadFile(agentConfigFile)
+	if sinkRemoteWriteURL != "" {
+		headers, err := parseHeaders(sinkRemoteWriteHeaders)
 		if err != nil {
-			return fmt.Errorf("could not read file %q: %w", agentConfigFile, err)
+			return nil, nil, fmt.Errorf("could not parse remote write headers: %w", err)
 		}
 
-		rawConfig = string(b)
+		defaults.Sinks = append(defaults.Sinks, sinkConfig{
+			Type:        sinkTypeRemoteWrite,
+			URL:         sinkRemoteWriteURL,
+			Username:    sinkRemoteWriteUsername,
+			Password:    sinkRemoteWritePassword,
+			BearerToken: sinkRemoteWriteBearerToken,
+			Headers:     headers,
+		})
 	}
 
-	kv := diskv.New(diskv.Options{
-		BasePath: dataPath,
-	})
+	if sinkInfluxDBURL != "" {
+		defaults.Sinks = append(defaults.Sinks, sinkConfig{Type: sinkTypeInfluxDB, URL: sinkInfluxDBURL, Token: sinkInfluxDBToken})
+	}
 
-	fd := forwarder.Forwarder{
-		Hostname:  agentHostname,
-		MachineID: agentMachineID,
-		RawConfig: rawConfig,
-		Store:     kv,
-		Interval:  agentPullInterval,
-		FluentBitClient: &fluentbit.Client{
-			HTTPClient: http.DefaultClient,
-			BaseURL:    agentURL,
-		},
-		CloudClient: &cloud.Client{
-			HTTPClient:   http.DefaultClient,
-			BaseURL:      cloudURL,
-			ProjectToken: projectToken,
-		},
-		Logger: logger,
+	if sinkStatsDAddress != "" {
+		defaults.Sinks = append(defaults.Sinks, sinkConfig{Type: sinkTypeStatsD, Address: sinkStatsDAddress})
 	}
 
-	go func() {
-		for err := range fd.Errs() {
-			_ = logger.Log("err", err)
+	if sinkDogStatsDAddress != "" {
+		defaults.Sinks = append(defaults.Sinks, sinkConfig{Type: sinkTypeDogStatsD, Address: sinkDogStatsDAddress})
+	}
+
+	for i := range defaults.Sinks {
+		defaults.Sinks[i].CounterSeries = splitList(counterSeries)
+	}
+
+	if sinkArchiveDir != "" {
+		defaults.Sinks = append(defaults.Sinks, sinkConfig{
+			Type:     sinkTypeArchive,
+			Path:     sinkArchiveDir,
+			Format:   string(sinks.ArchiveFormatMsgPack),
+			MaxSize:  defaultArchiveMaxSize,
+			MaxFiles: defaultArchiveMaxFiles,
+			Compress: true,
+		})
+	}
+
+	readConfig := func() (config, error) {
+		if configFile == "" {
+			return defaults, defaults.validate()
 		}
-	}()
 
-	return fd.Forward(ctx)
+		return loadConfig(configFile, defaults)
+	}
+
+	return readConfig, fs.Args(), nil
+}
+
+// newStore on disk. On dry-run it is kept in memory instead.
+func newStore(dryRun bool) forwarder.Store {
+	if dryRun {
+		return &memStore{data: map[string][]byte{}}
+	}
+
+	return diskv.New(diskv.Options{
+		BasePath: dataPath,
+	})
+}
+
+// splitList of comma separated values, ignoring empty ones.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+
+	return out
 }
 
 func env(key, fallback string) string {
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/notify"
+)
+
+// notificationsConfig of the webhooks notified of the forwarder state changes.
+type notificationsConfig struct {
+	Webhooks []webhookConfig `yaml:"webhooks"`
+}
+
+type webhookConfig struct {
+	URL         string         `yaml:"url"`
+	Format      string         `yaml:"format"`
+	Secret      string         `yaml:"secret"`
+	RoutingKey  string         `yaml:"routing_key"`
+	Events      []string       `yaml:"events"`
+	MaxAttempts int            `yaml:"max_attempts"`
+	HTTP        httpClientOpts `yaml:"http"`
+}
+
+func (cfg notificationsConfig) validate(path string) error {
+	for i, wh := range cfg.Webhooks {
+		if err := wh.validate(fmt.Sprintf("%s.webhooks[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cfg webhookConfig) validate(path string) error {
+	format, ok := cfg.format()
+	if !ok {
+		return &configError{Path: path + ".format", Msg: fmt.Sprintf("invalid webhook format %q", cfg.Format)}
+	}
+
+	if cfg.URL != "" || format != notify.FormatPagerDuty {
+		if err := validateURL(path+".url", cfg.URL); err != nil {
+			return err
+		}
+	}
+
+	if format == notify.FormatPagerDuty && cfg.RoutingKey == "" {
+		return &configError{Path: path + ".routing_key", Msg: "required with pagerduty format"}
+	}
+
+	for i, event := range cfg.Events {
+		if _, ok := notify.EventMap[event]; !ok {
+			return &configError{Path: fmt.Sprintf("%s.events[%d]", path, i), Msg: fmt.Sprintf("invalid event %q", event)}
+		}
+	}
+
+	if cfg.MaxAttempts < 0 {
+		return &configError{Path: path + ".max_attempts", Msg: "cannot be negative"}
+	}
+
+	return validateHTTP(path+".http", cfg.HTTP)
+}
+
+// format defaults to generic.
+func (cfg webhookConfig) format() (notify.Format, bool) {
+	if cfg.Format == "" {
+		return notify.FormatGeneric, true
+	}
+
+	format, ok := notify.FormatMap[cfg.Format]
+	return format, ok
+}
+
+func newWebhook(cfg webhookConfig) (*notify.Webhook, error) {
+	format, ok := cfg.format()
+	if !ok {
+		return nil, fmt.Errorf("invalid webhook format %q", cfg.Format)
+	}
+
+	events := make([]forwarder.EventKind, len(cfg.Events))
+	for i, event := range cfg.Events {
+		events[i], ok = notify.EventMap[event]
+		if !ok {
+			return nil, fmt.Errorf("invalid event %q", event)
+		}
+	}
+
+	httpClient, err := newHTTPClient(cfg.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("could not setup http client: %w", err)
+	}
+
+	return &notify.Webhook{
+		URL:         cfg.URL,
+		Format:      format,
+		Secret:      cfg.Secret,
+		RoutingKey:  cfg.RoutingKey,
+		Events:      events,
+		MaxAttempts: cfg.MaxAttempts,
+		HTTPClient:  httpClient,
+	}, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
+)
+
+const (
+	sinkTypeFile        = "file"
+	sinkTypeOTLP        = "otlp"
+	sinkTypeRemoteWrite = "remote_write"
+	sinkTypeInfluxDB    = "influxdb"
+	sinkTypeStatsD      = "statsd"
+	sinkTypeDogStatsD   = "dogstatsd"
+	sinkTypeArchive     = "archive"
+)
+
+// Archive rotation used by -sink-archive-dir.
+const (
+	defaultArchiveMaxSize  = 64 << 20
+	defaultArchiveMaxFiles = 10
+)
+
+// sinkConfig of a sink to push metrics to along with Cloud.
+// The fields in use depend on the type.
+type sinkConfig struct {
+	Type    string            `yaml:"type"`
+	Path    string            `yaml:"path"`
+	URL     string            `yaml:"url"`
+	Address string            `yaml:"address"`
+	Headers map[string]string `yaml:"headers"`
+	// Username and Password for basic auth.
+	Username    string         `yaml:"username"`
+	Password    string         `yaml:"password"`
+	BearerToken string         `yaml:"bearer_token"`
+	Token       string         `yaml:"token"`
+	HTTP        httpClientOpts `yaml:"http"`
+	// Format and rotation of archives.
+	Format   string        `yaml:"format"`
+	MaxSize  int64         `yaml:"max_size"`
+	MaxAge   time.Duration `yaml:"max_age"`
+	MaxFiles int           `yaml:"max_files"`
+	Compress bool          `yaml:"compress"`
+	// CounterSeries are the forms in which plugin counters are pushed.
+	// Archives get the Cloud payload, so cumulative only.
+	CounterSeries []string `yaml:"counter_series"`
+}
+
+// name the sink gets on the forwarder.
+func (c sinkConfig) name() string {
+	switch c.Type {
+	case sinkTypeFile:
+		return (&sinks.File{Path: c.Path}).Name()
+	case sinkTypeOTLP:
+		return (&sinks.OTLP{URL: c.URL}).Name()
+	case sinkTypeRemoteWrite:
+		return (&sinks.RemoteWrite{URL: c.URL}).Name()
+	case sinkTypeInfluxDB:
+		return (&sinks.InfluxDB{URL: c.URL}).Name()
+	case sinkTypeStatsD, sinkTypeDogStatsD:
+		return (&sinks.StatsD{Addr: c.Address, DogStatsD: c.Type == sinkTypeDogStatsD}).Name()
+	case sinkTypeArchive:
+		return (&sinks.Archive{Dir: c.Path}).Name()
+	}
+
+	return c.Type
+}
+
+func (c sinkConfig) validate(path string) error {
+	for i, series := range c.CounterSeries {
+		if _, ok := forwarder.CounterSeriesMap[series]; !ok {
+			return &configError{Path: fmt.Sprintf("%s.counter_series[%d]", path, i), Msg: fmt.Sprintf("invalid counter series %q", series)}
+		}
+	}
+
+	if c.Type == sinkTypeArchive && len(c.CounterSeries) != 0 {
+		return &configError{Path: path + ".counter_series", Msg: "not supported by archive sinks"}
+	}
+
+	switch c.Type {
+	case sinkTypeFile:
+		if c.Path == "" {
+			return &configError{Path: path + ".path", Msg: "required for file sinks"}
+		}
+	case sinkTypeOTLP, sinkTypeRemoteWrite:
+		if err := validateURL(path+".url", c.URL); err != nil {
+			return err
+		}
+
+		if err := validateHTTP(path+".http", c.HTTP); err != nil {
+			return err
+		}
+
+		if c.BearerToken != "" && (c.Username != "" || c.Password != "") {
+			return &configError{Path: path + ".bearer_token", Msg: "cannot be set along with username or password"}
+		}
+	case sinkTypeInfluxDB:
+		if u, err := url.Parse(c.URL); err == nil && u.Scheme == "udp" {
+			if _, _, err := net.SplitHostPort(u.Host); err != nil {
+				return &configError{Path: path + ".url", Msg: fmt.Sprintf("invalid UDP address: %v", err)}
+			}
+		} else if err := validateURL(path+".url", c.URL); err != nil {
+			return err
+		}
+
+		if err := validateHTTP(path+".http", c.HTTP); err != nil {
+			return err
+		}
+
+		if c.Token != "" && (c.Username != "" || c.Password != "") {
+			return &configError{Path: path + ".token", Msg: "cannot be set along with username or password"}
+		}
+	case sinkTypeStatsD, sinkTypeDogStatsD:
+		if c.Address == "" {
+			return &configError{Path: path + ".address", Msg: "required"}
+		}
+
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return &configError{Path: path + ".address", Msg: fmt.Sprintf("invalid address: %v", err)}
+		}
+	case sinkTypeArchive:
+		if c.Path == "" {
+			return &configError{Path: path + ".path", Msg: "required for archive sinks"}
+		}
+
+		if _, ok := sinks.ArchiveFormatMap[c.Format]; c.Format != "" && !ok {
+			return &configError{Path: path + ".format", Msg: fmt.Sprintf("invalid archive format %q", c.Format)}
+		}
+
+		if c.MaxSize < 0 {
+			return &configError{Path: path + ".max_size", Msg: "cannot be negative"}
+		}
+
+		if c.MaxAge < 0 {
+			return &configError{Path: path + ".max_age", Msg: "cannot be negative"}
+		}
+
+		if c.MaxFiles < 0 {
+			return &configError{Path: path + ".max_files", Msg: "cannot be negative"}
+		}
+	default:
+		return &configError{Path: path + ".type", Msg: fmt.Sprintf("invalid sink type %q", c.Type)}
+	}
+
+	return nil
+}
+
+func newSink(c sinkConfig) (forwarder.Sink, error) {
+	switch c.Type {
+	case sinkTypeFile:
+		return &sinks.File{Path: c.Path}, nil
+	case sinkTypeOTLP:
+		httpClient, err := newHTTPClient(c.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("could not setup otlp http client: %w", err)
+		}
+
+		return &sinks.OTLP{
+			URL:        c.URL,
+			Headers:    c.Headers,
+			HTTPClient: httpClient,
+		}, nil
+	case sinkTypeRemoteWrite:
+		httpClient, err := newHTTPClient(c.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("could not setup remote write http client: %w", err)
+		}
+
+		return &sinks.RemoteWrite{
+			URL:         c.URL,
+			Username:    c.Username,
+			Password:    c.Password,
+			BearerToken: c.BearerToken,
+			Headers:     c.Headers,
+			HTTPClient:  httpClient,
+		}, nil
+	case sinkTypeInfluxDB:
+		httpClient, err := newHTTPClient(c.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("could not setup influxdb http client: %w", err)
+		}
+
+		return &sinks.InfluxDB{
+			URL:        c.URL,
+			Token:      c.Token,
+			Username:   c.Username,
+			Password:   c.Password,
+			Headers:    c.Headers,
+			HTTPClient: httpClient,
+		}, nil
+	case sinkTypeStatsD, sinkTypeDogStatsD:
+		return &sinks.StatsD{Addr: c.Address, DogStatsD: c.Type == sinkTypeDogStatsD}, nil
+	case sinkTypeArchive:
+		return &sinks.Archive{
+			Dir:      c.Path,
+			Format:   sinks.ArchiveFormatMap[c.Format],
+			MaxSize:  c.MaxSize,
+			MaxAge:   c.MaxAge,
+			MaxFiles: c.MaxFiles,
+			Compress: c.Compress,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid sink type %q", c.Type)
+}
+
+// parseHeaders like "key=value,other=value",
+// the same format as OTEL_EXPORTER_OTLP_HEADERS.
+func parseHeaders(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	out := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q", pair)
+		}
+
+		out[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return out, nil
+}
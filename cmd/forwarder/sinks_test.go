@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseHeaders(t *testing.T) {
+	tt := []struct {
+		name    string
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", in: "", want: nil},
+		{name: "ok", in: "api-key=secret, x-scope = team=a", want: map[string]string{"api-key": "secret", "x-scope": "team=a"}},
+		{name: "missing_value", in: "api-key", wantErr: true},
+		{name: "missing_key", in: "=secret", wantErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseHeaders(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v; got %v", tc.wantErr, err)
+			}
+
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Errorf("want headers %v; got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// memStore keeps the agent registration in memory,
+// so a dry-run does not leave anything on disk.
+type memStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (s *memStore) Has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.data[key]
+	return ok
+}
+
+func (s *memStore) Write(key string, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[key] = append([]byte(nil), val...)
+	return nil
+}
+
+func (s *memStore) Read(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, ok := s.data[key]
+	if !ok {
+		return nil, fmt.Errorf("could not read %q: %w", key, os.ErrNotExist)
+	}
+
+	return val, nil
+}
+
+func (s *memStore) Erase(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, key)
+	return nil
+}
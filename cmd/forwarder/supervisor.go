@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud/dryrun"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/notify"
+	fluentbit "github.com/calyptia/go-fluent-bit-metrics"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/lucasepe/codename"
+)
+
+// notifyTimeout of each webhook notification, retries included.
+const notifyTimeout = time.Second * 30
+
+// notifyQueueSize is the max number of notifications waiting
+// to be delivered to each webhook. Newer ones are dropped once full.
+const notifyQueueSize = 100
+
+// supervisor runs a forwarder for each configured agent
+// and applies config changes to them without restarting.
+type supervisor struct {
+	Store  forwarder.Store
+	Logger log.Logger
+	// SkipConfigFiles leaves the agents Fluent Bit config files unread,
+	// for commands not sending them to Cloud.
+	SkipConfigFiles bool
+
+	mu        sync.Mutex
+	running   map[string]*runningForwarder
+	hostnames map[string]string
+	wg        sync.WaitGroup
+	errs      chan error
+	// webhooks of the applied config.
+	webhooks []*webhookQueue
+}
+
+// webhookQueue delivers the notifications of a webhook in order,
+// one at a time, from a single goroutine.
+type webhookQueue struct {
+	webhook *notify.Webhook
+	queue   chan notify.Notification
+	// done once the queue is closed and drained.
+	done chan struct{}
+}
+
+type runningForwarder struct {
+	fd      *forwarder.Forwarder
+	handler http.Handler
+	cancel  context.CancelFunc
+}
+
+// apply the config: running forwarders are reloaded,
+// new agents get started and removed ones get stopped.
+// If any agent setup fails, nothing is applied.
+func (s *supervisor) apply(ctx context.Context, cfg config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running == nil {
+		s.running = map[string]*runningForwarder{}
+		s.errs = make(chan error, 1)
+	}
+
+	next, err := s.forwarders(cfg)
+	if err != nil {
+		return err
+	}
+
+	webhooks, err := newWebhooks(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.setWebhooks(ctx, webhooks)
+
+	keep := map[string]bool{}
+	for _, fd := range next {
+		keep[fd.MachineID] = true
+
+		if r, ok := s.running[fd.MachineID]; ok {
+			err := r.fd.Reload(ctx, fd)
+			if err != nil {
+				_ = level.Warn(s.Logger).Log("msg", "could not reload agent", "machine_id", fd.MachineID, "err", err)
+			}
+			continue
+		}
+
+		s.start(ctx, fd)
+	}
+
+	for machineID, r := range s.running {
+		if !keep[machineID] {
+			_ = level.Info(s.Logger).Log("msg", "stopping removed agent", "machine_id", machineID)
+			r.cancel()
+			delete(s.running, machineID)
+		}
+	}
+
+	return nil
+}
+
+func (s *supervisor) start(ctx context.Context, fd *forwarder.Forwarder) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.running[fd.MachineID] = &runningForwarder{
+		fd:      fd,
+		handler: fd.Handler(),
+		cancel:  cancel,
+	}
+
+	events, unsubscribe := fd.Subscribe(0)
+	go func() {
+		var notifier notify.Notifier
+		for ev := range events {
+			logEvent(log.With(s.Logger, "machine_id", fd.MachineID), ev)
+
+			if n, ok := notifier.Notification(fd.Status(), ev); ok {
+				s.notify(n)
+			}
+		}
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer unsubscribe()
+
+		err := fd.Forward(ctx)
+		if err != nil && ctx.Err() == nil {
+			select {
+			case s.errs <- fmt.Errorf("agent %q: %w", fd.MachineID, err):
+			default:
+			}
+		}
+	}()
+}
+
+// setWebhooks starts a queue for each webhook and closes the previous ones.
+// Queues of the same endpoint start delivering once the previous one is drained,
+// so notifications stay in order across config changes.
+// It must be called with the mutex locked.
+func (s *supervisor) setWebhooks(ctx context.Context, webhooks []*notify.Webhook) {
+	prev := map[string]*webhookQueue{}
+	for _, q := range s.webhooks {
+		prev[webhookKey(q.webhook)] = q
+		close(q.queue)
+	}
+
+	s.webhooks = make([]*webhookQueue, len(webhooks))
+	for i, wh := range webhooks {
+		q := &webhookQueue{
+			webhook: wh,
+			queue:   make(chan notify.Notification, notifyQueueSize),
+			done:    make(chan struct{}),
+		}
+		s.webhooks[i] = q
+
+		key := webhookKey(wh)
+		go s.deliver(ctx, q, prev[key])
+		delete(prev, key)
+	}
+}
+
+// webhookKey identifies the endpoint of a webhook.
+func webhookKey(wh *notify.Webhook) string {
+	return string(wh.Format) + " " + wh.URL + " " + wh.RoutingKey
+}
+
+// deliver the notifications of the queue until it is closed,
+// after the previous queue of the same endpoint, if any, is done.
+func (s *supervisor) deliver(ctx context.Context, q *webhookQueue, prev *webhookQueue) {
+	defer close(q.done)
+
+	if prev != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-prev.done:
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-q.queue:
+			if !ok {
+				return
+			}
+
+			notifyCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+			err := q.webhook.Notify(notifyCtx, n)
+			cancel()
+			if err != nil {
+				_ = level.Warn(s.Logger).Log("msg", "could not notify webhook", "machine_id", n.MachineID, "event", n.Kind, "err", err)
+			}
+		}
+	}
+}
+
+// notify queues the notification on the webhooks wanting it without blocking.
+func (s *supervisor) notify(n notify.Notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, q := range s.webhooks {
+		if !q.webhook.Wants(n.Kind) {
+			continue
+		}
+
+		select {
+		case q.queue <- n:
+		default:
+			_ = level.Warn(s.Logger).Log("msg", "dropped webhook notification, queue is full", "machine_id", n.MachineID, "event", n.Kind)
+		}
+	}
+}
+
+// newWebhooks of the notifications config,
+// along with the alerts one.
+func newWebhooks(cfg config) ([]*notify.Webhook, error) {
+	var out []*notify.Webhook
+	for i, wh := range cfg.Notifications.Webhooks {
+		webhook, err := newWebhook(wh)
+		if err != nil {
+			return nil, fmt.Errorf("notifications.webhooks[%d]: %w", i, err)
+		}
+
+		out = append(out, webhook)
+	}
+
+	if wh := cfg.Alerts.webhook(); wh != nil {
+		out = append(out, wh)
+	}
+
+	return out, nil
+}
+
+// forwarders for each configured agent, not started.
+func (s *supervisor) forwarders(cfg config) ([]*forwarder.Forwarder, error) {
+	out := make([]*forwarder.Forwarder, len(cfg.Agents))
+	for i, agent := range cfg.Agents {
+		fd, err := s.newForwarder(cfg, agent)
+		if err != nil {
+			return nil, fmt.Errorf("agents[%d]: %w", i, err)
+		}
+
+		out[i] = fd
+	}
+
+	return out, nil
+}
+
+// wait for all forwarders to stop.
+func (s *supervisor) wait() {
+	s.wg.Wait()
+}
+
+func (s *supervisor) newForwarder(cfg config, agent agentConfig) (*forwarder.Forwarder, error) {
+	compression, ok := cloud.CompressionMap[cfg.Cloud.Compression]
+	if !ok {
+		return nil, fmt.Errorf("invalid cloud compression %q", cfg.Cloud.Compression)
+	}
+
+	hostname, err := s.hostname(agent)
+	if err != nil {
+		return nil, err
+	}
+
+	var rawConfig string
+	if agent.ConfigFile != "" && !s.SkipConfigFiles {
+		b, err := os.ReadFile(agent.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read file %q: %w", agent.ConfigFile, err)
+		}
+
+		rawConfig = string(b)
+	}
+
+	agentHTTPClient, err := newHTTPClient(agent.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("could not setup agent http client: %w", err)
+	}
+
+	cloudHTTPClient, err := newHTTPClient(cfg.Cloud.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("could not setup cloud http client: %w", err)
+	}
+
+	sinks := make([]forwarder.Sink, len(cfg.Sinks))
+	counterSeries := map[string][]forwarder.CounterSeries{}
+	for i, sink := range cfg.Sinks {
+		sinks[i], err = newSink(sink)
+		if err != nil {
+			return nil, fmt.Errorf("sinks[%d]: %w", i, err)
+		}
+
+		for _, series := range sink.CounterSeries {
+			v, ok := forwarder.CounterSeriesMap[series]
+			if !ok {
+				return nil, fmt.Errorf("sinks[%d]: invalid counter series %q", i, series)
+			}
+
+			counterSeries[sinks[i].Name()] = append(counterSeries[sinks[i].Name()], v)
+		}
+	}
+
+	var cloudClient forwarder.CloudClient = &cloud.Client{
+		HTTPClient:         cloudHTTPClient,
+		BaseURL:            cfg.Cloud.URL,
+		ProjectToken:       cfg.Cloud.ProjectToken,
+		ProjectTokenSource: tokenSource(cfg.Cloud.ProjectTokenFile, cfg.Cloud.ProjectTokenCommand),
+		AgentTokenSource:   tokenSource(agent.TokenFile, agent.TokenCommand),
+		Compression:        compression,
+	}
+	if cfg.DryRun {
+		cloudClient = &dryrun.Client{
+			Out:    os.Stdout,
+			Format: dryrun.FormatMap[cfg.DryRunFormat],
+		}
+	}
+
+	return &forwarder.Forwarder{
+		Hostname:      hostname,
+		MachineID:     agent.MachineID,
+		AgentID:       agent.AgentID,
+		ForceRegister: agent.ForceRegister,
+		RawConfig:     rawConfig,
+		Store:         s.Store,
+		Interval:      agent.PullInterval,
+		FluentBitClient: &fluentbit.Client{
+			HTTPClient: agentHTTPClient,
+			BaseURL:    agent.URL,
+		},
+		CloudClient:        cloudClient,
+		Logger:             log.With(s.Logger, "machine_id", agent.MachineID),
+		IncludeSelfMetrics: cfg.IncludeSelfMetrics,
+		ReadyPushIntervals: cfg.ReadyPushIntervals,
+		Labels:             agent.Labels,
+		BufferSize:         cfg.BufferSize,
+		CounterResets:      forwarder.CounterResetsMap[cfg.CounterResets],
+		SinkCounterSeries:  counterSeries,
+		AlertRules:         cfg.Alerts.rules(),
+		ConfigSync:         agent.ConfigSync.configSync(agent, agentHTTPClient),
+		Sinks:              sinks,
+	}, nil
+}
+
+// tokenSource from either a file or a credential helper command.
+// Returns nil if neither is set.
+func tokenSource(file, command string) cloud.TokenSource {
+	if file != "" {
+		return &cloud.FileTokenSource{Path: file}
+	}
+
+	if command != "" {
+		return &cloud.ExecTokenSource{Command: strings.Fields(command)}
+	}
+
+	return nil
+}
+
+// hostname of the agent. If empty, a random one is generated
+// and kept for the machine ID across reloads.
+func (s *supervisor) hostname(agent agentConfig) (string, error) {
+	if agent.Hostname != "" {
+		return agent.Hostname, nil
+	}
+
+	if s.hostnames == nil {
+		s.hostnames = map[string]string{}
+	}
+
+	if hostname, ok := s.hostnames[agent.MachineID]; ok {
+		return hostname, nil
+	}
+
+	rng, err := codename.DefaultRNG()
+	if err != nil {
+		return "", fmt.Errorf("could not generate hostname random seed: %w", err)
+	}
+
+	hostname := codename.Generate(rng, 4)
+	s.hostnames[agent.MachineID] = hostname
+	_ = level.Info(s.Logger).Log("generated_hostname", hostname, "machine_id", agent.MachineID)
+	return hostname, nil
+}
+
+// ServeHTTP serves the forwarder own endpoints.
+// With a single agent, they are served at the root.
+// With many, each agent is served under "/agents/{machineID}/",
+// and "/healthz", "/readyz" and "/status" report on all of them.
+func (s *supervisor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	running := make([]*runningForwarder, 0, len(s.running))
+	for _, r := range s.running {
+		running = append(running, r)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].fd.MachineID < running[j].fd.MachineID
+	})
+
+	if len(running) == 1 {
+		running[0].handler.ServeHTTP(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/agents/") {
+		rest := strings.TrimPrefix(r.URL.Path, "/agents/")
+		machineID := rest
+		if i := strings.Index(rest, "/"); i != -1 {
+			machineID = rest[:i]
+		}
+
+		for _, rf := range running {
+			if rf.fd.MachineID == machineID {
+				http.StripPrefix("/agents/"+machineID, rf.handler).ServeHTTP(w, r)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/healthz":
+		respondText(w, http.StatusOK, "ok")
+	case "/readyz":
+		var notReady []string
+		for _, rf := range running {
+			if err := rf.fd.Ready(); err != nil {
+				notReady = append(notReady, fmt.Sprintf("%s: %v", rf.fd.MachineID, err))
+			}
+		}
+
+		if len(notReady) != 0 {
+			respondText(w, http.StatusServiceUnavailable, strings.Join(notReady, "\n"))
+			return
+		}
+
+		respondText(w, http.StatusOK, "ok")
+	case "/status":
+		statuses := make([]forwarder.Status, len(running))
+		for i, rf := range running {
+			statuses[i] = rf.fd.Status()
+		}
+
+		b, err := json.Marshal(statuses)
+		if err != nil {
+			respondText(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write(b)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func respondText(w http.ResponseWriter, statusCode int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_, _ = fmt.Fprintln(w, text)
+}
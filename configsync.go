@@ -0,0 +1,658 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// DefaultConfigSyncInterval between fetches of the desired config.
+	DefaultConfigSyncInterval = time.Second * 30
+	// DefaultConfigHealthTimeout is how long a reload has to be confirmed
+	// and Fluent Bit healthy after it before rolling back.
+	DefaultConfigHealthTimeout = time.Second * 30
+)
+
+// configHealthCheckInterval between Fluent Bit fetches after a reload.
+var configHealthCheckInterval = time.Second
+
+// configHealthyChecks is the number of consecutive healthy checks
+// after a reload for a config to be applied.
+var configHealthyChecks = 3
+
+// ConfigSync applies the Fluent Bit config desired on Cloud for the agent.
+// Each new version is validated and written atomically over Path,
+// keeping the previous config at Path+".bak", and Fluent Bit is reloaded.
+// If the reload cannot be confirmed, or Fluent Bit does not stay reachable
+// after it, the backup is restored and Fluent Bit reloaded again.
+// The outcome is reported back to Cloud on the agent, retrying on each sync
+// until it gets it. The last version processed is kept on the store,
+// so it is not applied again after a restart.
+type ConfigSync struct {
+	// Path of the Fluent Bit config file. Required.
+	Path string
+	// Reloader makes Fluent Bit load the written config. Required.
+	Reloader Reloader
+	// ValidateCommand and its arguments run with the path of the
+	// candidate config appended, like "fluent-bit --dry-run -c".
+	// The config is rejected if it exits with non-zero.
+	// Empty only checks the config is not blank.
+	ValidateCommand []string
+	// Interval between fetches of the desired config.
+	// Defaults to DefaultConfigSyncInterval.
+	Interval time.Duration
+	// Wait for the desired config to change on each fetch, long-polling Cloud.
+	// Must be shorter than the cloud HTTP client timeout.
+	// Zero fetches without waiting, once per Interval.
+	Wait time.Duration
+	// HealthTimeout defaults to DefaultConfigHealthTimeout.
+	HealthTimeout time.Duration
+}
+
+// Reloader makes Fluent Bit load its config file again.
+type Reloader interface {
+	Reload(ctx context.Context) error
+}
+
+// ReloadCounter is a Reloader able to fetch the number of hot reloads
+// Fluent Bit did, to confirm each reload.
+// Otherwise reloads are confirmed by the Fluent Bit uptime going down,
+// if the FluentBitClient is an UpTimeClient.
+type ReloadCounter interface {
+	ReloadCount(ctx context.Context) (int, error)
+}
+
+// HTTPReloader reloads Fluent Bit with its hot reload endpoint,
+// available since Fluent Bit 2.0 with "Hot_Reload On".
+type HTTPReloader struct {
+	// BaseURL of the Fluent Bit HTTP server, like "http://localhost:2020".
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func (r *HTTPReloader) Reload(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(r.BaseURL, "/")+"/api/v2/reload", nil)
+	if err != nil {
+		return fmt.Errorf("could not create request to reload fluent bit: %w", err)
+	}
+
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not do request to reload fluent bit: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("unexpected status %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		if s := strings.TrimSpace(string(b)); s != "" {
+			err = fmt.Errorf("%w: %s", err, s)
+		}
+		return fmt.Errorf("could not reload fluent bit: %w", err)
+	}
+
+	// Fluent Bit responds with a negative status if the reload was not done,
+	// like while another one is in progress.
+	var out struct {
+		Reload string `json:"reload"`
+		Status *int   `json:"status"`
+	}
+	if json.Unmarshal(b, &out) == nil && out.Status != nil && *out.Status != 0 {
+		return fmt.Errorf("could not reload fluent bit: reload %s with status %d", out.Reload, *out.Status)
+	}
+
+	return nil
+}
+
+func (r *HTTPReloader) ReloadCount(ctx context.Context) (int, error) {
+	return fetchReloadCount(ctx, r.HTTPClient, r.BaseURL)
+}
+
+// SignalReloader reloads Fluent Bit by sending it SIGHUP,
+// supported since Fluent Bit 2.0 with hot reload enabled.
+type SignalReloader struct {
+	// PIDFile with the Fluent Bit process ID.
+	// It is read on each reload, since it changes if Fluent Bit restarts.
+	PIDFile string
+	// BaseURL of the Fluent Bit HTTP server, like "http://localhost:2020",
+	// to confirm reloads with the hot reload count.
+	// Optional.
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func (r *SignalReloader) Reload(ctx context.Context) error {
+	b, err := os.ReadFile(r.PIDFile)
+	if err != nil {
+		return fmt.Errorf("could not read fluent bit pid file: %w", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid fluent bit pid %q", strings.TrimSpace(string(b)))
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("could not find fluent bit process: %w", err)
+	}
+
+	err = p.Signal(syscall.SIGHUP)
+	if err != nil {
+		return fmt.Errorf("could not signal fluent bit process %d: %w", pid, err)
+	}
+
+	return nil
+}
+
+func (r *SignalReloader) ReloadCount(ctx context.Context) (int, error) {
+	if r.BaseURL == "" {
+		return 0, errors.New("fluent bit base url not set")
+	}
+
+	return fetchReloadCount(ctx, r.HTTPClient, r.BaseURL)
+}
+
+// fetchReloadCount from the Fluent Bit hot reload endpoint.
+func fetchReloadCount(ctx context.Context, client *http.Client, baseURL string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/api/v2/reload", nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not create request to fetch fluent bit reload count: %w", err)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("could not do request to fetch fluent bit reload count: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("could not fetch fluent bit reload count: unexpected status %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	var out struct {
+		HotReloadCount *int `json:"hot_reload_count"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode fluent bit reload count: %w", err)
+	}
+
+	if out.HotReloadCount == nil {
+		return 0, errors.New("fluent bit reload count missing")
+	}
+
+	return *out.HotReloadCount, nil
+}
+
+func validateConfigSync(cs *ConfigSync, cloudClient CloudClient) error {
+	if cs == nil {
+		return nil
+	}
+
+	if _, ok := cloudClient.(DesiredConfigFetcher); !ok {
+		return errors.New("config sync requires a cloud client able to fetch desired configs")
+	}
+
+	if cs.Path == "" {
+		return errors.New("config sync path required")
+	}
+
+	if cs.Reloader == nil {
+		return errors.New("config sync reloader required")
+	}
+
+	if cs.Interval < 0 || cs.Wait < 0 || cs.HealthTimeout < 0 {
+		return errors.New("config sync durations cannot be negative")
+	}
+
+	return nil
+}
+
+func (cs *ConfigSync) interval() time.Duration {
+	if cs.Interval <= 0 {
+		return DefaultConfigSyncInterval
+	}
+
+	return cs.Interval
+}
+
+func (cs *ConfigSync) healthTimeout() time.Duration {
+	if cs.HealthTimeout <= 0 {
+		return DefaultConfigHealthTimeout
+	}
+
+	return cs.HealthTimeout
+}
+
+// configSyncState persisted on the store.
+type configSyncState struct {
+	// Version of the last desired config processed, applied or not.
+	Version string
+	// Unreported status of Version, until Cloud gets it.
+	Unreported *cloud.AgentConfigStatus
+}
+
+func (fd *Forwarder) configStoreKey() string {
+	return fd.MachineID + ".config"
+}
+
+func (fd *Forwarder) loadConfigSyncState() configSyncState {
+	var out configSyncState
+	if fd.Store == nil || !fd.Store.Has(fd.configStoreKey()) {
+		return out
+	}
+
+	b, err := fd.Store.Read(fd.configStoreKey())
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&out)
+	}
+	if err != nil {
+		_ = level.Warn(fd.Logger).Log("msg", "could not load config sync state; starting over", "err", err)
+		return configSyncState{}
+	}
+
+	return out
+}
+
+func (fd *Forwarder) storeConfigSyncState(s configSyncState) {
+	if fd.Store == nil {
+		return
+	}
+
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(s)
+	if err == nil {
+		err = fd.Store.Write(fd.configStoreKey(), buff.Bytes())
+	}
+	if err != nil {
+		_ = level.Warn(fd.Logger).Log("msg", "could not store config sync state", "err", err)
+	}
+}
+
+// syncConfig keeps fetching the desired config and applying each new version
+// until the context is done. It does nothing while ConfigSync is not set,
+// which can change with Reload.
+func (fd *Forwarder) syncConfig(ctx context.Context, agentID string) {
+	synced := fd.loadConfigSyncState()
+	fd.state.setConfigVersion(synced.Version)
+
+	for {
+		delay := DefaultConfigSyncInterval
+		if cs := fd.settings().configSync; cs != nil {
+			delay = cs.interval()
+
+			err := fd.syncConfigOnce(ctx, agentID, &synced)
+			if ctx.Err() != nil {
+				return
+			}
+
+			switch {
+			case errors.Is(err, cloud.ErrNotModified):
+				// Long-poll again right away.
+				if cs.Wait > 0 {
+					delay = 0
+				}
+			case errors.Is(err, cloud.ErrNotFound):
+				// No desired config set for the agent.
+			case err != nil:
+				_ = level.Warn(fd.Logger).Log("msg", "could not sync fluent bit config", "err", err)
+			}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// syncConfigOnce reports the status of the last version if Cloud did not get it yet,
+// then fetches the desired config and applies it if it is a new version.
+func (fd *Forwarder) syncConfigOnce(ctx context.Context, agentID string, synced *configSyncState) error {
+	if synced.Unreported != nil {
+		err := fd.reportConfigStatus(ctx, agentID, synced)
+		if err != nil {
+			return err
+		}
+	}
+
+	settings := fd.settings()
+	cs := settings.configSync
+
+	var params cloud.DesiredConfigParams
+	version := synced.Version
+	if version != "" {
+		params.Version = &version
+	}
+	if cs.Wait > 0 {
+		params.Wait = &cs.Wait
+	}
+
+	fetcher, ok := settings.cloudClient.(DesiredConfigFetcher)
+	if !ok {
+		return errors.New("cloud client cannot fetch desired configs")
+	}
+
+	desired, err := fetcher.DesiredConfig(ctx, agentID, params)
+	if errors.Is(err, cloud.ErrNotModified) {
+		return err
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not fetch desired config: %w", err)
+	}
+
+	if desired.Version == version {
+		return nil
+	}
+
+	status := fd.applyConfig(ctx, settings, desired)
+	synced.Version = desired.Version
+	synced.Unreported = &status
+	fd.storeConfigSyncState(*synced)
+	fd.state.setConfigVersion(desired.Version)
+
+	if status.State == cloud.AgentConfigStateApplied {
+		fd.mu.Lock()
+		fd.RawConfig = desired.RawConfig
+		fd.mu.Unlock()
+
+		fd.emit(Event{Kind: EventFluentBitConfigApplied, ConfigVersion: desired.Version})
+	} else {
+		fd.emit(Event{Kind: EventFluentBitConfigFailed, ConfigVersion: desired.Version, Err: errors.New(status.Error)})
+	}
+
+	return fd.reportConfigStatus(ctx, agentID, synced)
+}
+
+// reportConfigStatus of the last version processed to Cloud,
+// along with the config if it was applied.
+func (fd *Forwarder) reportConfigStatus(ctx context.Context, agentID string, synced *configSyncState) error {
+	settings := fd.settings()
+	opts := cloud.UpdateAgentOpts{ConfigStatus: synced.Unreported}
+	if synced.Unreported.State == cloud.AgentConfigStateApplied {
+		opts.RawConfig = &settings.rawConfig
+	}
+
+	err := settings.cloudClient.UpdateAgent(ctx, agentID, opts)
+	if err != nil {
+		return fmt.Errorf("could not report config status: %w", err)
+	}
+
+	synced.Unreported = nil
+	fd.storeConfigSyncState(*synced)
+	return nil
+}
+
+// applyConfig writes the desired config and reloads Fluent Bit,
+// rolling back to the previous config if Fluent Bit is unhealthy after it.
+func (fd *Forwarder) applyConfig(ctx context.Context, settings settings, desired cloud.DesiredConfig) cloud.AgentConfigStatus {
+	cs := settings.configSync
+	failed := func(state cloud.AgentConfigState, err error) cloud.AgentConfigStatus {
+		return cloud.AgentConfigStatus{Version: desired.Version, State: state, Error: err.Error()}
+	}
+
+	if strings.TrimSpace(desired.RawConfig) == "" {
+		return failed(cloud.AgentConfigStateFailed, errors.New("desired config is empty"))
+	}
+
+	current, err := os.ReadFile(cs.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return failed(cloud.AgentConfigStateFailed, fmt.Errorf("could not read current config: %w", err))
+	}
+
+	hasCurrent := err == nil
+	if hasCurrent && bytes.Equal(current, []byte(desired.RawConfig)) {
+		return cloud.AgentConfigStatus{Version: desired.Version, State: cloud.AgentConfigStateApplied}
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(cs.Path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := writeTempFile(cs.Path, []byte(desired.RawConfig), mode)
+	if err != nil {
+		return failed(cloud.AgentConfigStateFailed, err)
+	}
+
+	defer os.Remove(tmp)
+
+	err = validateConfigFile(ctx, cs.ValidateCommand, tmp)
+	if err != nil {
+		return failed(cloud.AgentConfigStateFailed, err)
+	}
+
+	backup := cs.Path + ".bak"
+	if hasCurrent {
+		err = writeFileAtomic(backup, current, mode)
+		if err != nil {
+			return failed(cloud.AgentConfigStateFailed, fmt.Errorf("could not backup current config: %w", err))
+		}
+	}
+
+	err = os.Rename(tmp, cs.Path)
+	if err != nil {
+		return failed(cloud.AgentConfigStateFailed, fmt.Errorf("could not replace config: %w", err))
+	}
+
+	mark := fd.markReload(ctx, settings)
+	err = cs.Reloader.Reload(ctx)
+	if err == nil {
+		err = fd.waitFluentBitHealthy(ctx, settings, mark, cs.healthTimeout())
+	}
+	if err == nil {
+		return cloud.AgentConfigStatus{Version: desired.Version, State: cloud.AgentConfigStateApplied}
+	}
+
+	if !hasCurrent {
+		return failed(cloud.AgentConfigStateFailed, fmt.Errorf("%w; no previous config to roll back to", err))
+	}
+
+	_ = level.Warn(fd.Logger).Log("msg", "rolling back fluent bit config", "version", desired.Version, "err", err)
+
+	rollbackErr := writeFileAtomic(cs.Path, current, mode)
+	if rollbackErr == nil {
+		rollbackErr = cs.Reloader.Reload(ctx)
+	}
+	if rollbackErr != nil {
+		return failed(cloud.AgentConfigStateFailed, fmt.Errorf("%w; could not roll back: %v", err, rollbackErr))
+	}
+
+	return failed(cloud.AgentConfigStateRolledBack, err)
+}
+
+// reloadMark taken before a reload to confirm it after.
+// Both are nil if the reload cannot be confirmed.
+type reloadMark struct {
+	count  *int
+	upTime *uint64
+}
+
+// markReload takes the hot reload count, if the reloader can fetch it,
+// or otherwise the Fluent Bit uptime.
+func (fd *Forwarder) markReload(ctx context.Context, settings settings) reloadMark {
+	if counter, ok := settings.configSync.Reloader.(ReloadCounter); ok {
+		count, err := counter.ReloadCount(ctx)
+		if err == nil {
+			return reloadMark{count: &count}
+		}
+
+		_ = level.Debug(fd.Logger).Log("msg", "could not fetch fluent bit reload count", "err", err)
+	}
+
+	if c, ok := settings.fluentBitClient.(UpTimeClient); ok {
+		// An uptime of zero cannot go down.
+		u, err := c.UpTime(ctx)
+		if err == nil && u.UpTimeSec > 0 {
+			return reloadMark{upTime: &u.UpTimeSec}
+		}
+	}
+
+	return reloadMark{}
+}
+
+// reloadConfirmed tells whether the hot reload count changed
+// or the uptime went down since the mark.
+func (fd *Forwarder) reloadConfirmed(ctx context.Context, settings settings, mark reloadMark) error {
+	switch {
+	case mark.count != nil:
+		count, err := settings.configSync.Reloader.(ReloadCounter).ReloadCount(ctx)
+		if err != nil {
+			return err
+		}
+
+		if count == *mark.count {
+			return fmt.Errorf("could not confirm reload: hot reload count still %d", count)
+		}
+	case mark.upTime != nil:
+		u, err := settings.fluentBitClient.(UpTimeClient).UpTime(ctx)
+		if err != nil {
+			return fmt.Errorf("could not fetch fluent bit uptime: %w", err)
+		}
+
+		if u.UpTimeSec >= *mark.upTime {
+			return fmt.Errorf("could not confirm reload: uptime did not go down from %ds", *mark.upTime)
+		}
+	}
+
+	return nil
+}
+
+// waitFluentBitHealthy waits for the reload to be confirmed and for Fluent Bit
+// metrics to be fetched on configHealthyChecks consecutive checks after it.
+func (fd *Forwarder) waitFluentBitHealthy(ctx context.Context, settings settings, mark reloadMark, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(configHealthCheckInterval)
+	defer ticker.Stop()
+
+	var (
+		lastErr   error
+		confirmed bool
+		healthy   int
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			if lastErr == nil {
+				lastErr = ctx.Err()
+			}
+			return fmt.Errorf("fluent bit unhealthy after reload: %w", lastErr)
+		case <-ticker.C:
+		}
+
+		_, err := settings.fluentBitClient.Metrics(ctx)
+		if err == nil && !confirmed {
+			err = fd.reloadConfirmed(ctx, settings, mark)
+			confirmed = err == nil
+		}
+		if err != nil {
+			// Keep the error of a previous check over the timeout.
+			if lastErr == nil || ctx.Err() == nil {
+				lastErr = err
+			}
+			healthy = 0
+			continue
+		}
+
+		healthy++
+		if healthy >= configHealthyChecks {
+			return nil
+		}
+	}
+}
+
+func validateConfigFile(ctx context.Context, command []string, path string) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:len(command):len(command)], path)...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("invalid config: %w: %s", err, msg)
+		}
+
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	return nil
+}
+
+// writeTempFile next to path, so it can be renamed over it atomically.
+func writeTempFile(path string, b []byte, mode os.FileMode) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("could not create temp config file: %w", err)
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("could not write temp config file: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
+func writeFileAtomic(path string, b []byte, mode os.FileMode) error {
+	tmp, err := writeTempFile(path, b, mode)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not rename temp config file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultEventsBuffer is the default buffer size of a subscription.
+const DefaultEventsBuffer = 64
+
+type EventKind string
+
+const (
+	// EventRegistered is emitted once the agent is registered on Cloud,
+	// either newly created or loaded from the store.
+	EventRegistered EventKind = "registered"
+	// EventConfigUpdated is emitted once a reload changed the agent hostname
+	// or config and it is updated on Cloud. Registering does not emit it.
+	EventConfigUpdated EventKind = "config_updated"
+	// EventPushSucceeded is emitted after each successful metrics push.
+	EventPushSucceeded EventKind = "push_succeeded"
+	// EventPushFailed is emitted after each failed metrics push attempt,
+	// or when the payload could not be produced.
+	EventPushFailed EventKind = "push_failed"
+	// EventPushFailing is emitted once pushes to Cloud have been failing
+	// for ReadyPushIntervals, the same the forwarder stops being ready after.
+	EventPushFailing EventKind = "push_failing"
+	// EventPushRecovered is emitted on the first successful push to Cloud
+	// after EventPushFailing.
+	EventPushRecovered EventKind = "push_recovered"
+	// EventFluentBitUnreachable is emitted after each failed fetch
+	// to the Fluent Bit monitoring API.
+	EventFluentBitUnreachable EventKind = "fluentbit_unreachable"
+	// EventFluentBitRecovered is emitted on the first successful fetch
+	// to the Fluent Bit monitoring API after it was unreachable.
+	EventFluentBitRecovered EventKind = "fluentbit_recovered"
+	// EventFluentBitRestarted is emitted when a Fluent Bit restart is detected,
+	// unless counter resets are not handled.
+	EventFluentBitRestarted EventKind = "fluentbit_restarted"
+	// EventAlertFiring is emitted when an alert rule condition held
+	// for its duration on a series.
+	EventAlertFiring EventKind = "alert_firing"
+	// EventAlertResolved is emitted when the condition of a firing alert
+	// no longer holds, or its series is gone.
+	EventAlertResolved EventKind = "alert_resolved"
+	// EventFluentBitConfigApplied is emitted once a config desired on Cloud
+	// is written and Fluent Bit reloaded it.
+	EventFluentBitConfigApplied EventKind = "fluentbit_config_applied"
+	// EventFluentBitConfigFailed is emitted when a config desired on Cloud
+	// could not be applied, or was rolled back.
+	EventFluentBitConfigFailed EventKind = "fluentbit_config_failed"
+)
+
+// Stage of the collection at which an event happened.
+type Stage string
+
+const (
+	StageFetchBuildInfo      Stage = "fetch_build_info"
+	StageFetchMetrics        Stage = "fetch_metrics"
+	StageFetchStorageMetrics Stage = "fetch_storage_metrics"
+	StageEncode              Stage = "encode"
+	StagePush                Stage = "push"
+)
+
+// Event emitted by the forwarder.
+// Fields are set depending on the kind.
+type Event struct {
+	Kind      EventKind
+	Time      time.Time
+	AgentID   string
+	AgentName string
+	// Stage is set on EventPushFailed and EventFluentBitUnreachable.
+	Stage Stage
+	// Sink name is set on EventPushSucceeded, EventPushFailed,
+	// EventPushFailing and EventPushRecovered.
+	Sink string
+	// Attempt is set on EventPushSucceeded and EventPushFailed, starting at 1.
+	Attempt int
+	// Inserted is the number of metrics the sink inserted, if it reports it.
+	// Set on EventPushSucceeded.
+	Inserted int
+	// PayloadSize in bytes before compression.
+	// Set on EventPushSucceeded and EventPushFailed.
+	PayloadSize int
+	// Duration of the push attempt.
+	// Set on EventPushSucceeded and EventPushFailed.
+	Duration time.Duration
+	// Alert is set on EventAlertFiring and EventAlertResolved.
+	Alert *Alert
+	// ConfigVersion of the desired config.
+	// Set on EventFluentBitConfigApplied and EventFluentBitConfigFailed.
+	ConfigVersion string
+	Err           error
+}
+
+// events fans out emitted events to subscribers without blocking.
+// The zero value is ready to use.
+type events struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   map[int]chan Event
+
+	droppedMu sync.Mutex
+	dropped   uint64
+}
+
+func (e *events) subscribe(buffer int) (<-chan Event, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.subs == nil {
+		e.subs = map[int]chan Event{}
+	}
+
+	id := e.nextID
+	e.nextID++
+
+	ch := make(chan Event, buffer)
+	e.subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+
+			delete(e.subs, id)
+			close(ch)
+		})
+	}
+}
+
+// emit sends the event to every subscriber.
+// Subscribers with a full buffer miss the event.
+func (e *events) emit(ev Event) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+			e.droppedMu.Lock()
+			e.dropped++
+			e.droppedMu.Unlock()
+		}
+	}
+}
+
+func (e *events) droppedCount() uint64 {
+	e.droppedMu.Lock()
+	defer e.droppedMu.Unlock()
+
+	return e.dropped
+}
+
+// Subscribe to the forwarder events.
+// Events are never blocked on: if the subscriber does not keep up
+// and its buffer is full, events are dropped.
+// Buffer defaults to DefaultEventsBuffer.
+// Call the returned function to unsubscribe and close the channel.
+func (fd *Forwarder) Subscribe(buffer int) (<-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = DefaultEventsBuffer
+	}
+
+	return fd.events.subscribe(buffer)
+}
+
+func (fd *Forwarder) emit(ev Event) {
+	ev.Time = fd.now()
+	if ev.AgentID == "" {
+		status := fd.Status()
+		ev.AgentID = status.AgentID
+		ev.AgentName = status.AgentName
+	}
+
+	if ev.Err != nil {
+		fd.state.setErr(ev.Err, ev.Time)
+
+		select {
+		case fd.errs() <- ev.Err:
+		default:
+		}
+	}
+
+	fd.events.emit(ev)
+}
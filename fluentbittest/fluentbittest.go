@@ -0,0 +1,377 @@
+// Package fluentbittest provides an in-process stand-in for the Fluent Bit
+// monitoring HTTP API with scriptable state, to be used on tests.
+package fluentbittest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"time"
+
+	fluentbit "github.com/calyptia/go-fluent-bit-metrics"
+)
+
+// Step of counters added to the metrics on each fetch.
+// Maps keyed by plugin name.
+type Step struct {
+	Input  map[string]fluentbit.MetricInput
+	Output map[string]fluentbit.MetricOutput
+}
+
+// Failure to inject in the responses of the matching requests.
+type Failure struct {
+	// Method to match. Empty matches any.
+	Method string
+	// Path pattern to match as in path.Match. Example: "/api/v1/*".
+	// Empty matches any.
+	Path       string
+	StatusCode int
+	Body       string
+	// Times the failure is injected. Zero means forever.
+	Times int
+}
+
+// Handler implementing the fake Fluent Bit monitoring API.
+// Use NewHandler to create one.
+type Handler struct {
+	mu        sync.Mutex
+	buildInfo fluentbit.BuildInfo
+	metrics   fluentbit.Metrics
+	storage   fluentbit.StorageMetrics
+	step      Step
+	startedAt time.Time
+	latency   time.Duration
+	failures  []*Failure
+	fetches   map[string]int
+	reloads   int
+	onReload  func()
+	nowFunc   func() time.Time
+}
+
+// NewHandler with a community edition build info and no plugins.
+func NewHandler() *Handler {
+	h := &Handler{
+		metrics: fluentbit.Metrics{
+			Input:  map[string]fluentbit.MetricInput{},
+			Output: map[string]fluentbit.MetricOutput{},
+		},
+		storage: fluentbit.StorageMetrics{
+			InputChunks: map[string]fluentbit.PluginStorage{},
+		},
+		fetches: map[string]int{},
+		nowFunc: time.Now,
+	}
+	h.buildInfo.FluentBit.Version = "1.8.0"
+	h.buildInfo.FluentBit.Edition = "Community"
+	h.buildInfo.FluentBit.Flags = []string{"FLB_HAVE_METRICS", "FLB_HAVE_HTTP_SERVER"}
+	h.startedAt = h.nowFunc()
+	return h
+}
+
+// Server is a fake Fluent Bit listening on a system-chosen port on the local
+// loopback interface.
+type Server struct {
+	*Handler
+	*httptest.Server
+}
+
+// NewServer starts and returns a new fake Fluent Bit server.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	h := NewHandler()
+	return &Server{
+		Handler: h,
+		Server:  httptest.NewServer(h),
+	}
+}
+
+func (h *Handler) SetBuildInfo(version, edition string, flags []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buildInfo.FluentBit.Version = version
+	h.buildInfo.FluentBit.Edition = edition
+	h.buildInfo.FluentBit.Flags = flags
+}
+
+// SetInput adds or replaces an input plugin metrics.
+func (h *Handler) SetInput(name string, m fluentbit.MetricInput) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.metrics.Input[name] = m
+}
+
+// RemoveInput makes the input plugin disappear from metrics and storage.
+func (h *Handler) RemoveInput(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.metrics.Input, name)
+	delete(h.storage.InputChunks, name)
+}
+
+// SetOutput adds or replaces an output plugin metrics.
+func (h *Handler) SetOutput(name string, m fluentbit.MetricOutput) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.metrics.Output[name] = m
+}
+
+// RemoveOutput makes the output plugin disappear from metrics.
+func (h *Handler) RemoveOutput(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.metrics.Output, name)
+}
+
+// SetInputStorage adds or replaces an input plugin storage metrics.
+func (h *Handler) SetInputStorage(name string, s fluentbit.PluginStorage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.storage.InputChunks[name] = s
+}
+
+// SetStorageLayer replaces the storage layer metrics.
+func (h *Handler) SetStorageLayer(totalChunks, memChunks, fsChunks, fsChunksUp, fsChunksDown uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	chunks := &h.storage.StorageLayer.Chunks
+	chunks.TotalChunks = totalChunks
+	chunks.MemChunks = memChunks
+	chunks.FsChunks = fsChunks
+	chunks.FsChunksUp = fsChunksUp
+	chunks.FsChunksDown = fsChunksDown
+}
+
+// SetStep sets the counters added on each metrics fetch.
+func (h *Handler) SetStep(step Step) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.step = step
+}
+
+// Advance adds the step counters once.
+func (h *Handler) Advance(step Step) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.advance(step)
+}
+
+// Restart simulates a Fluent Bit restart:
+// all counters are zeroed and uptime starts again.
+func (h *Handler) Restart() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.restart()
+}
+
+// Reloads returns how many hot reloads were requested
+// with POST or PUT /api/v2/reload.
+func (h *Handler) Reloads() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.reloads
+}
+
+// OnReload sets a function called after each hot reload,
+// like to inject failures simulating a bad config.
+func (h *Handler) OnReload(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.onReload = fn
+}
+
+// restart must be called with the lock held.
+func (h *Handler) restart() {
+	for name := range h.metrics.Input {
+		h.metrics.Input[name] = fluentbit.MetricInput{}
+	}
+	for name := range h.metrics.Output {
+		h.metrics.Output[name] = fluentbit.MetricOutput{}
+	}
+	h.startedAt = h.nowFunc()
+}
+
+// SetLatency delays every response.
+func (h *Handler) SetLatency(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.latency = d
+}
+
+// InjectFailure makes the matching requests respond with the given failure.
+// Failures are matched in the order they were injected.
+// Note that the Fluent Bit client keeps retrying on 404.
+func (h *Handler) InjectFailure(f Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures = append(h.failures, &f)
+}
+
+// ClearFailures removes all injected failures.
+func (h *Handler) ClearFailures() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures = nil
+}
+
+// Fetches returns how many successful requests the given path got.
+func (h *Handler) Fetches(path string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.fetches[path]
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	latency := h.latency
+	h.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+
+	reload := r.URL.Path == "/api/v2/reload" && (r.Method == http.MethodPost || r.Method == http.MethodPut)
+	if r.Method != http.MethodGet && !reload {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if f := h.failure(r); f != nil {
+		w.WriteHeader(f.StatusCode)
+		_, _ = io.WriteString(w, f.Body)
+		return
+	}
+
+	if reload {
+		h.reload(w)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var v interface{}
+	switch r.URL.Path {
+	case "/":
+		v = h.buildInfo
+	case "/api/v1/uptime":
+		secs := uint64(h.nowFunc().Sub(h.startedAt) / time.Second)
+		v = fluentbit.UpTime{
+			UpTimeSec: secs,
+			UpTimeHr:  fmt.Sprintf("Fluent Bit has been running: %d seconds", secs),
+		}
+	case "/api/v1/metrics":
+		h.advance(h.step)
+		v = h.metrics
+	case "/api/v1/storage":
+		v = h.storage
+	case "/api/v2/reload":
+		v = map[string]int{"hot_reload_count": h.reloads}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.fetches[r.URL.Path]++
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// reload the same way Fluent Bit does on a hot reload,
+// restarting the pipeline with zeroed counters.
+func (h *Handler) reload(w http.ResponseWriter) {
+	h.mu.Lock()
+	h.restart()
+	h.reloads++
+	h.fetches["/api/v2/reload"]++
+	onReload := h.onReload
+	h.mu.Unlock()
+
+	if onReload != nil {
+		onReload()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = io.WriteString(w, `{"reload":"done","status":0}`)
+}
+
+// advance must be called with the lock held.
+func (h *Handler) advance(step Step) {
+	for name, delta := range step.Input {
+		m := h.metrics.Input[name]
+		m.Records += delta.Records
+		m.Bytes += delta.Bytes
+		h.metrics.Input[name] = m
+	}
+
+	for name, delta := range step.Output {
+		m := h.metrics.Output[name]
+		m.ProcRecords += delta.ProcRecords
+		m.ProcBytes += delta.ProcBytes
+		m.Errors += delta.Errors
+		m.Retries += delta.Retries
+		m.RetriesFailed += delta.RetriesFailed
+		h.metrics.Output[name] = m
+	}
+}
+
+func (h *Handler) failure(r *http.Request) *Failure {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, f := range h.failures {
+		if f.Method != "" && f.Method != r.Method {
+			continue
+		}
+
+		if f.Path != "" {
+			if ok, _ := path.Match(f.Path, r.URL.Path); !ok {
+				continue
+			}
+		}
+
+		out := *f
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				h.failures = append(h.failures[:i], h.failures[i+1:]...)
+			}
+		}
+
+		return &out
+	}
+
+	return nil
+}
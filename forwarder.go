@@ -1,31 +1,85 @@
 package forwarder
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"fmt"
-	"strings"
+	"sync"
 	"time"
 
-	cmetrics "github.com/calyptia/cmetrics-go"
 	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
 	fluentbit "github.com/calyptia/go-fluent-bit-metrics"
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 )
 
+const (
+	maxPushAttempts  = 3
+	pushRetryBackoff = time.Millisecond * 500
+)
+
+// Forwarder pulls metrics from a Fluent Bit agent and pushes them to Cloud,
+// along with any other sinks.
+// Settings can be changed while forwarding using Reload.
 type Forwarder struct {
-	Hostname        string
-	MachineID       string
+	Hostname  string
+	MachineID string
+	// AgentID of a pre-provisioned agent.
+	// When set, the agent is not created nor stored,
+	// and the cloud client must provide its token.
+	AgentID string
+	// ForceRegister creates a new agent even if one with the same machine ID
+	// already exists on Cloud, instead of adopting it when the store is lost.
+	ForceRegister   bool
 	RawConfig       string
 	Store           Store
 	Interval        time.Duration
 	FluentBitClient FluentBitClient
 	CloudClient     CloudClient
 	Logger          log.Logger
-
-	errChan chan error
-	nowFunc func() time.Time
+	// IncludeSelfMetrics adds the forwarder own metrics
+	// to each snapshot under the "forwarder" namespace.
+	IncludeSelfMetrics bool
+	// ReadyPushIntervals is the number of intervals without a successful push
+	// after which the forwarder is no longer ready.
+	// Defaults to DefaultReadyPushIntervals.
+	ReadyPushIntervals int
+	// Labels identifying the agent, added to the snapshots pushed to sinks.
+	Labels map[string]string
+	// BufferSize is the max number of snapshots kept in memory per sink
+	// while they cannot be pushed, to retry them on the next intervals.
+	// Zero disables buffering.
+	BufferSize int
+	// Sinks to push each snapshot to, along with Cloud.
+	Sinks []Sink
+	// CounterResets sets how Fluent Bit restarts are handled.
+	// Defaults to CounterResetsNone.
+	CounterResets CounterResets
+	// SinkCounterSeries sets, by sink name, the forms in which plugin counters
+	// are pushed to each sink, like deltas or rates instead of, or along with,
+	// the cumulative totals. Sinks not set, like Cloud, get cumulative only.
+	SinkCounterSeries map[string][]CounterSeries
+	// AlertRules evaluated on each snapshot.
+	// Alerts are emitted as events, and counted on a
+	// "forwarder_alerts_firing" gauge pushed along the snapshot
+	// to the sinks other than Cloud.
+	AlertRules []AlertRule
+	// ConfigSync applies the Fluent Bit config desired on Cloud.
+	// Nil disables it.
+	ConfigSync *ConfigSync
+
+	// mu guards the fields that can change with Reload.
+	mu             sync.RWMutex
+	initOnce       sync.Once
+	errChan        chan error
+	reloaded       chan struct{}
+	events         events
+	nowFunc        func() time.Time
+	selfMetrics    selfMetrics
+	state          state
+	sinkRunners    sinkRunners
+	counterTracker counterTracker
+	counterDeriver counterDeriver
+	alertEvaluator alertEvaluator
 }
 
 type Store interface {
@@ -41,6 +95,13 @@ type FluentBitClient interface {
 	StorageMetrics(ctx context.Context) (fluentbit.StorageMetrics, error)
 }
 
+// UpTimeClient is a FluentBitClient able to fetch the Fluent Bit uptime.
+// If implemented, it is used to detect Fluent Bit restarts
+// when tracking counter resets.
+type UpTimeClient interface {
+	UpTime(ctx context.Context) (fluentbit.UpTime, error)
+}
+
 type CloudClient interface {
 	SetAgentToken(token string)
 	CreateAgent(ctx context.Context, payload cloud.CreateAgentPayload) (cloud.CreatedAgentPayload, error)
@@ -48,294 +109,200 @@ type CloudClient interface {
 	AddAgentMetrics(ctx context.Context, agentID string, msgPackEncoded []byte) (cloud.CreatedAgentMetrics, error)
 }
 
+// AgentFetcher is a CloudClient able to fetch an agent,
+// required by VerifyAgent.
+type AgentFetcher interface {
+	Agent(ctx context.Context, agentID string) (cloud.Agent, error)
+}
+
+// AgentDeleter is a CloudClient able to delete an agent,
+// required by Unregister.
+type AgentDeleter interface {
+	DeleteAgent(ctx context.Context, agentID string) error
+}
+
+// AgentAdopter is a CloudClient able to list agents and rotate their token.
+// If implemented, an existing agent with the same machine ID is adopted
+// instead of registering a new one when none is stored.
+type AgentAdopter interface {
+	Agents(ctx context.Context, params cloud.AgentsParams) (cloud.Agents, error)
+	RotateAgentToken(ctx context.Context, agentID string) (cloud.RotatedAgentToken, error)
+}
+
+// DesiredConfigFetcher is a CloudClient able to fetch
+// the desired Fluent Bit config of an agent, required by ConfigSync.
+type DesiredConfigFetcher interface {
+	DesiredConfig(ctx context.Context, agentID string, params cloud.DesiredConfigParams) (cloud.DesiredConfig, error)
+}
+
+// Errs returns the errors that happen while forwarding.
+//
+// Deprecated: use Subscribe, which carries structured events.
+// Errors are dropped if not read in time.
 func (fd *Forwarder) Errs() <-chan error {
-	if fd.errChan == nil {
-		fd.errChan = make(chan error)
-	}
+	return fd.errs()
+}
 
+func (fd *Forwarder) errs() chan error {
+	fd.init()
 	return fd.errChan
 }
 
+func (fd *Forwarder) init() {
+	fd.initOnce.Do(func() {
+		fd.errChan = make(chan error, DefaultEventsBuffer)
+		fd.reloaded = make(chan struct{}, 1)
+	})
+}
+
 type StorePayload struct {
 	AgentID    string
 	AgentToken string
 	AgentName  string
 }
 
+// Forward registers the agent and pushes a snapshot of its metrics to every sink
+// on each interval until the context is done.
+// It returns once every goroutine it started is done.
 func (fd *Forwarder) Forward(ctx context.Context) error {
-	buildInfo, err := fd.FluentBitClient.BuildInfo(ctx)
+	fd.init()
+
+	settings := fd.settings()
+	err := validateSinks(settings.sinks)
 	if err != nil {
-		return fmt.Errorf("could not fetch fluent bit build info: %w", err)
+		return err
 	}
 
-	var payload StorePayload
-	if fd.Store.Has(fd.MachineID) {
-		b, err := fd.Store.Read(fd.MachineID)
-		if err != nil {
-			return fmt.Errorf("could not read from store: %w", err)
-		}
+	err = validateAlertRules(settings.alertRules)
+	if err != nil {
+		return err
+	}
 
-		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&payload)
-		if err != nil {
-			return fmt.Errorf("could not decode store payload: %w", err)
-		}
+	err = validateConfigSync(settings.configSync, settings.cloudClient)
+	if err != nil {
+		return err
+	}
 
-		edition := cloud.AgentEdition(buildInfo.FluentBit.Edition)
-		err = fd.CloudClient.UpdateAgent(ctx, payload.AgentID, cloud.UpdateAgentOpts{
-			Name:      &fd.Hostname,
-			Version:   &buildInfo.FluentBit.Version,
-			Edition:   &edition,
-			Flags:     &buildInfo.FluentBit.Flags,
-			RawConfig: &fd.RawConfig,
-		})
-		if err != nil {
-			return fmt.Errorf("could not update agent: %w", err)
-		}
-	} else {
-		createdAgent, err := fd.CloudClient.CreateAgent(ctx, cloud.CreateAgentPayload{
-			Name:      fd.Hostname,
-			MachineID: fd.MachineID,
-			Type:      cloud.AgentTypeFluentBit,
-			Version:   buildInfo.FluentBit.Version,
-			Edition:   cloud.AgentEdition(strings.ToLower(buildInfo.FluentBit.Edition)),
-			Flags:     buildInfo.FluentBit.Flags,
-			RawConfig: fd.RawConfig,
-		})
-		if err != nil {
-			return fmt.Errorf("could not create agent: %w", err)
-		}
+	buildInfo, err := settings.fluentBitClient.BuildInfo(ctx)
+	if err != nil {
+		fd.selfMetrics.observeFetchErr(fetchEndpointBuildInfo)
+		err = fmt.Errorf("could not fetch fluent bit build info: %w", err)
+		fd.fluentBitUnreachable(StageFetchBuildInfo, err)
+		return err
+	}
 
-		payload.AgentID = createdAgent.ID
-		payload.AgentToken = createdAgent.Token
-		payload.AgentName = createdAgent.Name
+	fd.state.setFluentBitVersion(buildInfo.FluentBit.Version)
 
-		buff := &bytes.Buffer{}
-		err = gob.NewEncoder(buff).Encode(payload)
-		if err != nil {
-			return fmt.Errorf("could not encode store payload: %w", err)
-		}
+	payload, err := fd.register(ctx, settings, buildInfo)
+	if err != nil {
+		return err
+	}
 
-		err = fd.Store.Write(fd.MachineID, buff.Bytes())
-		if err != nil {
-			return fmt.Errorf("could not write to store: %w", err)
-		}
+	fd.state.setRegistered(payload, fd.now())
+	// The cloud client could have been reloaded while registering.
+	if payload.AgentToken != "" {
+		fd.settings().cloudClient.SetAgentToken(payload.AgentToken)
 	}
+	fd.emit(Event{Kind: EventRegistered, AgentID: payload.AgentID, AgentName: payload.AgentName})
 
-	_ = fd.Logger.Log(
+	_ = level.Debug(fd.Logger).Log(
 		"agent_id", payload.AgentID,
-		"agent_token", payload.AgentToken,
 		"agent_name", payload.AgentName,
 	)
-	fd.CloudClient.SetAgentToken(payload.AgentToken)
 
-	ticker := time.NewTicker(fd.Interval)
-	if fd.errChan == nil {
-		fd.errChan = make(chan error)
-	}
+	// Every goroutine started is done before returning.
+	var wg sync.WaitGroup
+	defer fd.sinkRunners.wg.Wait()
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fd.syncConfig(ctx, payload.AgentID)
+	}()
+
+	interval := fd.settings().interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-loop:
 	for {
 		select {
 		case <-ctx.Done():
-			break loop
+			return nil
+		case <-fd.reloaded:
+			if next := fd.settings().interval; next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
 		case <-ticker.C:
-			go func() {
-				ctx, cancel := context.WithTimeout(ctx, fd.Interval)
-				defer cancel()
-
-				metrics, err := fd.FluentBitClient.Metrics(ctx)
-				if err != nil {
-					fd.errChan <- fmt.Errorf("could not fetch fluent bit metrics: %w", err)
-					return
-				}
-
-				storageMetrics, err := fd.FluentBitClient.StorageMetrics(ctx)
-				if err != nil {
-					fd.errChan <- fmt.Errorf("could not fetch fluent bit storage metrics: %w", err)
-				}
-
-				msgPackEncoded, err := fd.fluentBitMetricsToCMetrics(&metrics, &storageMetrics)
-				if err != nil {
-					fd.errChan <- fmt.Errorf("could not transform fluentbit metrics into cmetrics msgpack")
-				}
-
-				_, err = fd.CloudClient.AddAgentMetrics(ctx, payload.AgentID, msgPackEncoded)
-				if err != nil {
-					fd.errChan <- fmt.Errorf("could not push metric to cloud: %w", err)
-				}
-			}()
+			// Collected one at a time, so snapshots are processed in order.
+			fd.collectAndPush(ctx, payload.AgentID)
 		}
 	}
-
-	return nil
 }
 
-func (fd *Forwarder) fluentBitMetricsToCMetrics(metrics *fluentbit.Metrics, storageMetrics *fluentbit.StorageMetrics) ([]byte, error) {
-	if fd.nowFunc == nil {
-		fd.nowFunc = time.Now
-	}
+// collectAndPush fetches Fluent Bit metrics and dispatches the snapshot
+// to every sink. Failures are reported as events.
+func (fd *Forwarder) collectAndPush(ctx context.Context, agentID string) {
+	settings := fd.settings()
 
-	ts := fd.nowFunc()
-
-	metricsContext, err := cmetrics.NewContext()
-	if err != nil {
-		return nil, err
-	}
-
-	defer metricsContext.Destroy()
-
-	// Storage metrics
-	//TotalChunks  uint64 `json:"total_chunks"`
-	//MemChunks    uint64 `json:"mem_chunks"`
-	//FsChunks     uint64 `json:"fs_chunks"`
-	//FsChunksUp   uint64 `json:"fs_chunks_up"`
-	//FsChunksDown uint64 `json:"fs_chunks_down"`
-
-	counter, err := metricsContext.CounterCreate("fluentbit", "storage", "total_chunks", "total_chunks", []string{"plugin"})
-	if err != nil {
-		return nil, err
-	}
-	err = counter.Set(ts, float64(storageMetrics.StorageLayer.Chunks.TotalChunks), []string{"chunks"})
-	if err != nil {
-		return nil, err
-	}
-
-	counter, err = metricsContext.CounterCreate("fluentbit", "storage", "mem_chunks", "mem_chunks", []string{"plugin"})
-	if err != nil {
-		return nil, err
-	}
-	err = counter.Set(ts, float64(storageMetrics.StorageLayer.Chunks.MemChunks), []string{"chunks"})
-	if err != nil {
-		return nil, err
+	sinks := []Sink{&cloudSink{fd: fd, agentID: agentID}}
+	for _, sink := range settings.sinks {
+		// Payload sinks get what the cloud sink sends instead.
+		if _, ok := sink.(PayloadSink); !ok {
+			sinks = append(sinks, sink)
+		}
 	}
 
-	counter, err = metricsContext.CounterCreate("fluentbit", "storage", "fs_chunks", "fs_chunks", []string{"plugin"})
-	if err != nil {
-		return nil, err
-	}
-	err = counter.Set(ts, float64(storageMetrics.StorageLayer.Chunks.FsChunks), []string{"chunks"})
-	if err != nil {
-		return nil, err
-	}
+	fetchCtx, cancel := context.WithTimeout(ctx, settings.interval)
+	defer cancel()
 
-	counter, err = metricsContext.CounterCreate("fluentbit", "storage", "fs_chunks_up", "fs_chunks_up", []string{"plugin"})
-	if err != nil {
-		return nil, err
-	}
-	err = counter.Set(ts, float64(storageMetrics.StorageLayer.Chunks.FsChunksUp), []string{"chunks"})
+	metrics, err := settings.fluentBitClient.Metrics(fetchCtx)
 	if err != nil {
-		return nil, err
+		fd.selfMetrics.observeFetchErr(fetchEndpointMetrics)
+		fd.fluentBitUnreachable(StageFetchMetrics, fmt.Errorf("could not fetch fluent bit metrics: %w", err))
+		return
 	}
 
-	counter, err = metricsContext.CounterCreate("fluentbit", "storage", "fs_chunks_down", "fs_chunks_down", []string{"plugin"})
+	storageMetrics, err := settings.fluentBitClient.StorageMetrics(fetchCtx)
 	if err != nil {
-		return nil, err
-	}
-	err = counter.Set(ts, float64(storageMetrics.StorageLayer.Chunks.FsChunksDown), []string{"chunks"})
-	if err != nil {
-		return nil, err
+		fd.selfMetrics.observeFetchErr(fetchEndpointStorage)
+		fd.fluentBitUnreachable(StageFetchStorageMetrics, fmt.Errorf("could not fetch fluent bit storage metrics: %w", err))
+		return
 	}
 
-	for pluginName, metric := range storageMetrics.InputChunks {
-		counter, err := metricsContext.CounterCreate("fluentbit", "storage", "total", "total", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.Chunks.Total), []string{pluginName})
-		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "storage", "up", "up", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.Chunks.Up), []string{pluginName})
+	// The uptime is only needed to detect restarts,
+	// which can still be detected from the counters without it.
+	var upTime *uint64
+	if c, ok := settings.fluentBitClient.(UpTimeClient); ok && settings.counterResets != "" && settings.counterResets != CounterResetsNone {
+		u, err := c.UpTime(fetchCtx)
 		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "storage", "down", "down", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.Chunks.Down), []string{pluginName})
-		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "storage", "busy", "busy", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.Chunks.Busy), []string{pluginName})
-		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "storage", "busy_size", "busy_size", []string{"plugin"})
-		if err != nil {
-			return nil, err
+			fd.selfMetrics.observeFetchErr(fetchEndpointUpTime)
+			_ = level.Warn(fd.Logger).Log("msg", "could not fetch fluent bit uptime", "err", err)
+		} else {
+			upTime = &u.UpTimeSec
 		}
 	}
 
-	for metricName, metric := range metrics.Input {
-		counter, err := metricsContext.CounterCreate("fluentbit", "input", "records", "records", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.Records), []string{metricName})
-		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "input", "bytes", "bytes", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.Bytes), []string{metricName})
-		if err != nil {
-			return nil, err
-		}
+	if fd.state.setFluentBitReachable(true) {
+		fd.emit(Event{Kind: EventFluentBitRecovered})
 	}
 
-	for metricName, metric := range metrics.Output {
-		counter, err := metricsContext.CounterCreate("fluentbit", "output", "proc_records", "proc_records", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.ProcRecords), []string{metricName})
-		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "output", "proc_bytes", "proc_bytes", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.ProcBytes), []string{metricName})
-		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "output", "errors", "errors", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.Errors), []string{metricName})
-		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "output", "retries", "retries", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.Retries), []string{metricName})
-		if err != nil {
-			return nil, err
-		}
-		counter, err = metricsContext.CounterCreate("fluentbit", "output", "retries_failed", "retries_failed", []string{"plugin"})
-		if err != nil {
-			return nil, err
-		}
-		err = counter.Set(ts, float64(metric.RetriesFailed), []string{metricName})
-		if err != nil {
-			return nil, err
-		}
+	snapshot, restarted := fd.trackCounters(settings, fd.snapshot(settings, &metrics, &storageMetrics), upTime)
+	snapshot = fd.deriveCounters(settings, snapshot, restarted)
+	snapshot = fd.evaluateAlerts(settings, snapshot)
+	fd.dispatch(ctx, settings, sinks, snapshot)
+}
+
+func (fd *Forwarder) fluentBitUnreachable(stage Stage, err error) {
+	fd.state.setFluentBitReachable(false)
+	fd.emit(Event{Kind: EventFluentBitUnreachable, Stage: stage, Err: err})
+}
+
+func (fd *Forwarder) now() time.Time {
+	if fd.nowFunc == nil {
+		return time.Now()
 	}
 
-	return metricsContext.EncodeMsgPack()
+	return fd.nowFunc()
 }
@@ -2,14 +2,38 @@ package forwarder
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	cmetrics "github.com/calyptia/cmetrics-go"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud/cloudtest"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/fluentbittest"
 	fluentbit "github.com/calyptia/go-fluent-bit-metrics"
+	"github.com/go-kit/log"
 )
 
-func Test_fluentBitMetricsToCMetrics(t *testing.T) {
+var (
+	_ CloudClient          = (*cloud.Client)(nil)
+	_ AgentFetcher         = (*cloud.Client)(nil)
+	_ AgentDeleter         = (*cloud.Client)(nil)
+	_ AgentAdopter         = (*cloud.Client)(nil)
+	_ DesiredConfigFetcher = (*cloud.Client)(nil)
+	_ FluentBitClient      = (*fluentbit.Client)(nil)
+	_ UpTimeClient         = (*fluentbit.Client)(nil)
+)
+
+func TestEncodeCMetrics(t *testing.T) {
 	now := time.Now().Truncate(time.Nanosecond)
 	tt := []struct {
 		name           string
@@ -65,7 +89,7 @@ func Test_fluentBitMetricsToCMetrics(t *testing.T) {
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 			fd := &Forwarder{nowFunc: func() time.Time { return now }}
-			got, err := fd.fluentBitMetricsToCMetrics(&tc.metrics, &tc.storageMetrics)
+			got, err := EncodeCMetrics(fd.snapshot(fd.settings(), &tc.metrics, &tc.storageMetrics))
 			if err != nil {
 				t.Error(err)
 				return
@@ -84,8 +108,1504 @@ func Test_fluentBitMetricsToCMetrics(t *testing.T) {
 			}
 
 			if !bytes.Equal(want, got) {
-				t.Errorf("fluentBitMetricsToCMetrics() = %v, want %v", got, want)
+				t.Errorf("EncodeCMetrics() = %v, want %v", got, want)
+			}
+
+			// Storage metrics keep the counter type Cloud expects.
+			prom, err := ctx.EncodePrometheus()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if !strings.Contains(prom, "# TYPE fluentbit_storage_total counter") {
+				t.Errorf("want storage metrics as counters; got:\n%s", prom)
+			}
+
+			// Series only for local sinks are left out.
+			if strings.Contains(prom, "fluentbit_storage_overlimit") {
+				t.Errorf("want no storage overlimit; got:\n%s", prom)
+			}
+		})
+	}
+}
+
+func TestForwarder_Forward(t *testing.T) {
+	fluentBit := fluentbittest.NewServer()
+	defer fluentBit.Close()
+
+	fluentBit.SetInput("dummy.0", fluentbit.MetricInput{})
+	fluentBit.SetOutput("stdout.0", fluentbit.MetricOutput{})
+	fluentBit.SetStep(fluentbittest.Step{
+		Input: map[string]fluentbit.MetricInput{
+			"dummy.0": {Records: 10, Bytes: 100},
+		},
+		Output: map[string]fluentbit.MetricOutput{
+			"stdout.0": {ProcRecords: 10, ProcBytes: 100},
+		},
+	})
+
+	fakeCloud := cloudtest.NewServer("project-token")
+	defer fakeCloud.Close()
+
+	store := newMemStore()
+	fd := &Forwarder{
+		Hostname:  "test",
+		MachineID: "machine-id",
+		RawConfig: "[INPUT]\n    name dummy\n",
+		Store:     store,
+		// The fluent bit client waits 150ms before the first request.
+		Interval: time.Millisecond * 400,
+		FluentBitClient: &fluentbit.Client{
+			HTTPClient: fluentBit.Client(),
+			BaseURL:    fluentBit.URL,
+		},
+		CloudClient: &cloud.Client{
+			HTTPClient:   fakeCloud.Client(),
+			BaseURL:      fakeCloud.URL,
+			ProjectToken: "project-token",
+			Compression:  cloud.CompressionZstd,
+		},
+		Logger:             log.NewNopLogger(),
+		IncludeSelfMetrics: true,
+	}
+
+	if code := serve(fd.Handler(), "/readyz").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("readyz before registering = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// A subscriber that never reads must not block forwarding.
+	_, unsubscribe := fd.Subscribe(1)
+	defer unsubscribe()
+
+	events, unsubscribe := fd.Subscribe(0)
+	defer unsubscribe()
+
+	gotEvents := make(chan []EventKind, 1)
+	go func() {
+		var kinds []EventKind
+		for ev := range events {
+			if ev.Err != nil && ctx.Err() == nil {
+				t.Errorf("unexpected event %s error: %v", ev.Kind, ev.Err)
+			}
+			kinds = append(kinds, ev.Kind)
+		}
+		gotEvents <- kinds
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fd.Forward(ctx)
+	}()
+
+	for len(fakeCloud.Metrics()) < 2 {
+		select {
+		case err := <-done:
+			t.Fatalf("forward returned early: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("got %d metrics pushes, want at least 2", len(fakeCloud.Metrics()))
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+
+	unsubscribe()
+	kinds := <-gotEvents
+	if len(kinds) < 3 || kinds[0] != EventRegistered || kinds[1] != EventPushSucceeded {
+		t.Errorf("unexpected events %v", kinds)
+	}
+
+	agents := fakeCloud.Agents()
+	if len(agents) != 1 {
+		t.Fatalf("got %d agents, want 1", len(agents))
+	}
+
+	if agents[0].MachineID != "machine-id" || agents[0].Version != "1.8.0" || agents[0].RawConfig != fd.RawConfig {
+		t.Errorf("unexpected agent %+v", agents[0])
+	}
+
+	metrics := fakeCloud.Metrics()
+	if !strings.Contains(metrics[0].Text, `fluentbit_input_records{plugin="dummy.0"}`) {
+		t.Errorf("missing input records on %q", metrics[0].Text)
+	}
+
+	if metrics[0].Text == metrics[len(metrics)-1].Text {
+		t.Error("expected counters to advance between pushes")
+	}
+
+	if !strings.Contains(metrics[len(metrics)-1].Text, `forwarder_push_total{sink="cloud",result="success"} = 1`) {
+		t.Errorf("missing self metrics on %q", metrics[len(metrics)-1].Text)
+	}
+
+	if code := serve(fd.Handler(), "/readyz").Code; code != http.StatusOK {
+		t.Errorf("readyz = %d, want %d", code, http.StatusOK)
+	}
+
+	var status Status
+	err := json.NewDecoder(serve(fd.Handler(), "/status").Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !status.Registered || status.AgentID != agents[0].ID || status.FluentBitVersion != "1.8.0" || status.LastPushAt == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	if body := serve(fd.Handler(), "/metrics").Body.String(); !strings.Contains(body, `forwarder_push_total{sink="cloud",result="success"}`) || strings.Contains(body, `forwarder_push_total{sink="cloud",result="success"} 0`) {
+		t.Errorf("missing successful pushes on self metrics %q", body)
+	}
+}
+
+func TestForwarder_Reload(t *testing.T) {
+	fluentBit := fluentbittest.NewServer()
+	defer fluentBit.Close()
+
+	fakeCloud := cloudtest.NewServer("project-token")
+	defer fakeCloud.Close()
+
+	// Cloud is down, so payloads get buffered.
+	fakeCloud.InjectFailure(cloudtest.Failure{
+		Method:     http.MethodPost,
+		Path:       "/v1/agents/*/metrics",
+		StatusCode: http.StatusServiceUnavailable,
+	})
+
+	newForwarder := func(hostname string) *Forwarder {
+		return &Forwarder{
+			Hostname:  hostname,
+			MachineID: "machine-id",
+			Store:     newMemStore(),
+			Interval:  time.Millisecond * 400,
+			FluentBitClient: &fluentbit.Client{
+				HTTPClient: fluentBit.Client(),
+				BaseURL:    fluentBit.URL,
+			},
+			CloudClient: &cloud.Client{
+				HTTPClient:   fakeCloud.Client(),
+				BaseURL:      fakeCloud.URL,
+				ProjectToken: "project-token",
+			},
+			Logger:     log.NewNopLogger(),
+			BufferSize: 10,
+		}
+	}
+
+	fd := newForwarder("before")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	events, unsubscribe := fd.Subscribe(0)
+	defer unsubscribe()
+
+	configUpdates := make(chan int, 1)
+	go func() {
+		var n int
+		for ev := range events {
+			if ev.Kind == EventConfigUpdated {
+				n++
+			}
+		}
+		configUpdates <- n
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fd.Forward(ctx)
+	}()
+
+	waitFor := func(desc string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case err := <-done:
+				t.Fatalf("forward returned early: %v", err)
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s", desc)
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
+
+	waitFor("buffered payloads", func() bool {
+		size, _ := fd.bufferStats()
+		return size >= 2
+	})
+
+	err := fd.Reload(ctx, newForwarder("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeCloud.ClearFailures()
+
+	waitFor("buffer flush", func() bool {
+		size, _ := fd.bufferStats()
+		return size == 0 && len(fakeCloud.Metrics()) >= 3
+	})
+
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+
+	agents := fakeCloud.Agents()
+	if len(agents) != 1 {
+		t.Fatalf("got %d agents, want 1", len(agents))
+	}
+
+	if agents[0].Name != "after" {
+		t.Errorf("agent name = %q, want %q", agents[0].Name, "after")
+	}
+
+	// Only the reload changing the hostname updates the config,
+	// not registering on start.
+	unsubscribe()
+	if n := <-configUpdates; n != 1 {
+		t.Errorf("got %d config updated events, want 1", n)
+	}
+}
+
+func TestForwarder_Forward_sinks(t *testing.T) {
+	fluentBit := fluentbittest.NewServer()
+	defer fluentBit.Close()
+
+	fluentBit.SetInput("dummy.0", fluentbit.MetricInput{Records: 10})
+
+	fakeCloud := cloudtest.NewServer("project-token")
+	defer fakeCloud.Close()
+
+	slow := &testSink{name: "slow", block: make(chan struct{})}
+	defer close(slow.block)
+
+	fast := &testSink{name: "fast"}
+
+	fd := &Forwarder{
+		Hostname:  "test",
+		MachineID: "machine-id",
+		Store:     newMemStore(),
+		Interval:  time.Millisecond * 400,
+		FluentBitClient: &fluentbit.Client{
+			HTTPClient: fluentBit.Client(),
+			BaseURL:    fluentBit.URL,
+		},
+		CloudClient: &cloud.Client{
+			HTTPClient:   fakeCloud.Client(),
+			BaseURL:      fakeCloud.URL,
+			ProjectToken: "project-token",
+		},
+		Logger:     log.NewNopLogger(),
+		BufferSize: 10,
+		Sinks:      []Sink{slow, fast},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fd.Forward(ctx)
+	}()
+
+	// Pushes to the slow sink only end once they time out,
+	// getting its snapshots buffered, yet the others keep getting them.
+	// The buffer is checked along since it is briefly empty
+	// while its only snapshot is being pushed again.
+	buffered := func() bool {
+		size, _ := fd.bufferStats()
+		return size != 0
+	}
+	for len(fast.snapshots()) < 3 || len(fakeCloud.Metrics()) < 3 || !buffered() {
+		select {
+		case err := <-done:
+			t.Fatalf("forward returned early: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("got %d snapshots, %d cloud pushes and buffered %v, want at least 3 and buffered snapshots for the slow sink", len(fast.snapshots()), len(fakeCloud.Metrics()), buffered())
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	snapshot := fast.snapshots()[0]
+	if snapshot.AgentID == "" || snapshot.MachineID != "machine-id" || snapshot.FluentBitVersion != "1.8.0" {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	var found bool
+	for _, m := range snapshot.Metrics {
+		if m.FullName() == "fluentbit_input_records" && len(m.Samples) == 1 && m.Samples[0].Value == 10 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("missing input records on %+v", snapshot.Metrics)
+	}
+
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+
+	fd.Sinks = []Sink{fast, &testSink{name: "fast"}}
+	if err := fd.Forward(context.Background()); err == nil || !strings.Contains(err.Error(), "duplicated sink name") {
+		t.Errorf("want duplicated sink name error; got %v", err)
+	}
+}
+
+func TestForwarder_Forward_payloadSinks(t *testing.T) {
+	fluentBit := fluentbittest.NewServer()
+	defer fluentBit.Close()
+
+	fakeCloud := cloudtest.NewServer("project-token")
+	defer fakeCloud.Close()
+
+	// The first payload is rejected by Cloud, so it is not archived.
+	fakeCloud.InjectFailure(cloudtest.Failure{
+		Method:     http.MethodPost,
+		Path:       "/v1/agents/*/metrics",
+		StatusCode: http.StatusBadRequest,
+		Times:      1,
+	})
+
+	archive := &testPayloadSink{testSink: testSink{name: "archive"}}
+	fd := &Forwarder{
+		Hostname:  "test",
+		MachineID: "machine-id",
+		Store:     newMemStore(),
+		Interval:  time.Millisecond * 400,
+		FluentBitClient: &fluentbit.Client{
+			HTTPClient: fluentBit.Client(),
+			BaseURL:    fluentBit.URL,
+		},
+		CloudClient: &cloud.Client{
+			HTTPClient:   fakeCloud.Client(),
+			BaseURL:      fakeCloud.URL,
+			ProjectToken: "project-token",
+		},
+		Logger: log.NewNopLogger(),
+		Sinks:  []Sink{archive},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fd.Forward(ctx)
+	}()
+
+	for len(archive.payloads()) < 2 {
+		select {
+		case err := <-done:
+			t.Fatalf("forward returned early: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("got %d archived payloads, want at least 2", len(archive.payloads()))
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+
+	if n := len(archive.snapshots()); n != 0 {
+		t.Errorf("got %d snapshots pushed to the payload sink, want 0", n)
+	}
+
+	metrics := fakeCloud.Metrics()
+	payloads := archive.payloads()
+	if len(payloads) > len(metrics) {
+		t.Fatalf("got %d archived payloads for %d cloud pushes", len(payloads), len(metrics))
+	}
+
+	for i, payload := range payloads {
+		if !bytes.Equal(payload, metrics[i].MsgPack) {
+			t.Errorf("archived payload %d differs from the one sent to cloud", i)
+		}
+	}
+}
+
+func TestForwarder_pushWithRetry_failing(t *testing.T) {
+	now := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	fd := &Forwarder{
+		Interval:           time.Second,
+		ReadyPushIntervals: 2,
+		nowFunc:            func() time.Time { return now },
+	}
+
+	events, unsubscribe := fd.Subscribe(0)
+	defer unsubscribe()
+
+	sink := &testSink{name: CloudSinkName}
+	unavailable := &SinkError{Err: errors.New("unavailable")}
+
+	// Pushes fail for 2 intervals, and then recover.
+	var got []string
+	for _, err := range []error{unavailable, unavailable, unavailable, unavailable, nil, nil} {
+		sink.mu.Lock()
+		sink.err = err
+		sink.mu.Unlock()
+
+		_ = fd.pushWithRetry(context.Background(), sink, Snapshot{Time: now})
+		now = now.Add(time.Second)
+
+		for len(events) != 0 {
+			if ev := <-events; ev.Kind == EventPushFailing || ev.Kind == EventPushRecovered {
+				got = append(got, string(ev.Kind))
+			}
+		}
+	}
+
+	if want := []string{"push_failing", "push_recovered"}; !equalStrings(want, got) {
+		t.Errorf("want events %v; got %v", want, got)
+	}
+}
+
+func TestForwarder_pushWithRetry_sinks(t *testing.T) {
+	now := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	fd := &Forwarder{Interval: time.Second, nowFunc: func() time.Time { return now }}
+
+	// Other sinks get their own self metrics, but do not count as Cloud pushes.
+	if err := fd.pushWithRetry(context.Background(), &testSink{name: "file"}, Snapshot{Time: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fd.state.lastPush(); !got.IsZero() {
+		t.Errorf("want no cloud push tracked; got last push at %v", got)
+	}
+
+	body := serve(fd.MetricsHandler(), "/metrics").Body.String()
+	for _, want := range []string{
+		`forwarder_push_total{sink="cloud",result="success"} 0`,
+		`forwarder_push_total{sink="file",result="success"} 1`,
+		`forwarder_push_duration_seconds_count{sink="file"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %s on self metrics %q", want, body)
+		}
+	}
+}
+
+func TestForwarder_push_bufferedFailing(t *testing.T) {
+	start := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	fd := &Forwarder{Interval: time.Second, BufferSize: 10, nowFunc: func() time.Time { return start }}
+
+	// The buffered snapshot keeps failing, the current one goes through.
+	var pushed []time.Time
+	sink := sinkFunc(func(ctx context.Context, snapshot Snapshot) (PushResult, error) {
+		if snapshot.Time.Equal(start) {
+			return PushResult{}, errors.New("unavailable")
+		}
+
+		pushed = append(pushed, snapshot.Time)
+		return PushResult{}, nil
+	})
+
+	r := &sinkRunner{}
+	r.buffer.push(Snapshot{Time: start}, 10)
+	fd.push(context.Background(), fd.settings(), r, sinkJob{sink: sink, snapshot: Snapshot{Time: start.Add(time.Second)}})
+
+	if want, got := 1, len(pushed); want != got {
+		t.Fatalf("want %d pushed snapshots; got %d", want, got)
+	}
+	if want, got := start.Add(time.Second), pushed[0]; !want.Equal(got) {
+		t.Errorf("want pushed snapshot at %v; got %v", want, got)
+	}
+	if size, _ := r.buffer.stats(); size != 1 {
+		t.Errorf("want failed snapshot to stay buffered; got buffer size %d", size)
+	}
+}
+
+func TestForwarder_trackCounters(t *testing.T) {
+	type step struct {
+		records float64
+		upTime  uint64
+	}
+
+	// Fluent Bit restarts twice: once noticed from the uptime,
+	// even though records went up, and once from records going down.
+	steps := []step{{records: 10, upTime: 10}, {records: 30, upTime: 20}, {records: 40, upTime: 5}, {records: 5, upTime: 3600}}
+
+	tt := []struct {
+		mode         CounterResets
+		wantRecords  []float64
+		wantRestarts []float64
+	}{
+		{mode: CounterResetsNone, wantRecords: []float64{10, 30, 40, 5}},
+		{mode: CounterResetsMarker, wantRecords: []float64{10, 30, 40, 5}, wantRestarts: []float64{0, 0, 1, 2}},
+		{mode: CounterResetsAdjust, wantRecords: []float64{10, 30, 70, 75}},
+	}
+	for _, tc := range tt {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			store := newMemStore()
+			fd := &Forwarder{MachineID: "machine-id", Store: store, Logger: log.NewNopLogger(), CounterResets: tc.mode}
+			start := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+
+			var gotRecords, gotRestarts []float64
+			for i, s := range steps {
+				records := pluginMetric(MetricCounter, "input", "records")
+				records.add(s.records, "dummy.0")
+
+				upTime := s.upTime
+				snapshot, _ := fd.trackCounters(fd.settings(), Snapshot{
+					Time:    start.Add(time.Duration(i) * time.Second * 10),
+					Metrics: []Metric{records},
+				}, &upTime)
+
+				for _, m := range snapshot.Metrics {
+					switch m.FullName() {
+					case "fluentbit_input_records":
+						gotRecords = append(gotRecords, m.Samples[0].Value)
+					case "fluentbit_restarts_total":
+						gotRestarts = append(gotRestarts, m.Samples[0].Value)
+					case "fluentbit_start_time_seconds":
+						if want, got := unixSeconds(snapshot.Time)-float64(s.upTime), m.Samples[0].Value; want != got {
+							t.Errorf("step %d: want start time %v; got %v", i, want, got)
+						}
+					}
+				}
+
+				if _, err := EncodeCMetrics(snapshot); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+			}
+
+			if want, got := tc.wantRecords, gotRecords; !equalFloats(want, got) {
+				t.Errorf("want records %v; got %v", want, got)
+			}
+
+			if want, got := tc.wantRestarts, gotRestarts; !equalFloats(want, got) {
+				t.Errorf("want restarts %v; got %v", want, got)
+			}
+
+			if tc.mode != CounterResetsAdjust {
+				return
+			}
+
+			// A new forwarder picks up the offsets from the store.
+			fd = &Forwarder{MachineID: "machine-id", Store: store, Logger: log.NewNopLogger(), CounterResets: tc.mode}
+			records := pluginMetric(MetricCounter, "input", "records")
+			records.add(6, "dummy.0")
+			snapshot, _ := fd.trackCounters(fd.settings(), Snapshot{Time: start.Add(time.Minute), Metrics: []Metric{records}}, nil)
+			if want, got := 76.0, snapshot.Metrics[0].Samples[0].Value; want != got {
+				t.Errorf("want records %v after loading from store; got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestForwarder_deriveCounters(t *testing.T) {
+	// Records go down on the third snapshot, as after a restart.
+	values := []float64{10, 30, 5}
+
+	tt := []struct {
+		series      []CounterSeries
+		wantNames   []string
+		wantDeltas  []float64
+		wantRates   []float64
+		wantRecords []float64
+	}{
+		{
+			series:      []CounterSeries{CounterSeriesCumulative},
+			wantNames:   []string{"fluentbit_input_records", "forwarder_push_total"},
+			wantRecords: []float64{10, 30, 5},
+		},
+		{
+			series:      []CounterSeries{CounterSeriesCumulative, CounterSeriesDelta},
+			wantNames:   []string{"fluentbit_input_records", "fluentbit_input_records_delta", "forwarder_push_total"},
+			wantDeltas:  []float64{20, 5},
+			wantRecords: []float64{10, 30, 5},
+		},
+		{
+			series:    []CounterSeries{CounterSeriesRate},
+			wantNames: []string{"fluentbit_input_records_per_second", "forwarder_push_total"},
+			wantRates: []float64{2, 0.5},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(fmt.Sprint(tc.series), func(t *testing.T) {
+			fd := &Forwarder{SinkCounterSeries: map[string][]CounterSeries{"test": tc.series}}
+			start := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+
+			var gotDeltas, gotRates, gotRecords []float64
+			for i, v := range values {
+				records := pluginMetric(MetricCounter, "input", "records")
+				records.add(v, "dummy.0")
+
+				// Not a plugin counter, so kept as is.
+				pushes := Metric{Namespace: "forwarder", Subsystem: "push", Name: "total", Type: MetricCounter}
+				pushes.add(float64(i))
+
+				snapshot := fd.deriveCounters(fd.settings(), Snapshot{
+					Time:    start.Add(time.Duration(i) * time.Second * 10),
+					Metrics: []Metric{records, pushes},
+				}, false)
+				snapshot = sinkCounterSeries(snapshot, tc.series)
+
+				var names []string
+				for _, m := range snapshot.Metrics {
+					if i != 0 || len(m.Samples) != 0 {
+						names = append(names, m.FullName())
+					}
+
+					for _, sample := range m.Samples {
+						switch m.FullName() {
+						case "fluentbit_input_records":
+							gotRecords = append(gotRecords, sample.Value)
+						case "fluentbit_input_records_delta":
+							gotDeltas = append(gotDeltas, sample.Value)
+						case "fluentbit_input_records_per_second":
+							gotRates = append(gotRates, sample.Value)
+						}
+					}
+				}
+
+				if want, got := tc.wantNames, names; i != 0 && !equalStrings(want, got) {
+					t.Errorf("step %d: want metrics %v; got %v", i, want, got)
+				}
+			}
+
+			if want, got := tc.wantRecords, gotRecords; !equalFloats(want, got) {
+				t.Errorf("want records %v; got %v", want, got)
+			}
+
+			if want, got := tc.wantDeltas, gotDeltas; !equalFloats(want, got) {
+				t.Errorf("want deltas %v; got %v", want, got)
+			}
+
+			if want, got := tc.wantRates, gotRates; !equalFloats(want, got) {
+				t.Errorf("want rates %v; got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestForwarder_deriveCounters_restarted(t *testing.T) {
+	// Fluent Bit restarts before the third snapshot, with its uptime going
+	// down, but records going up past the previous value anyway.
+	steps := []struct {
+		records float64
+		upTime  uint64
+	}{
+		{records: 10, upTime: 10},
+		{records: 30, upTime: 20},
+		{records: 40, upTime: 5},
+	}
+
+	for _, mode := range []CounterResets{CounterResetsMarker, CounterResetsAdjust} {
+		t.Run(string(mode), func(t *testing.T) {
+			fd := &Forwarder{
+				MachineID:         "machine-id",
+				Store:             newMemStore(),
+				Logger:            log.NewNopLogger(),
+				CounterResets:     mode,
+				SinkCounterSeries: map[string][]CounterSeries{"test": {CounterSeriesDelta}},
+			}
+			start := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+
+			var gotDeltas []float64
+			for i, s := range steps {
+				records := pluginMetric(MetricCounter, "input", "records")
+				records.add(s.records, "dummy.0")
+
+				upTime := s.upTime
+				snapshot, restarted := fd.trackCounters(fd.settings(), Snapshot{
+					Time:    start.Add(time.Duration(i) * time.Second * 10),
+					Metrics: []Metric{records},
+				}, &upTime)
+				if want, got := i == 2, restarted; want != got {
+					t.Fatalf("step %d: want restarted %v; got %v", i, want, got)
+				}
+
+				snapshot = fd.deriveCounters(fd.settings(), snapshot, restarted)
+				for _, m := range snapshot.Metrics {
+					if m.FullName() == "fluentbit_input_records_delta" {
+						for _, sample := range m.Samples {
+							gotDeltas = append(gotDeltas, sample.Value)
+						}
+					}
+				}
+			}
+
+			// Adjusted records go 10, 30, 70, and the ones not adjusted 10, 30, 40,
+			// so either way the records since the restart are 40.
+			if want, got := []float64{20, 40}, gotDeltas; !equalFloats(want, got) {
+				t.Errorf("want deltas %v; got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestForwarder_deriveCounters_prune(t *testing.T) {
+	fd := &Forwarder{SinkCounterSeries: map[string][]CounterSeries{"test": {CounterSeriesDelta}}}
+	start := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	// The "tail.0" input is gone on the second snapshot and back on the third,
+	// and the fourth is older than the third.
+	steps := []struct {
+		offset time.Duration
+		inputs map[string]float64
+	}{
+		{offset: 0, inputs: map[string]float64{"dummy.0": 10, "tail.0": 10}},
+		{offset: time.Second * 10, inputs: map[string]float64{"dummy.0": 20}},
+		{offset: time.Second * 20, inputs: map[string]float64{"dummy.0": 30, "tail.0": 50}},
+		{offset: time.Second * 15, inputs: map[string]float64{"dummy.0": 25, "tail.0": 40}},
+	}
+
+	var got []string
+	for _, step := range steps {
+		records := pluginMetric(MetricCounter, "input", "records")
+		for _, name := range []string{"dummy.0", "tail.0"} {
+			if v, ok := step.inputs[name]; ok {
+				records.add(v, name)
+			}
+		}
+
+		snapshot := fd.deriveCounters(fd.settings(), Snapshot{Time: start.Add(step.offset), Metrics: []Metric{records}}, false)
+		for _, m := range snapshot.Metrics {
+			if m.FullName() != "fluentbit_input_records_delta" {
+				continue
+			}
+
+			for _, sample := range m.Samples {
+				got = append(got, fmt.Sprintf("%s=%v", sample.LabelValues[0], sample.Value))
+			}
+		}
+	}
+
+	// tail.0 starts over once back, and the older snapshot gets no deltas.
+	if want := []string{"dummy.0=10", "dummy.0=10"}; !equalStrings(want, got) {
+		t.Errorf("want deltas %v; got %v", want, got)
+	}
+}
+
+func TestSinkCounterSeries(t *testing.T) {
+	records := pluginMetric(MetricCounter, "input", "records")
+	deltas := derivedMetric(records, "_delta", " per interval")
+	rates := derivedMetric(records, "_per_second", " per second")
+	chunks := Metric{Namespace: "fluentbit", Subsystem: "storage", Name: "chunks", Type: MetricGauge}
+	snapshot := Snapshot{Metrics: []Metric{records, deltas, rates, chunks}}
+
+	tt := []struct {
+		series    []CounterSeries
+		wantNames []string
+	}{
+		{
+			wantNames: []string{"fluentbit_input_records", "fluentbit_storage_chunks"},
+		},
+		{
+			series:    []CounterSeries{CounterSeriesDelta, CounterSeriesRate},
+			wantNames: []string{"fluentbit_input_records_delta", "fluentbit_input_records_per_second", "fluentbit_storage_chunks"},
+		},
+		{
+			series:    []CounterSeries{CounterSeriesCumulative, CounterSeriesDelta, CounterSeriesRate},
+			wantNames: []string{"fluentbit_input_records", "fluentbit_input_records_delta", "fluentbit_input_records_per_second", "fluentbit_storage_chunks"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(fmt.Sprint(tc.series), func(t *testing.T) {
+			var names []string
+			for _, m := range sinkCounterSeries(snapshot, tc.series).Metrics {
+				names = append(names, m.FullName())
+			}
+
+			if want, got := tc.wantNames, names; !equalStrings(want, got) {
+				t.Errorf("want metrics %v; got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestForwarder_evaluateAlerts(t *testing.T) {
+	fd := &Forwarder{AlertRules: []AlertRule{
+		{
+			Name:   "retries_failed",
+			Metric: "fluentbit_output_retries_failed",
+			Op:     AlertOpIncrease,
+			For:    time.Second * 5,
+		},
+		{
+			Name:      "chunks_down",
+			Metric:    "fluentbit_storage_fs_chunks_down",
+			Op:        AlertOpGreater,
+			Threshold: 5,
+		},
+	}}
+
+	events, unsubscribe := fd.Subscribe(0)
+	defer unsubscribe()
+
+	start := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		retriesFailed float64
+		chunksDown    float64
+		wantEvents    []string
+		wantFiring    []float64
+	}{
+		{retriesFailed: 0, chunksDown: 10, wantEvents: []string{"alert_firing chunks_down"}, wantFiring: []float64{0, 1}},
+		// Pending for 5s, on snapshots 5s apart.
+		{retriesFailed: 2, chunksDown: 10, wantFiring: []float64{0, 1}},
+		{retriesFailed: 4, chunksDown: 1, wantEvents: []string{"alert_resolved chunks_down", "alert_firing retries_failed"}, wantFiring: []float64{1, 0}},
+		{retriesFailed: 4, chunksDown: 1, wantEvents: []string{"alert_resolved retries_failed"}, wantFiring: []float64{0, 0}},
+	}
+	for i, step := range steps {
+		retriesFailed := pluginMetric(MetricCounter, "output", "retries_failed")
+		retriesFailed.add(step.retriesFailed, "es.0")
+
+		chunksDown := pluginMetric(MetricGauge, "storage", "fs_chunks_down")
+		chunksDown.add(step.chunksDown, "chunks")
+
+		snapshot := fd.evaluateAlerts(fd.settings(), Snapshot{
+			Time:    start.Add(time.Duration(i) * time.Second * 5),
+			Metrics: []Metric{retriesFailed, chunksDown},
+		})
+
+		var gotEvents []string
+		for len(events) != 0 {
+			ev := <-events
+			gotEvents = append(gotEvents, string(ev.Kind)+" "+ev.Alert.Rule)
+		}
+
+		if want, got := step.wantEvents, gotEvents; !equalStrings(want, got) {
+			t.Errorf("step %d: want events %v; got %v", i, want, got)
+		}
+
+		var gotFiring []float64
+		for _, m := range snapshot.Metrics {
+			if m.FullName() == "forwarder_alerts_firing" {
+				for _, sample := range m.Samples {
+					gotFiring = append(gotFiring, sample.Value)
+				}
+			}
+		}
+
+		if want, got := step.wantFiring, gotFiring; !equalFloats(want, got) {
+			t.Errorf("step %d: want firing %v; got %v", i, want, got)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestForwarder_Register(t *testing.T) {
+	fluentBit := fluentbittest.NewServer()
+	defer fluentBit.Close()
+
+	fakeCloud := cloudtest.NewServer("project-token")
+	defer fakeCloud.Close()
+
+	fd := &Forwarder{
+		Hostname:  "test",
+		MachineID: "machine-id",
+		Store:     newMemStore(),
+		Interval:  time.Second,
+		FluentBitClient: &fluentbit.Client{
+			HTTPClient: fluentBit.Client(),
+			BaseURL:    fluentBit.URL,
+		},
+		CloudClient: &cloud.Client{
+			HTTPClient:   fakeCloud.Client(),
+			BaseURL:      fakeCloud.URL,
+			ProjectToken: "project-token",
+		},
+		Logger: log.NewNopLogger(),
+	}
+
+	ctx := context.Background()
+	_, err := fd.VerifyAgent(ctx)
+	if !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("verify before registering = %v, want %v", err, ErrNotRegistered)
+	}
+
+	registered, err := fd.Register(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agents := fakeCloud.Agents()
+	if len(agents) != 1 || agents[0].ID != registered.AgentID || agents[0].Version != "1.8.0" {
+		t.Fatalf("unexpected agents %+v", agents)
+	}
+
+	verified, err := fd.VerifyAgent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified != registered {
+		t.Errorf("verified agent %+v, want %+v", verified, registered)
+	}
+
+	err = fd.Store.Write(fd.countersStoreKey(), []byte(`{"Restarts":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd.storeConfigSyncState(configSyncState{Version: "1"})
+
+	_, err = fd.Unregister(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agents := fakeCloud.Agents(); len(agents) != 0 {
+		t.Errorf("got %d agents after unregistering, want 0", len(agents))
+	}
+
+	if fd.Store.Has(fd.countersStoreKey()) {
+		t.Error("counters kept after unregistering")
+	}
+
+	if fd.Store.Has(fd.configStoreKey()) {
+		t.Error("config sync state kept after unregistering")
+	}
+
+	_, err = fd.VerifyAgent(ctx)
+	if !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("verify after unregistering = %v, want %v", err, ErrNotRegistered)
+	}
+
+	// A stored agent deleted from Cloud is an error
+	// and its credentials are kept.
+	err = fd.storeAgent(registered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fd.Register(ctx)
+	if !errors.Is(err, cloud.ErrNotFound) {
+		t.Errorf("register with deleted agent = %v, want %v", err, cloud.ErrNotFound)
+	}
+
+	if !fd.Store.Has(fd.MachineID) {
+		t.Error("stored agent erased")
+	}
+}
+
+func TestForwarder_Register_adopt(t *testing.T) {
+	fluentBit := fluentbittest.NewServer()
+	defer fluentBit.Close()
+
+	fakeCloud := cloudtest.NewServer("project-token")
+	defer fakeCloud.Close()
+
+	// Each forwarder starts with an empty store, as if it was lost.
+	newForwarder := func(forceRegister bool) *Forwarder {
+		return &Forwarder{
+			Hostname:      "test",
+			MachineID:     "machine-id",
+			ForceRegister: forceRegister,
+			Store:         newMemStore(),
+			Interval:      time.Second,
+			FluentBitClient: &fluentbit.Client{
+				HTTPClient: fluentBit.Client(),
+				BaseURL:    fluentBit.URL,
+			},
+			CloudClient: &cloud.Client{
+				HTTPClient:   fakeCloud.Client(),
+				BaseURL:      fakeCloud.URL,
+				ProjectToken: "project-token",
+			},
+			Logger: log.NewNopLogger(),
+		}
+	}
+
+	ctx := context.Background()
+	first, err := newForwarder(false).Register(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd := newForwarder(false)
+	adopted, err := fd.Register(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if adopted.AgentID != first.AgentID || adopted.AgentToken == first.AgentToken {
+		t.Errorf("adopted agent %+v, want %q with a rotated token", adopted, first.AgentID)
+	}
+
+	if _, err := fd.VerifyAgent(ctx); err != nil {
+		t.Errorf("adopted agent token not stored: %v", err)
+	}
+
+	if agents := fakeCloud.Agents(); len(agents) != 1 {
+		t.Fatalf("got %d agents, want 1", len(agents))
+	}
+
+	// Listing agents fails, as with a project token lacking permissions.
+	fakeCloud.InjectFailure(cloudtest.Failure{
+		Method:     http.MethodGet,
+		Path:       "/v1/agents",
+		StatusCode: http.StatusUnauthorized,
+		Times:      1,
+	})
+	if _, err := newForwarder(false).Register(ctx); !errors.Is(err, cloud.ErrUnauthorized) {
+		t.Errorf("want list agents error %v; got %v", cloud.ErrUnauthorized, err)
+	}
+
+	if agents := fakeCloud.Agents(); len(agents) != 1 {
+		t.Fatalf("got %d agents after failing to list them, want 1", len(agents))
+	}
+
+	forced, err := newForwarder(true).Register(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if forced.AgentID == first.AgentID {
+		t.Error("expected a new agent when forcing registration")
+	}
+
+	if agents := fakeCloud.Agents(); len(agents) != 2 {
+		t.Errorf("got %d agents, want 2", len(agents))
+	}
+}
+
+func TestForwarder_syncConfig(t *testing.T) {
+	configHealthCheckInterval = time.Millisecond * 10
+
+	fluentBit := fluentbittest.NewServer()
+	defer fluentBit.Close()
+
+	fakeCloud := cloudtest.NewServer("project-token")
+	defer fakeCloud.Close()
+
+	path := filepath.Join(t.TempDir(), "fluent-bit.conf")
+	err := os.WriteFile(path, []byte("[INPUT]\n    Name cpu\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newMemStore()
+	newForwarder := func() *Forwarder {
+		return &Forwarder{
+			Hostname:  "test",
+			MachineID: "machine-id",
+			Store:     store,
+			Interval:  time.Second,
+			FluentBitClient: &fluentbit.Client{
+				HTTPClient: fluentBit.Client(),
+				BaseURL:    fluentBit.URL,
+			},
+			CloudClient: &cloud.Client{
+				HTTPClient:   fakeCloud.Client(),
+				BaseURL:      fakeCloud.URL,
+				ProjectToken: "project-token",
+			},
+			Logger: log.NewNopLogger(),
+			ConfigSync: &ConfigSync{
+				Path: path,
+				Reloader: &HTTPReloader{
+					BaseURL:    fluentBit.URL,
+					HTTPClient: fluentBit.Client(),
+				},
+				Interval:      time.Millisecond * 50,
+				Wait:          time.Second,
+				HealthTimeout: time.Second,
+			},
+		}
+	}
+
+	fd := newForwarder()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fd.Forward(ctx)
+	}()
+
+	waitFor := func(desc string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case err := <-done:
+				t.Fatalf("forward returned early: %v", err)
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s", desc)
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
+
+	waitForStatus := func(version string) cloud.AgentConfigStatus {
+		t.Helper()
+		var status cloud.AgentConfigStatus
+		waitFor("config status of version "+version, func() bool {
+			agents := fakeCloud.Agents()
+			if len(agents) != 1 || agents[0].ConfigStatus == nil {
+				return false
 			}
+
+			status = *agents[0].ConfigStatus
+			return status.Version == version
 		})
+		return status
+	}
+
+	waitFor("registration", func() bool {
+		return fd.Status().Registered
+	})
+
+	agentID := fd.Status().AgentID
+
+	readFile := func(name string) string {
+		t.Helper()
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	good := "[INPUT]\n    Name mem\n"
+	version, err := fakeCloud.SetDesiredConfig(agentID, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := waitForStatus(version)
+	if want, got := cloud.AgentConfigStateApplied, status.State; want != got {
+		t.Fatalf("want state %q; got %q: %s", want, got, status.Error)
+	}
+
+	if want, got := good, readFile(path); want != got {
+		t.Errorf("want config %q; got %q", want, got)
+	}
+
+	if want, got := "[INPUT]\n    Name cpu\n", readFile(path+".bak"); want != got {
+		t.Errorf("want backup %q; got %q", want, got)
+	}
+
+	if want, got := good, fakeCloud.Agents()[0].RawConfig; want != got {
+		t.Errorf("want agent raw config %q; got %q", want, got)
+	}
+
+	// Fluent Bit goes down with the next config until reloaded again.
+	var reloads int
+	fluentBit.OnReload(func() {
+		reloads++
+		if reloads == 1 {
+			fluentBit.InjectFailure(fluentbittest.Failure{Path: "/api/v1/*", StatusCode: http.StatusInternalServerError})
+			return
+		}
+
+		fluentBit.ClearFailures()
+	})
+
+	version, err = fakeCloud.SetDesiredConfig(agentID, "[INPUT]\n    Name bad\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = waitForStatus(version)
+	if want, got := cloud.AgentConfigStateRolledBack, status.State; want != got {
+		t.Fatalf("want state %q; got %q", want, got)
+	}
+
+	if want, got := good, readFile(path); want != got {
+		t.Errorf("want rolled back config %q; got %q", want, got)
+	}
+
+	if want, got := 3, fluentBit.Reloads(); want != got {
+		t.Errorf("want %d reloads; got %d", want, got)
+	}
+
+	// Fluent Bit ignores the next reload, so metrics keep being fetched
+	// but the reload is never confirmed.
+	fluentBit.OnReload(nil)
+	fluentBit.InjectFailure(fluentbittest.Failure{
+		Method:     http.MethodPost,
+		Path:       "/api/v2/reload",
+		StatusCode: http.StatusOK,
+		Body:       `{"reload":"done","status":0}`,
+		Times:      1,
+	})
+
+	version, err = fakeCloud.SetDesiredConfig(agentID, "[INPUT]\n    Name ignored\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = waitForStatus(version)
+	if want, got := cloud.AgentConfigStateRolledBack, status.State; want != got {
+		t.Fatalf("want state %q; got %q", want, got)
+	}
+
+	if want, got := "hot reload count still 3", status.Error; !strings.Contains(got, want) {
+		t.Errorf("want error containing %q; got %q", want, got)
+	}
+
+	// Fluent Bit goes down right after the first healthy check.
+	reloads = 0
+	fluentBit.OnReload(func() {
+		reloads++
+		if reloads != 1 {
+			fluentBit.ClearFailures()
+			return
+		}
+
+		fetches := fluentBit.Fetches("/api/v1/metrics")
+		go func() {
+			for fluentBit.Fetches("/api/v1/metrics") == fetches {
+				time.Sleep(time.Millisecond)
+			}
+			fluentBit.InjectFailure(fluentbittest.Failure{Path: "/api/v1/*", StatusCode: http.StatusInternalServerError})
+		}()
+	})
+
+	version, err = fakeCloud.SetDesiredConfig(agentID, "[INPUT]\n    Name flaky\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = waitForStatus(version)
+	if want, got := cloud.AgentConfigStateRolledBack, status.State; want != got {
+		t.Fatalf("want state %q; got %q", want, got)
+	}
+
+	if want, got := good, readFile(path); want != got {
+		t.Errorf("want rolled back config %q; got %q", want, got)
+	}
+
+	if want, got := 6, fluentBit.Reloads(); want != got {
+		t.Errorf("want %d reloads; got %d", want, got)
+	}
+
+	// Cloud fails to get the next report, so it is reported again.
+	fakeCloud.InjectFailure(cloudtest.Failure{
+		Method:     http.MethodPatch,
+		Path:       "/v1/agents/*",
+		StatusCode: http.StatusServiceUnavailable,
+		Times:      1,
+	})
+
+	version, err = fakeCloud.SetDesiredConfig(agentID, " \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = waitForStatus(version)
+	if want, got := cloud.AgentConfigStateFailed, status.State; want != got {
+		t.Fatalf("want state %q; got %q", want, got)
+	}
+
+	if want, got := 6, fluentBit.Reloads(); want != got {
+		t.Errorf("want %d reloads; got %d", want, got)
+	}
+
+	if want, got := version, fd.Status().ConfigVersion; want != got {
+		t.Errorf("want status config version %q; got %q", want, got)
+	}
+
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+
+	// After a restart, the last version processed is not applied again.
+	fd = newForwarder()
+	if want, got := version, fd.loadConfigSyncState().Version; want != got {
+		t.Errorf("want stored config version %q; got %q", want, got)
 	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	updates := func() int {
+		var n int
+		for _, req := range fakeCloud.Requests() {
+			if req.Method == http.MethodPatch {
+				n++
+			}
+		}
+		return n
+	}
+	before := updates()
+
+	go func() {
+		done <- fd.Forward(ctx)
+	}()
+
+	waitFor("registration", func() bool {
+		return fd.Status().Registered
+	})
+
+	time.Sleep(time.Millisecond * 200)
+
+	// Only the agent update on start.
+	if want, got := 1, updates()-before; want != got {
+		t.Errorf("want %d agent updates after restart; got %d", want, got)
+	}
+
+	if want, got := version, fd.Status().ConfigVersion; want != got {
+		t.Errorf("want status config version %q; got %q", want, got)
+	}
+
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+}
+
+func serve(h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+type memStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: map[string][]byte{}}
+}
+
+func (s *memStore) Has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.data[key]
+	return ok
+}
+
+func (s *memStore) Write(key string, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[key] = append([]byte(nil), val...)
+	return nil
+}
+
+func (s *memStore) Read(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, ok := s.data[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+
+	return val, nil
+}
+
+func (s *memStore) Erase(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, key)
+	return nil
+}
+
+type testSink struct {
+	name string
+	// block, if set, makes pushes wait until it is closed.
+	block chan struct{}
+	// err, if set, is returned by pushes.
+	err error
+
+	mu    sync.Mutex
+	store []Snapshot
+}
+
+func (s *testSink) Name() string {
+	return s.name
+}
+
+func (s *testSink) Push(ctx context.Context, snapshot Snapshot) (PushResult, error) {
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-ctx.Done():
+			return PushResult{}, ctx.Err()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return PushResult{}, s.err
+	}
+
+	s.store = append(s.store, snapshot)
+	return PushResult{}, nil
+}
+
+func (s *testSink) snapshots() []Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Snapshot(nil), s.store...)
+}
+
+// testPayloadSink records the payloads pushed to it,
+// and the snapshots pushed as a regular sink, if any.
+type testPayloadSink struct {
+	testSink
+	store [][]byte
+}
+
+func (s *testPayloadSink) PushPayload(ctx context.Context, snapshot Snapshot, payload []byte) (PushResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store = append(s.store, payload)
+	return PushResult{PayloadSize: len(payload)}, nil
+}
+
+func (s *testPayloadSink) payloads() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]byte(nil), s.store...)
+}
+
+// sinkFunc is a sink named "func" pushing with the function.
+type sinkFunc func(ctx context.Context, snapshot Snapshot) (PushResult, error)
+
+func (f sinkFunc) Name() string {
+	return "func"
+}
+
+func (f sinkFunc) Push(ctx context.Context, snapshot Snapshot) (PushResult, error) {
+	return f(ctx, snapshot)
 }
@@ -8,6 +8,10 @@ require (
 	github.com/denisbrodbeck/machineid v1.0.1
 	github.com/go-kit/log v0.1.0
 	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.13.6
 	github.com/lucasepe/codename v0.2.0
 	github.com/peterbourgon/diskv v2.0.1+incompatible
+	go.opentelemetry.io/proto/otlp v0.9.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,80 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultReadyPushIntervals is the default number of intervals
+// without a successful push after which the forwarder is not ready.
+const DefaultReadyPushIntervals = 3
+
+// Handler serves the forwarder own endpoints:
+//   - GET /healthz reports the process is alive.
+//   - GET /readyz reports the agent is registered and pushed metrics recently.
+//   - GET /status reports the forwarder Status as JSON.
+//   - GET /metrics reports the forwarder own metrics.
+func (fd *Forwarder) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		respondText(w, http.StatusOK, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := fd.Ready(); err != nil {
+			respondText(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		respondText(w, http.StatusOK, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(fd.Status())
+		if err != nil {
+			respondText(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write(b)
+	})
+	mux.Handle("/metrics", fd.MetricsHandler())
+	return mux
+}
+
+// Ready reports whether the agent is registered
+// and the last successful push happened within ReadyPushIntervals.
+func (fd *Forwarder) Ready() error {
+	if !fd.state.registered() {
+		return fmt.Errorf("agent not registered yet")
+	}
+
+	lastPush := fd.state.lastPush()
+	if lastPush.IsZero() {
+		return fmt.Errorf("no metrics pushed yet")
+	}
+
+	if since := fd.now().Sub(lastPush); since > fd.readyPushWindow() {
+		return fmt.Errorf("last metrics push was %s ago", since.Truncate(time.Second))
+	}
+
+	return nil
+}
+
+// readyPushWindow is how long the forwarder stays ready without a successful push.
+func (fd *Forwarder) readyPushWindow() time.Duration {
+	settings := fd.settings()
+	intervals := settings.readyPushIntervals
+	if intervals <= 0 {
+		intervals = DefaultReadyPushIntervals
+	}
+
+	return settings.interval * time.Duration(intervals)
+}
+
+func respondText(w http.ResponseWriter, statusCode int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_, _ = fmt.Fprintln(w, text)
+}
@@ -0,0 +1,211 @@
+// Package notify sends forwarder state changes, like Fluent Bit becoming
+// unreachable or Cloud pushes failing for a while, to webhooks.
+package notify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+// Severity of a notification.
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityError    Severity = "error"
+	SeverityCritical Severity = "critical"
+)
+
+// DefaultEvents notified by webhooks that do not set their own.
+var DefaultEvents = []forwarder.EventKind{
+	forwarder.EventRegistered,
+	forwarder.EventConfigUpdated,
+	forwarder.EventFluentBitUnreachable,
+	forwarder.EventFluentBitRecovered,
+	forwarder.EventPushFailing,
+	forwarder.EventPushRecovered,
+	forwarder.EventFluentBitConfigApplied,
+	forwarder.EventFluentBitConfigFailed,
+}
+
+// EventMap of the events that can be notified.
+var EventMap = map[string]forwarder.EventKind{
+	string(forwarder.EventRegistered):             forwarder.EventRegistered,
+	string(forwarder.EventConfigUpdated):          forwarder.EventConfigUpdated,
+	string(forwarder.EventFluentBitUnreachable):   forwarder.EventFluentBitUnreachable,
+	string(forwarder.EventFluentBitRecovered):     forwarder.EventFluentBitRecovered,
+	string(forwarder.EventFluentBitRestarted):     forwarder.EventFluentBitRestarted,
+	string(forwarder.EventPushFailing):            forwarder.EventPushFailing,
+	string(forwarder.EventPushRecovered):          forwarder.EventPushRecovered,
+	string(forwarder.EventAlertFiring):            forwarder.EventAlertFiring,
+	string(forwarder.EventAlertResolved):          forwarder.EventAlertResolved,
+	string(forwarder.EventFluentBitConfigApplied): forwarder.EventFluentBitConfigApplied,
+	string(forwarder.EventFluentBitConfigFailed):  forwarder.EventFluentBitConfigFailed,
+}
+
+// Notification of a forwarder state change.
+type Notification struct {
+	Kind      forwarder.EventKind `json:"event"`
+	Time      time.Time           `json:"time"`
+	Severity  Severity            `json:"severity"`
+	Summary   string              `json:"summary"`
+	MachineID string              `json:"machineID"`
+	Hostname  string              `json:"hostname,omitempty"`
+	AgentID   string              `json:"agentID,omitempty"`
+	AgentName string              `json:"agentName,omitempty"`
+	Sink      string              `json:"sink,omitempty"`
+	Error     string              `json:"error,omitempty"`
+	Alert     *forwarder.Alert    `json:"alert,omitempty"`
+	// ConfigVersion of the desired Fluent Bit config.
+	ConfigVersion string `json:"configVersion,omitempty"`
+}
+
+// Resolves tells whether the notification ends a previous problem one,
+// like Fluent Bit recovering after being unreachable.
+func (n Notification) Resolves() bool {
+	switch n.Kind {
+	case forwarder.EventFluentBitRecovered, forwarder.EventPushRecovered, forwarder.EventAlertResolved, forwarder.EventFluentBitConfigApplied:
+		return true
+	}
+
+	return false
+}
+
+// Problem tells whether the notification is about something going wrong.
+func (n Notification) Problem() bool {
+	switch n.Kind {
+	case forwarder.EventFluentBitUnreachable, forwarder.EventPushFailing, forwarder.EventAlertFiring, forwarder.EventFluentBitConfigFailed:
+		return true
+	}
+
+	return false
+}
+
+// DedupKey shared by a problem notification and the one resolving it.
+func (n Notification) DedupKey() string {
+	var topic string
+	switch n.Kind {
+	case forwarder.EventFluentBitUnreachable, forwarder.EventFluentBitRecovered:
+		topic = "fluentbit"
+	case forwarder.EventPushFailing, forwarder.EventPushRecovered:
+		topic = "push/" + n.Sink
+	case forwarder.EventFluentBitConfigFailed, forwarder.EventFluentBitConfigApplied:
+		topic = "fluentbit_config"
+	case forwarder.EventAlertFiring, forwarder.EventAlertResolved:
+		topic = "alert/" + n.Alert.Rule
+		if len(n.Alert.Labels) != 0 {
+			topic += "/" + labelsString(n.Alert.Labels)
+		}
+	default:
+		topic = string(n.Kind)
+	}
+
+	return n.MachineID + "/" + topic
+}
+
+// Notifier turns the events of a forwarder into notifications,
+// skipping repeated ones, like every failed fetch while Fluent Bit
+// stays unreachable.
+// The zero value is ready to use.
+type Notifier struct {
+	mu            sync.Mutex
+	fluentBitDown bool
+}
+
+// Notification for the event, along with the forwarder status.
+// It reports false for events that should not be notified.
+func (nt *Notifier) Notification(status forwarder.Status, ev forwarder.Event) (Notification, bool) {
+	n := Notification{
+		Kind:          ev.Kind,
+		Time:          ev.Time,
+		Severity:      SeverityInfo,
+		MachineID:     status.MachineID,
+		Hostname:      status.Hostname,
+		AgentID:       ev.AgentID,
+		AgentName:     ev.AgentName,
+		Sink:          ev.Sink,
+		Alert:         ev.Alert,
+		ConfigVersion: ev.ConfigVersion,
+	}
+	if ev.Err != nil {
+		n.Error = ev.Err.Error()
+	}
+
+	host := status.Hostname
+	if host == "" {
+		host = status.MachineID
+	}
+
+	switch ev.Kind {
+	case forwarder.EventRegistered:
+		n.Summary = fmt.Sprintf("Agent %s registered on Cloud", host)
+	case forwarder.EventConfigUpdated:
+		n.Summary = fmt.Sprintf("Agent %s config updated on Cloud", host)
+	case forwarder.EventFluentBitUnreachable:
+		if !nt.setFluentBitDown(true) {
+			return n, false
+		}
+
+		n.Severity = SeverityCritical
+		n.Summary = fmt.Sprintf("Fluent Bit on %s is unreachable", host)
+	case forwarder.EventFluentBitRecovered:
+		if !nt.setFluentBitDown(false) {
+			return n, false
+		}
+
+		n.Summary = fmt.Sprintf("Fluent Bit on %s recovered", host)
+	case forwarder.EventFluentBitRestarted:
+		n.Severity = SeverityWarning
+		n.Summary = fmt.Sprintf("Fluent Bit on %s restarted", host)
+	case forwarder.EventPushFailing:
+		n.Severity = SeverityError
+		n.Summary = fmt.Sprintf("Pushes from %s to %s are failing", host, ev.Sink)
+	case forwarder.EventPushRecovered:
+		n.Summary = fmt.Sprintf("Pushes from %s to %s recovered", host, ev.Sink)
+	case forwarder.EventAlertFiring:
+		n.Severity = SeverityWarning
+		n.Summary = fmt.Sprintf("Alert %s firing on %s", ev.Alert, host)
+	case forwarder.EventAlertResolved:
+		n.Summary = fmt.Sprintf("Alert %s resolved on %s", ev.Alert, host)
+	case forwarder.EventFluentBitConfigApplied:
+		n.Summary = fmt.Sprintf("Fluent Bit config %s applied on %s", ev.ConfigVersion, host)
+	case forwarder.EventFluentBitConfigFailed:
+		n.Severity = SeverityError
+		n.Summary = fmt.Sprintf("Fluent Bit config %s failed on %s", ev.ConfigVersion, host)
+	default:
+		return n, false
+	}
+
+	return n, true
+}
+
+// setFluentBitDown reports whether it changed.
+func (nt *Notifier) setFluentBitDown(down bool) bool {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+
+	changed := nt.fluentBitDown != down
+	nt.fluentBitDown = down
+	return changed
+}
+
+func labelsString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%q", k, labels[k])
+	}
+
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,272 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+// Format of the webhook payload.
+type Format string
+
+const (
+	// FormatGeneric posts the notification as a JSON object.
+	FormatGeneric Format = "generic"
+	// FormatSlack posts a Slack-compatible message with a "text" field,
+	// like to a Slack or Mattermost incoming webhook.
+	FormatSlack Format = "slack"
+	// FormatPagerDuty posts a PagerDuty Events API v2 event.
+	// Problems trigger an alert and the notifications ending them resolve it.
+	// Other notifications are skipped.
+	FormatPagerDuty Format = "pagerduty"
+)
+
+var FormatMap = map[string]Format{
+	string(FormatGeneric):   FormatGeneric,
+	string(FormatSlack):     FormatSlack,
+	string(FormatPagerDuty): FormatPagerDuty,
+}
+
+const (
+	// DefaultPagerDutyURL of the PagerDuty Events API v2.
+	DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+	// DefaultMaxAttempts of each notification.
+	DefaultMaxAttempts = 3
+
+	// SignatureHeader holds the HMAC-SHA256 of the timestamp header value,
+	// a dot and the body, hex encoded and prefixed with "sha256=".
+	SignatureHeader = "X-Forwarder-Signature"
+	// TimestampHeader holds the unix time the request was signed at,
+	// so receivers can reject old ones.
+	TimestampHeader = "X-Forwarder-Timestamp"
+)
+
+// retryBackoff before the second attempt, doubling on each one after.
+var retryBackoff = time.Second
+
+// Webhook posts notifications to a URL.
+// Network errors, 5xx, 408 and 429 responses are retried with backoff.
+type Webhook struct {
+	// URL to post to. Defaults to DefaultPagerDutyURL with FormatPagerDuty.
+	URL string
+	// Format defaults to FormatGeneric.
+	Format Format
+	// Secret to sign each request with.
+	// See SignatureHeader.
+	Secret string
+	// RoutingKey of the PagerDuty service integration.
+	// Required with FormatPagerDuty.
+	RoutingKey string
+	// Events to notify. Defaults to DefaultEvents.
+	Events []forwarder.EventKind
+	// MaxAttempts of each notification. Defaults to DefaultMaxAttempts.
+	MaxAttempts int
+	HTTPClient  *http.Client
+}
+
+// Wants tells whether the webhook notifies the given event.
+func (w *Webhook) Wants(kind forwarder.EventKind) bool {
+	events := w.Events
+	if len(events) == 0 {
+		events = DefaultEvents
+	}
+
+	for _, e := range events {
+		if e == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Notify posts the notification, retrying while it fails with a retryable error
+// and the context allows it.
+func (w *Webhook) Notify(ctx context.Context, n Notification) error {
+	body, ok, err := w.body(n)
+	if err != nil || !ok {
+		return err
+	}
+
+	attempts := w.MaxAttempts
+	if attempts <= 0 {
+		attempts = DefaultMaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= attempts {
+			return err
+		}
+
+		timer := time.NewTimer(retryBackoff * time.Duration(1<<(attempt-1)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// body of the request in the webhook format.
+// It reports false if the notification is skipped.
+func (w *Webhook) body(n Notification) ([]byte, bool, error) {
+	var v interface{}
+	switch w.Format {
+	case "", FormatGeneric:
+		v = n
+	case FormatSlack:
+		v = slackMessage{Text: slackText(n)}
+	case FormatPagerDuty:
+		var action string
+		switch {
+		case n.Problem():
+			action = "trigger"
+		case n.Resolves():
+			action = "resolve"
+		default:
+			return nil, false, nil
+		}
+
+		source := n.Hostname
+		if source == "" {
+			source = n.MachineID
+		}
+
+		v = pagerDutyEvent{
+			RoutingKey:  w.RoutingKey,
+			EventAction: action,
+			DedupKey:    n.DedupKey(),
+			Payload: pagerDutyPayload{
+				Summary:       n.Summary,
+				Source:        source,
+				Severity:      n.Severity,
+				Timestamp:     n.Time,
+				Component:     "fluent-bit",
+				CustomDetails: n,
+			},
+		}
+	default:
+		return nil, false, fmt.Errorf("invalid webhook format %q", w.Format)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not json marshal notification: %w", err)
+	}
+
+	return b, true, nil
+}
+
+// post the body, reporting whether a failure can be retried.
+func (w *Webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url(), bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(w.Secret, timestamp, body))
+	}
+
+	client := w.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return !errors.Is(err, context.Canceled), fmt.Errorf("could not do request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("unexpected status %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		if s := strings.TrimSpace(string(b)); s != "" {
+			err = fmt.Errorf("%w: %s", err, s)
+		}
+
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+		return retry, err
+	}
+
+	return false, nil
+}
+
+func (w *Webhook) url() string {
+	if w.URL == "" && w.Format == FormatPagerDuty {
+		return DefaultPagerDutyURL
+	}
+
+	return w.URL
+}
+
+// Sign the body as sent on SignatureHeader.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+func slackText(n Notification) string {
+	var emoji string
+	switch {
+	case n.Problem():
+		emoji = ":red_circle:"
+	case n.Resolves():
+		emoji = ":large_green_circle:"
+	default:
+		emoji = ":information_source:"
+	}
+
+	text := emoji + " " + n.Summary
+	if n.Error != "" {
+		text += "\n```" + n.Error + "```"
+	}
+
+	return text
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string           `json:"routing_key"`
+	EventAction string           `json:"event_action"`
+	DedupKey    string           `json:"dedup_key"`
+	Payload     pagerDutyPayload `json:"payload"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string       `json:"summary"`
+	Source        string       `json:"source"`
+	Severity      Severity     `json:"severity"`
+	Timestamp     time.Time    `json:"timestamp"`
+	Component     string       `json:"component"`
+	CustomDetails Notification `json:"custom_details"`
+}
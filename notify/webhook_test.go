@@ -0,0 +1,175 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+func TestWebhook_Notify(t *testing.T) {
+	retryBackoff = time.Millisecond
+
+	var (
+		mu       sync.Mutex
+		requests int
+		body     []byte
+		header   http.Header
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	wh := &Webhook{URL: srv.URL, Secret: "secret"}
+	n := testNotification(forwarder.EventFluentBitUnreachable)
+	err := wh.Notify(context.Background(), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if want, got := 2, requests; want != got {
+		t.Errorf("want %d requests; got %d", want, got)
+	}
+
+	if want, got := Sign("secret", header.Get(TimestampHeader), body), header.Get(SignatureHeader); want != got {
+		t.Errorf("want signature %q; got %q", want, got)
+	}
+
+	var got Notification
+	err = json.Unmarshal(body, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := n.Summary, got.Summary; want != got {
+		t.Errorf("want summary %q; got %q", want, got)
+	}
+}
+
+func TestWebhook_Notify_notRetryable(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "bad routing key", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	wh := &Webhook{URL: srv.URL}
+	err := wh.Notify(context.Background(), testNotification(forwarder.EventRegistered))
+	if err == nil || !strings.Contains(err.Error(), "bad routing key") {
+		t.Errorf("want bad request error; got %v", err)
+	}
+
+	if want, got := 1, requests; want != got {
+		t.Errorf("want %d requests; got %d", want, got)
+	}
+}
+
+func TestWebhook_body(t *testing.T) {
+	tt := []struct {
+		name     string
+		format   Format
+		kind     forwarder.EventKind
+		wantSkip bool
+		want     string
+	}{
+		{
+			name:   "slack",
+			format: FormatSlack,
+			kind:   forwarder.EventFluentBitUnreachable,
+			want:   `{"text":":red_circle: Fluent Bit on test is unreachable\n` + "```connection refused```" + `"}`,
+		},
+		{
+			name:   "pagerduty_trigger",
+			format: FormatPagerDuty,
+			kind:   forwarder.EventFluentBitUnreachable,
+			want:   `"event_action":"trigger","dedup_key":"machine-id/fluentbit"`,
+		},
+		{
+			name:   "pagerduty_resolve",
+			format: FormatPagerDuty,
+			kind:   forwarder.EventFluentBitRecovered,
+			want:   `"event_action":"resolve","dedup_key":"machine-id/fluentbit"`,
+		},
+		{
+			name:     "pagerduty_skips_info",
+			format:   FormatPagerDuty,
+			kind:     forwarder.EventRegistered,
+			wantSkip: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			wh := &Webhook{Format: tc.format, RoutingKey: "key"}
+			n := testNotification(tc.kind)
+			n.Error = "connection refused"
+
+			b, ok, err := wh.body(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want, got := !tc.wantSkip, ok; want != got {
+				t.Fatalf("want ok %v; got %v", want, got)
+			}
+
+			if !strings.Contains(string(b), tc.want) {
+				t.Errorf("want body containing\n%s\ngot\n%s", tc.want, b)
+			}
+		})
+	}
+}
+
+func TestNotifier_Notification(t *testing.T) {
+	status := forwarder.Status{MachineID: "machine-id", Hostname: "test"}
+	unreachable := forwarder.Event{Kind: forwarder.EventFluentBitUnreachable, Err: errors.New("connection refused")}
+	recovered := forwarder.Event{Kind: forwarder.EventFluentBitRecovered}
+	pushed := forwarder.Event{Kind: forwarder.EventPushSucceeded}
+
+	var nt Notifier
+	var got []bool
+	for _, ev := range []forwarder.Event{unreachable, unreachable, pushed, recovered, unreachable} {
+		_, ok := nt.Notification(status, ev)
+		got = append(got, ok)
+	}
+
+	want := []bool{true, false, false, true, true}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Errorf("want notified %v; got %v", want, got)
+			break
+		}
+	}
+}
+
+func testNotification(kind forwarder.EventKind) Notification {
+	var nt Notifier
+	n, _ := nt.Notification(forwarder.Status{MachineID: "machine-id", Hostname: "test"}, forwarder.Event{
+		Kind: kind,
+		Time: time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC),
+	})
+	return n
+}
@@ -0,0 +1,190 @@
+package forwarder
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// CounterSeries is a form in which Fluent Bit plugin counters are forwarded.
+type CounterSeries string
+
+const (
+	// CounterSeriesCumulative forwards counters as totals, as Fluent Bit reports them.
+	CounterSeriesCumulative CounterSeries = "cumulative"
+	// CounterSeriesDelta adds a gauge with the increment of each counter
+	// since the previous snapshot, named like "fluentbit_input_records_delta".
+	CounterSeriesDelta CounterSeries = "delta"
+	// CounterSeriesRate adds a gauge with the per-second rate of each counter
+	// since the previous snapshot, named like "fluentbit_input_records_per_second".
+	CounterSeriesRate CounterSeries = "rate"
+)
+
+var CounterSeriesMap = map[string]CounterSeries{
+	string(CounterSeriesCumulative): CounterSeriesCumulative,
+	string(CounterSeriesDelta):      CounterSeriesDelta,
+	string(CounterSeriesRate):       CounterSeriesRate,
+}
+
+// counterDeriver keeps the plugin counters of the previous snapshot
+// to derive deltas and rates from.
+// The zero value is ready to use.
+type counterDeriver struct {
+	mu       sync.Mutex
+	prevTime time.Time
+	prev     map[string]float64
+}
+
+// deriveCounters adds the delta and rate series of the plugin counters
+// to the snapshot, as needed by any sink. The cumulative ones are kept,
+// and dropped later for each sink by sinkCounterSeries.
+// Series without a previous value, like on the first snapshot
+// or once back after missing from one, get no delta nor rate. A counter that went down, or any counter after
+// a detected restart that was not adjusted, is taken as starting over from zero.
+func (fd *Forwarder) deriveCounters(settings settings, snapshot Snapshot, restarted bool) Snapshot {
+	var delta, rate bool
+	for _, sinkSeries := range settings.sinkCounterSeries {
+		for _, series := range sinkSeries {
+			switch series {
+			case CounterSeriesDelta:
+				delta = true
+			case CounterSeriesRate:
+				rate = true
+			}
+		}
+	}
+
+	if !delta && !rate {
+		return snapshot
+	}
+
+	d := &fd.counterDeriver
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Snapshots are collected in order, but skip any older than the previous one
+	// rather than taking its counters as starting over.
+	if !d.prevTime.IsZero() && !snapshot.Time.After(d.prevTime) {
+		return snapshot
+	}
+
+	// Only the series of this snapshot are kept for the next one.
+	prevs := map[string]float64{}
+
+	elapsed := snapshot.Time.Sub(d.prevTime).Seconds()
+	if d.prevTime.IsZero() {
+		elapsed = 0
+	}
+
+	// Adjusted counters keep going up after a restart.
+	startedOver := restarted && settings.counterResets != CounterResetsAdjust
+
+	metrics := make([]Metric, 0, len(snapshot.Metrics))
+	for _, m := range snapshot.Metrics {
+		metrics = append(metrics, m)
+		if !isPluginCounter(m) {
+			continue
+		}
+
+		deltas := derivedMetric(m, "_delta", " per interval")
+		rates := derivedMetric(m, "_per_second", " per second")
+		for _, sample := range m.Samples {
+			key := seriesKey(m, sample)
+			prev, ok := d.prev[key]
+			prevs[key] = sample.Value
+			if !ok {
+				continue
+			}
+
+			v := sample.Value - prev
+			if startedOver || v < 0 {
+				v = sample.Value
+			}
+
+			deltas.add(v, sample.LabelValues...)
+			if elapsed > 0 {
+				rates.add(v/elapsed, sample.LabelValues...)
+			}
+		}
+
+		if delta {
+			metrics = append(metrics, deltas)
+		}
+		if rate {
+			metrics = append(metrics, rates)
+		}
+	}
+
+	d.prevTime = snapshot.Time
+	d.prev = prevs
+	snapshot.Metrics = metrics
+	return snapshot
+}
+
+// sinkCounterSeries keeps only the forms of the plugin counters
+// configured for the sink. Sinks without any get the cumulative ones only.
+func sinkCounterSeries(snapshot Snapshot, series []CounterSeries) Snapshot {
+	if len(series) == 0 {
+		series = []CounterSeries{CounterSeriesCumulative}
+	}
+
+	keep := map[CounterSeries]bool{}
+	for _, s := range series {
+		keep[s] = true
+	}
+
+	if len(keep) == len(CounterSeriesMap) {
+		return snapshot
+	}
+
+	metrics := make([]Metric, 0, len(snapshot.Metrics))
+	for _, m := range snapshot.Metrics {
+		if series, ok := counterSeriesOf(m); ok && !keep[series] {
+			continue
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	snapshot.Metrics = metrics
+	return snapshot
+}
+
+// counterSeriesOf tells the form of a plugin counter,
+// or of a series derived from one.
+func counterSeriesOf(m Metric) (CounterSeries, bool) {
+	if isPluginCounter(m) {
+		return CounterSeriesCumulative, true
+	}
+
+	if m.Type != MetricGauge || m.Namespace != "fluentbit" || (m.Subsystem != "input" && m.Subsystem != "output") {
+		return "", false
+	}
+
+	switch {
+	case strings.HasSuffix(m.Name, "_delta"):
+		return CounterSeriesDelta, true
+	case strings.HasSuffix(m.Name, "_per_second"):
+		return CounterSeriesRate, true
+	}
+
+	return "", false
+}
+
+// isPluginCounter tells whether the metric is a counter
+// of the Fluent Bit input or output plugins.
+func isPluginCounter(m Metric) bool {
+	return isFluentBitCounter(m) && (m.Subsystem == "input" || m.Subsystem == "output")
+}
+
+// derivedMetric is a gauge named after the counter with the given suffix.
+func derivedMetric(m Metric, nameSuffix, helpSuffix string) Metric {
+	return Metric{
+		Namespace: m.Namespace,
+		Subsystem: m.Subsystem,
+		Name:      m.Name + nameSuffix,
+		Help:      m.Help + helpSuffix,
+		Type:      MetricGauge,
+		LabelKeys: m.LabelKeys,
+	}
+}
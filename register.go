@@ -0,0 +1,290 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+	fluentbit "github.com/calyptia/go-fluent-bit-metrics"
+	"github.com/go-kit/log/level"
+)
+
+// ErrNotRegistered is returned when there is no agent stored for the machine ID.
+var ErrNotRegistered = errors.New("agent not registered")
+
+// Register the agent on Cloud and store its credentials without forwarding.
+// If Fluent Bit is unreachable within the interval, the agent is registered
+// without its build info, which gets updated once forwarding.
+func (fd *Forwarder) Register(ctx context.Context) (StorePayload, error) {
+	settings := fd.settings()
+
+	fetchCtx, cancel := context.WithTimeout(ctx, settings.interval)
+	buildInfo, err := settings.fluentBitClient.BuildInfo(fetchCtx)
+	cancel()
+	if err != nil {
+		_ = level.Warn(fd.Logger).Log("msg", "registering without fluent bit build info", "err", err)
+		buildInfo = fluentbit.BuildInfo{}
+	}
+
+	return fd.register(ctx, settings, buildInfo)
+}
+
+// VerifyAgent returns the stored agent, named as on Cloud,
+// and checks its token is still valid.
+// Returns ErrNotRegistered if there is no stored agent.
+func (fd *Forwarder) VerifyAgent(ctx context.Context) (StorePayload, error) {
+	settings := fd.settings()
+	payload, err := fd.storedAgent()
+	if err != nil {
+		return payload, err
+	}
+
+	if payload.AgentToken != "" {
+		settings.cloudClient.SetAgentToken(payload.AgentToken)
+	}
+
+	fetcher, ok := settings.cloudClient.(AgentFetcher)
+	if !ok {
+		return payload, errors.New("cloud client cannot fetch agents")
+	}
+
+	agent, err := fetcher.Agent(ctx, payload.AgentID)
+	if err != nil {
+		return payload, fmt.Errorf("could not verify agent: %w", err)
+	}
+
+	payload.AgentName = agent.Name
+	return payload, nil
+}
+
+// Unregister deletes the stored agent from Cloud and erases it from the store,
+// along with its tracked counters and config sync state.
+// Returns ErrNotRegistered if there is no stored agent.
+func (fd *Forwarder) Unregister(ctx context.Context) (StorePayload, error) {
+	settings := fd.settings()
+	payload, err := fd.storedAgent()
+	if err != nil {
+		return payload, err
+	}
+
+	if payload.AgentToken != "" {
+		settings.cloudClient.SetAgentToken(payload.AgentToken)
+	}
+
+	deleter, ok := settings.cloudClient.(AgentDeleter)
+	if !ok {
+		return payload, errors.New("cloud client cannot delete agents")
+	}
+
+	err = deleter.DeleteAgent(ctx, payload.AgentID)
+	if err != nil && !errors.Is(err, cloud.ErrNotFound) {
+		return payload, fmt.Errorf("could not delete agent: %w", err)
+	}
+
+	if fd.AgentID == "" {
+		err = fd.Store.Erase(fd.MachineID)
+		if err != nil {
+			return payload, fmt.Errorf("could not erase from store: %w", err)
+		}
+	}
+
+	// The counters of the deleted agent are not carried over to the next one.
+	if key := fd.countersStoreKey(); fd.Store.Has(key) {
+		err = fd.Store.Erase(key)
+		if err != nil {
+			return payload, fmt.Errorf("could not erase counters from store: %w", err)
+		}
+	}
+
+	// Neither is the last desired config version it processed.
+	if key := fd.configStoreKey(); fd.Store.Has(key) {
+		err = fd.Store.Erase(key)
+		if err != nil {
+			return payload, fmt.Errorf("could not erase config sync state from store: %w", err)
+		}
+	}
+
+	return payload, nil
+}
+
+// storedAgent returns the pre-provisioned agent, or the one stored for the machine ID.
+func (fd *Forwarder) storedAgent() (StorePayload, error) {
+	var payload StorePayload
+	if fd.AgentID != "" {
+		payload.AgentID = fd.AgentID
+		payload.AgentName = fd.settings().hostname
+		return payload, nil
+	}
+
+	if !fd.Store.Has(fd.MachineID) {
+		return payload, ErrNotRegistered
+	}
+
+	b, err := fd.Store.Read(fd.MachineID)
+	if err != nil {
+		return payload, fmt.Errorf("could not read from store: %w", err)
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(&payload)
+	if err != nil {
+		return payload, fmt.Errorf("could not decode store payload: %w", err)
+	}
+
+	return payload, nil
+}
+
+// register the agent on Cloud, or update it if it was already registered.
+func (fd *Forwarder) register(ctx context.Context, settings settings, buildInfo fluentbit.BuildInfo) (StorePayload, error) {
+	payload, err := fd.storedAgent()
+	registered := err == nil
+	if err != nil && !errors.Is(err, ErrNotRegistered) {
+		return payload, err
+	}
+
+	if fd.AgentID != "" {
+		err = settings.cloudClient.UpdateAgent(ctx, payload.AgentID, updateAgentOpts(settings, buildInfo))
+		if err != nil {
+			return payload, fmt.Errorf("could not update pre-provisioned agent: %w", err)
+		}
+		return payload, nil
+	}
+
+	if registered {
+		settings.cloudClient.SetAgentToken(payload.AgentToken)
+
+		err = settings.cloudClient.UpdateAgent(ctx, payload.AgentID, updateAgentOpts(settings, buildInfo))
+		if err != nil {
+			return payload, fmt.Errorf("could not update agent: %w", err)
+		}
+	}
+
+	if !registered && !fd.ForceRegister {
+		adopted, ok, err := fd.adopt(ctx, settings, buildInfo)
+		if err != nil {
+			return adopted, err
+		}
+
+		if ok {
+			payload = adopted
+			registered = true
+		}
+	}
+
+	if !registered {
+		createdAgent, err := settings.cloudClient.CreateAgent(ctx, cloud.CreateAgentPayload{
+			Name:      settings.hostname,
+			MachineID: fd.MachineID,
+			Type:      cloud.AgentTypeFluentBit,
+			Version:   buildInfo.FluentBit.Version,
+			Edition:   cloud.AgentEdition(strings.ToLower(buildInfo.FluentBit.Edition)),
+			Flags:     buildInfo.FluentBit.Flags,
+			RawConfig: settings.rawConfig,
+		})
+		if err != nil {
+			return payload, fmt.Errorf("could not create agent: %w", err)
+		}
+
+		payload.AgentID = createdAgent.ID
+		payload.AgentToken = createdAgent.Token
+		payload.AgentName = createdAgent.Name
+
+		err = fd.storeAgent(payload)
+		if err != nil {
+			return payload, err
+		}
+
+		settings.cloudClient.SetAgentToken(payload.AgentToken)
+	}
+
+	return payload, nil
+}
+
+// adopt the newest agent on Cloud with the same machine ID, if any,
+// so losing the store does not leave duplicated agents behind.
+// Its token is rotated since the previous one was lost along with the store.
+// Nothing is adopted if the cloud client is not an AgentAdopter.
+// Failing to list agents is an error, since a new agent could duplicate
+// the existing one. ForceRegister skips adopting altogether.
+func (fd *Forwarder) adopt(ctx context.Context, settings settings, buildInfo fluentbit.BuildInfo) (StorePayload, bool, error) {
+	var payload StorePayload
+
+	adopter, ok := settings.cloudClient.(AgentAdopter)
+	if !ok {
+		return payload, false, nil
+	}
+
+	last := uint64(1)
+	agents, err := adopter.Agents(ctx, cloud.AgentsParams{
+		MachineID: &fd.MachineID,
+		Last:      &last,
+	})
+	if err != nil {
+		return payload, false, fmt.Errorf("could not look up existing agents: %w", err)
+	}
+
+	if len(agents.Items) == 0 {
+		return payload, false, nil
+	}
+
+	agent := agents.Items[0]
+	rotated, err := adopter.RotateAgentToken(ctx, agent.ID)
+	if err != nil {
+		return payload, false, fmt.Errorf("could not rotate token of existing agent: %w", err)
+	}
+
+	payload.AgentID = agent.ID
+	payload.AgentToken = rotated.Token
+	payload.AgentName = settings.hostname
+
+	settings.cloudClient.SetAgentToken(payload.AgentToken)
+
+	err = settings.cloudClient.UpdateAgent(ctx, payload.AgentID, updateAgentOpts(settings, buildInfo))
+	if err != nil {
+		return payload, false, fmt.Errorf("could not update existing agent: %w", err)
+	}
+
+	err = fd.storeAgent(payload)
+	if err != nil {
+		return payload, false, err
+	}
+
+	_ = level.Info(fd.Logger).Log("msg", "adopted existing agent with the same machine ID", "agent_id", payload.AgentID)
+	return payload, true, nil
+}
+
+func (fd *Forwarder) storeAgent(payload StorePayload) error {
+	buff := &bytes.Buffer{}
+	err := gob.NewEncoder(buff).Encode(payload)
+	if err != nil {
+		return fmt.Errorf("could not encode store payload: %w", err)
+	}
+
+	err = fd.Store.Write(fd.MachineID, buff.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not write to store: %w", err)
+	}
+
+	return nil
+}
+
+// updateAgentOpts with the agent settings and build info.
+// Build info is left out if unknown.
+func updateAgentOpts(settings settings, buildInfo fluentbit.BuildInfo) cloud.UpdateAgentOpts {
+	opts := cloud.UpdateAgentOpts{
+		Name:      &settings.hostname,
+		RawConfig: &settings.rawConfig,
+	}
+
+	if buildInfo.FluentBit.Version != "" {
+		edition := cloud.AgentEdition(strings.ToLower(buildInfo.FluentBit.Edition))
+		opts.Version = &buildInfo.FluentBit.Version
+		opts.Edition = &edition
+		opts.Flags = &buildInfo.FluentBit.Flags
+	}
+
+	return opts
+}
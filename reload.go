@@ -0,0 +1,126 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/calyptia/fluent-bit-cloud-forwarder/cloud"
+)
+
+// settings that can change while forwarding with Reload.
+type settings struct {
+	hostname           string
+	rawConfig          string
+	interval           time.Duration
+	fluentBitClient    FluentBitClient
+	cloudClient        CloudClient
+	labels             map[string]string
+	includeSelfMetrics bool
+	readyPushIntervals int
+	bufferSize         int
+	sinks              []Sink
+	counterResets      CounterResets
+	sinkCounterSeries  map[string][]CounterSeries
+	alertRules         []AlertRule
+	configSync         *ConfigSync
+}
+
+func (fd *Forwarder) settings() settings {
+	fd.mu.RLock()
+	defer fd.mu.RUnlock()
+
+	return settings{
+		hostname:           fd.Hostname,
+		rawConfig:          fd.RawConfig,
+		interval:           fd.Interval,
+		fluentBitClient:    fd.FluentBitClient,
+		cloudClient:        fd.CloudClient,
+		labels:             fd.Labels,
+		includeSelfMetrics: fd.IncludeSelfMetrics,
+		readyPushIntervals: fd.ReadyPushIntervals,
+		bufferSize:         fd.BufferSize,
+		sinks:              fd.Sinks,
+		counterResets:      fd.CounterResets,
+		sinkCounterSeries:  fd.SinkCounterSeries,
+		alertRules:         fd.AlertRules,
+		configSync:         fd.ConfigSync,
+	}
+}
+
+// Reload applies the settings of next to the running forwarder:
+// hostname, raw config, interval, clients, labels, self metrics,
+// readiness, buffer size, sinks, counters handling, alert rules and config sync.
+// MachineID, AgentID and Store cannot change.
+// The agent registration and buffered snapshots of the remaining sinks are kept.
+// If the hostname or raw config changed, the agent is updated on Cloud.
+func (fd *Forwarder) Reload(ctx context.Context, next *Forwarder) error {
+	if next.MachineID != fd.MachineID {
+		return errors.New("machine ID cannot change on reload")
+	}
+
+	if next.AgentID != fd.AgentID {
+		return errors.New("agent ID cannot change on reload")
+	}
+
+	err := validateSinks(next.Sinks)
+	if err != nil {
+		return err
+	}
+
+	err = validateAlertRules(next.AlertRules)
+	if err != nil {
+		return err
+	}
+
+	err = validateConfigSync(next.ConfigSync, next.CloudClient)
+	if err != nil {
+		return err
+	}
+
+	agentID, agentToken := fd.state.agent()
+	if agentToken != "" && next.CloudClient != nil {
+		next.CloudClient.SetAgentToken(agentToken)
+	}
+
+	fd.mu.Lock()
+	agentChanged := next.Hostname != fd.Hostname || next.RawConfig != fd.RawConfig
+	fd.Hostname = next.Hostname
+	fd.RawConfig = next.RawConfig
+	fd.Interval = next.Interval
+	fd.FluentBitClient = next.FluentBitClient
+	fd.CloudClient = next.CloudClient
+	fd.Labels = next.Labels
+	fd.IncludeSelfMetrics = next.IncludeSelfMetrics
+	fd.ReadyPushIntervals = next.ReadyPushIntervals
+	fd.BufferSize = next.BufferSize
+	fd.Sinks = next.Sinks
+	fd.CounterResets = next.CounterResets
+	fd.SinkCounterSeries = next.SinkCounterSeries
+	fd.AlertRules = next.AlertRules
+	fd.ConfigSync = next.ConfigSync
+	fd.mu.Unlock()
+
+	fd.sinkRunners.truncate(next.BufferSize)
+
+	select {
+	case fd.reloaded <- struct{}{}:
+	default:
+	}
+
+	if agentID == "" || !agentChanged {
+		return nil
+	}
+
+	err = next.CloudClient.UpdateAgent(ctx, agentID, cloud.UpdateAgentOpts{
+		Name:      &next.Hostname,
+		RawConfig: &next.RawConfig,
+	})
+	if err != nil {
+		return fmt.Errorf("could not update agent: %w", err)
+	}
+
+	fd.emit(Event{Kind: EventConfigUpdated, AgentID: agentID, AgentName: next.Hostname})
+	return nil
+}
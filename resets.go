@@ -0,0 +1,209 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// CounterResets is how counters going back to zero when Fluent Bit restarts
+// are handled.
+type CounterResets string
+
+const (
+	// CounterResetsNone forwards counters as they are.
+	CounterResetsNone CounterResets = "none"
+	// CounterResetsMarker adds a fluentbit_restarts_total counter
+	// and a fluentbit_start_time_seconds gauge to each snapshot,
+	// so consumers can tell resets apart.
+	CounterResetsMarker CounterResets = "marker"
+	// CounterResetsAdjust keeps counters monotonic across restarts,
+	// by adding the value each one had before every restart.
+	CounterResetsAdjust CounterResets = "adjust"
+)
+
+var CounterResetsMap = map[string]CounterResets{
+	string(CounterResetsNone):   CounterResetsNone,
+	string(CounterResetsMarker): CounterResetsMarker,
+	string(CounterResetsAdjust): CounterResetsAdjust,
+}
+
+// counterTracker keeps the Fluent Bit counters of the last snapshot,
+// to detect restarts. Its state is persisted on the store so restarts
+// that happen while the forwarder is down are detected too.
+// The zero value is ready to use.
+type counterTracker struct {
+	mu     sync.Mutex
+	loaded bool
+	state  counterState
+}
+
+// counterState persisted on the store.
+type counterState struct {
+	// UpTime of Fluent Bit in seconds, if known.
+	UpTime    uint64
+	StartTime time.Time
+	Restarts  uint64
+	// Last raw value of each counter series.
+	Last map[string]float64
+	// Offsets added to each counter series on adjust mode.
+	Offsets map[string]float64
+}
+
+func (fd *Forwarder) countersStoreKey() string {
+	return fd.MachineID + ".counters"
+}
+
+// trackCounters detects Fluent Bit restarts, either from its uptime going
+// down or from any of its counters decreasing since the last snapshot,
+// and marks or adjusts the snapshot as configured.
+// The uptime is nil if it could not be fetched.
+// It also tells whether a restart was detected.
+func (fd *Forwarder) trackCounters(settings settings, snapshot Snapshot, upTime *uint64) (Snapshot, bool) {
+	mode := settings.counterResets
+	if mode == "" || mode == CounterResetsNone {
+		return snapshot, false
+	}
+
+	t := &fd.counterTracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.loaded {
+		t.state = fd.loadCounterState()
+		t.loaded = true
+	}
+
+	s := &t.state
+	if s.Last == nil {
+		s.Last = map[string]float64{}
+	}
+	if s.Offsets == nil {
+		s.Offsets = map[string]float64{}
+	}
+
+	seen := len(s.Last) != 0
+	restarted := seen && upTime != nil && *upTime < s.UpTime
+	for _, m := range snapshot.Metrics {
+		if !isFluentBitCounter(m) {
+			continue
+		}
+
+		for _, sample := range m.Samples {
+			if last, ok := s.Last[seriesKey(m, sample)]; ok && sample.Value < last {
+				restarted = true
+			}
+		}
+	}
+
+	if restarted || s.StartTime.IsZero() {
+		s.StartTime = snapshot.Time
+		if upTime != nil {
+			s.StartTime = snapshot.Time.Add(-time.Duration(*upTime) * time.Second).Truncate(time.Second)
+		}
+	}
+	if upTime != nil {
+		s.UpTime = *upTime
+	}
+
+	if restarted {
+		s.Restarts++
+		fd.emit(Event{Kind: EventFluentBitRestarted})
+	}
+
+	metrics := make([]Metric, len(snapshot.Metrics))
+	for i, m := range snapshot.Metrics {
+		if !isFluentBitCounter(m) {
+			metrics[i] = m
+			continue
+		}
+
+		samples := make([]Sample, len(m.Samples))
+		for j, sample := range m.Samples {
+			key := seriesKey(m, sample)
+			if last, ok := s.Last[key]; ok && (restarted || sample.Value < last) {
+				s.Offsets[key] += last
+			}
+			s.Last[key] = sample.Value
+
+			if mode == CounterResetsAdjust {
+				sample.Value += s.Offsets[key]
+			}
+			samples[j] = sample
+		}
+
+		m.Samples = samples
+		metrics[i] = m
+	}
+
+	if mode == CounterResetsMarker {
+		restarts := Metric{
+			Namespace: "fluentbit",
+			Name:      "restarts_total",
+			Help:      "Fluent Bit restarts detected by the forwarder",
+			Type:      MetricCounter,
+		}
+		restarts.add(float64(s.Restarts))
+
+		startTime := Metric{
+			Namespace: "fluentbit",
+			Name:      "start_time_seconds",
+			Help:      "Unix time Fluent Bit started at",
+			Type:      MetricGauge,
+		}
+		startTime.add(unixSeconds(s.StartTime))
+
+		metrics = append(metrics, restarts, startTime)
+	}
+
+	snapshot.Metrics = metrics
+	fd.storeCounterState(*s)
+	return snapshot, restarted
+}
+
+// isFluentBitCounter tells whether the metric is a counter from Fluent Bit,
+// as opposed to one from the forwarder itself.
+func isFluentBitCounter(m Metric) bool {
+	return m.Type == MetricCounter && m.Namespace == "fluentbit"
+}
+
+func seriesKey(m Metric, sample Sample) string {
+	return m.FullName() + "{" + strings.Join(sample.LabelValues, ",") + "}"
+}
+
+func (fd *Forwarder) loadCounterState() counterState {
+	var out counterState
+	if fd.Store == nil || !fd.Store.Has(fd.countersStoreKey()) {
+		return out
+	}
+
+	b, err := fd.Store.Read(fd.countersStoreKey())
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&out)
+	}
+	if err != nil {
+		_ = level.Warn(fd.Logger).Log("msg", "could not load counters; starting over", "err", err)
+		return counterState{}
+	}
+
+	return out
+}
+
+func (fd *Forwarder) storeCounterState(s counterState) {
+	if fd.Store == nil {
+		return
+	}
+
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(s)
+	if err == nil {
+		err = fd.Store.Write(fd.countersStoreKey(), buff.Bytes())
+	}
+	if err != nil {
+		_ = level.Warn(fd.Logger).Log("msg", "could not store counters", "err", err)
+	}
+}
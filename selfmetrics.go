@@ -0,0 +1,298 @@
+package forwarder
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pushResultSuccess = "success"
+	pushResultFailure = "failure"
+
+	fetchEndpointBuildInfo = "build_info"
+	fetchEndpointMetrics   = "metrics"
+	fetchEndpointStorage   = "storage"
+	fetchEndpointUpTime    = "uptime"
+)
+
+var fetchEndpoints = []string{fetchEndpointBuildInfo, fetchEndpointMetrics, fetchEndpointStorage, fetchEndpointUpTime}
+
+var (
+	pushDurationBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10}
+	payloadSizeBuckets  = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+)
+
+// selfMetrics tracks the forwarder own operation.
+// Pushes are tracked by sink name.
+// The zero value is ready to use.
+type selfMetrics struct {
+	mu                 sync.Mutex
+	sinks              map[string]*sinkSelfMetrics
+	fluentBitFetchErrs map[string]uint64
+}
+
+type sinkSelfMetrics struct {
+	pushes          map[string]uint64
+	pushDuration    histogram
+	payloadSize     histogram
+	lastPushSuccess time.Time
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+
+	for i, le := range buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *selfMetrics) observePush(sink string, d time.Duration, payloadSize int, err error, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sinks == nil {
+		m.sinks = map[string]*sinkSelfMetrics{}
+	}
+
+	sm, ok := m.sinks[sink]
+	if !ok {
+		sm = &sinkSelfMetrics{pushes: map[string]uint64{}}
+		m.sinks[sink] = sm
+	}
+
+	result := pushResultSuccess
+	if err != nil {
+		result = pushResultFailure
+	} else {
+		sm.lastPushSuccess = now
+	}
+
+	sm.pushes[result]++
+	sm.pushDuration.observe(pushDurationBuckets, d.Seconds())
+	sm.payloadSize.observe(payloadSizeBuckets, float64(payloadSize))
+}
+
+// sinkNames pushed to, sorted. Cloud is always included.
+func (m *selfMetrics) sinkNames() []string {
+	names := []string{CloudSinkName}
+	for name := range m.sinks {
+		if name != CloudSinkName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sink metrics by name, the zero value if not pushed yet.
+func (m *selfMetrics) sink(name string) sinkSelfMetrics {
+	if sm, ok := m.sinks[name]; ok {
+		return *sm
+	}
+
+	return sinkSelfMetrics{}
+}
+
+func (m *selfMetrics) observeFetchErr(endpoint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fluentBitFetchErrs == nil {
+		m.fluentBitFetchErrs = map[string]uint64{}
+	}
+
+	m.fluentBitFetchErrs[endpoint]++
+}
+
+// appendTo appends the self metrics under the "forwarder" namespace.
+func (m *selfMetrics) appendTo(metrics []Metric) []Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := m.sinkNames()
+
+	pushes := Metric{
+		Namespace: "forwarder",
+		Subsystem: "push",
+		Name:      "total",
+		Help:      "Metrics pushes by sink and result",
+		Type:      MetricCounter,
+		LabelKeys: []string{"sink", "result"},
+	}
+	for _, name := range names {
+		sm := m.sink(name)
+		for _, result := range []string{pushResultSuccess, pushResultFailure} {
+			pushes.add(float64(sm.pushes[result]), name, result)
+		}
+	}
+
+	metrics = append(metrics, pushes)
+
+	durations := make([]histogram, len(names))
+	payloadSizes := make([]histogram, len(names))
+	for i, name := range names {
+		durations[i] = m.sink(name).pushDuration
+		payloadSizes[i] = m.sink(name).payloadSize
+	}
+	metrics = appendHistogram(metrics, "push", "duration_seconds", "Metrics push duration by sink", pushDurationBuckets, names, durations)
+	metrics = appendHistogram(metrics, "push", "payload_bytes", "Metrics push payload size before compression by sink", payloadSizeBuckets, names, payloadSizes)
+
+	lastSuccess := Metric{
+		Namespace: "forwarder",
+		Subsystem: "push",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful metrics push by sink",
+		Type:      MetricGauge,
+		LabelKeys: []string{"sink"},
+	}
+	for _, name := range names {
+		lastSuccess.add(unixSeconds(m.sink(name).lastPushSuccess), name)
+	}
+
+	fetchErrs := Metric{
+		Namespace: "forwarder",
+		Subsystem: "fluentbit",
+		Name:      "fetch_errors_total",
+		Help:      "Fluent Bit API fetch errors by endpoint",
+		Type:      MetricCounter,
+		LabelKeys: []string{"endpoint"},
+	}
+	for _, endpoint := range fetchEndpoints {
+		fetchErrs.add(float64(m.fluentBitFetchErrs[endpoint]), endpoint)
+	}
+
+	return append(metrics, lastSuccess, fetchErrs)
+}
+
+// appendHistogram of each sink, given in the same order as their histograms.
+func appendHistogram(metrics []Metric, subsystem, name, help string, buckets []float64, sinks []string, hs []histogram) []Metric {
+	bucket := Metric{
+		Namespace: "forwarder",
+		Subsystem: subsystem,
+		Name:      name + "_bucket",
+		Help:      help,
+		Type:      MetricCounter,
+		LabelKeys: []string{"sink", "le"},
+	}
+	sum := Metric{Namespace: "forwarder", Subsystem: subsystem, Name: name + "_sum", Help: help, Type: MetricCounter, LabelKeys: []string{"sink"}}
+	count := Metric{Namespace: "forwarder", Subsystem: subsystem, Name: name + "_count", Help: help, Type: MetricCounter, LabelKeys: []string{"sink"}}
+	for j, h := range hs {
+		for i, le := range buckets {
+			var c uint64
+			if h.counts != nil {
+				c = h.counts[i]
+			}
+			bucket.add(float64(c), sinks[j], formatFloat(le))
+		}
+		bucket.add(float64(h.count), sinks[j], "+Inf")
+		sum.add(h.sum, sinks[j])
+		count.add(float64(h.count), sinks[j])
+	}
+
+	return append(metrics, bucket, sum, count)
+}
+
+// writeTo writes the self metrics in Prometheus text exposition format.
+func (m *selfMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := m.sinkNames()
+
+	fmt.Fprintln(w, "# HELP forwarder_push_total Metrics pushes by sink and result.")
+	fmt.Fprintln(w, "# TYPE forwarder_push_total counter")
+	for _, name := range names {
+		sm := m.sink(name)
+		for _, result := range []string{pushResultSuccess, pushResultFailure} {
+			fmt.Fprintf(w, "forwarder_push_total{sink=%q,result=%q} %d\n", name, result, sm.pushes[result])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP forwarder_push_duration_seconds Metrics push duration by sink.")
+	fmt.Fprintln(w, "# TYPE forwarder_push_duration_seconds histogram")
+	for _, name := range names {
+		writeHistogram(w, "forwarder_push_duration_seconds", name, pushDurationBuckets, m.sink(name).pushDuration)
+	}
+
+	fmt.Fprintln(w, "# HELP forwarder_push_payload_bytes Metrics push payload size before compression by sink.")
+	fmt.Fprintln(w, "# TYPE forwarder_push_payload_bytes histogram")
+	for _, name := range names {
+		writeHistogram(w, "forwarder_push_payload_bytes", name, payloadSizeBuckets, m.sink(name).payloadSize)
+	}
+
+	fmt.Fprintln(w, "# HELP forwarder_push_last_success_timestamp_seconds Unix time of the last successful metrics push by sink.")
+	fmt.Fprintln(w, "# TYPE forwarder_push_last_success_timestamp_seconds gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "forwarder_push_last_success_timestamp_seconds{sink=%q} %s\n", name, formatFloat(unixSeconds(m.sink(name).lastPushSuccess)))
+	}
+
+	fmt.Fprintln(w, "# HELP forwarder_fluentbit_fetch_errors_total Fluent Bit API fetch errors by endpoint.")
+	fmt.Fprintln(w, "# TYPE forwarder_fluentbit_fetch_errors_total counter")
+	for _, endpoint := range fetchEndpoints {
+		fmt.Fprintf(w, "forwarder_fluentbit_fetch_errors_total{endpoint=%q} %d\n", endpoint, m.fluentBitFetchErrs[endpoint])
+	}
+}
+
+// writeHistogram samples of a sink, without the HELP and TYPE lines.
+func writeHistogram(w io.Writer, name, sink string, buckets []float64, h histogram) {
+	for i, le := range buckets {
+		var count uint64
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{sink=%q,le=%q} %d\n", name, sink, formatFloat(le), count)
+	}
+	fmt.Fprintf(w, "%s_bucket{sink=%q,le=\"+Inf\"} %d\n", name, sink, h.count)
+	fmt.Fprintf(w, "%s_sum{sink=%q} %s\n", name, sink, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{sink=%q} %d\n", name, sink, h.count)
+}
+
+// MetricsHandler serves the forwarder own metrics
+// in Prometheus text exposition format.
+func (fd *Forwarder) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fd.selfMetrics.writeTo(w)
+
+		fmt.Fprintln(w, "# HELP forwarder_events_dropped_total Events dropped because a subscriber did not keep up.")
+		fmt.Fprintln(w, "# TYPE forwarder_events_dropped_total counter")
+		fmt.Fprintf(w, "forwarder_events_dropped_total %d\n", fd.events.droppedCount())
+
+		size, dropped := fd.bufferStats()
+		fmt.Fprintln(w, "# HELP forwarder_buffer_payloads Payloads buffered to be retried.")
+		fmt.Fprintln(w, "# TYPE forwarder_buffer_payloads gauge")
+		fmt.Fprintf(w, "forwarder_buffer_payloads %d\n", size)
+		fmt.Fprintln(w, "# HELP forwarder_buffer_dropped_total Buffered payloads dropped because the buffer was full.")
+		fmt.Fprintln(w, "# TYPE forwarder_buffer_dropped_total counter")
+		fmt.Fprintf(w, "forwarder_buffer_dropped_total %d\n", dropped)
+	})
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,318 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CloudSinkName is the name of the sink pushing to Calyptia Cloud.
+const CloudSinkName = "cloud"
+
+// Sink receives the snapshot collected on each interval.
+// Each sink is pushed from its own goroutine with its own retries and buffer,
+// so a slow or failing sink does not hold back the others.
+type Sink interface {
+	// Name identifies the sink on events.
+	// It must be unique within the forwarder.
+	Name() string
+	Push(ctx context.Context, snapshot Snapshot) (PushResult, error)
+}
+
+// PayloadSink is a Sink taking the payloads sent to Cloud instead of the snapshots.
+// After each successful push to Cloud, buffered ones included, it is pushed
+// the payload as sent, along with its snapshot, from the Cloud sink goroutine.
+// Failed pushes are reported but neither retried nor buffered.
+type PayloadSink interface {
+	Sink
+	PushPayload(ctx context.Context, snapshot Snapshot, payload []byte) (PushResult, error)
+}
+
+// PushResult of a successful push, reported on events.
+type PushResult struct {
+	// Inserted number of metrics, if the sink reports it.
+	Inserted int
+	// PayloadSize in bytes before compression.
+	PayloadSize int
+}
+
+// SinkError tells whether a failed push could succeed if retried.
+// Retryable errors are retried with backoff and then buffered.
+// Other errors returned by a sink, like network errors,
+// are not retried right away, but buffered for the next intervals.
+type SinkError struct {
+	Err       error
+	Retryable bool
+	// RetryAfter is the min time to wait before retrying.
+	RetryAfter time.Duration
+}
+
+func (e *SinkError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// validateSinks checks sink names are unique.
+func validateSinks(sinks []Sink) error {
+	names := map[string]struct{}{CloudSinkName: {}}
+	for _, sink := range sinks {
+		name := sink.Name()
+		if _, ok := names[name]; ok {
+			return fmt.Errorf("duplicated sink name %q", name)
+		}
+
+		names[name] = struct{}{}
+	}
+
+	return nil
+}
+
+// sinkRunners pushes snapshots to each sink from its own goroutine.
+// Runners and their buffers are kept across reloads and Forward calls.
+// The zero value is ready to use.
+type sinkRunners struct {
+	mu      sync.Mutex
+	runners map[string]*sinkRunner
+	// wg of the running runSink goroutines.
+	wg sync.WaitGroup
+}
+
+type sinkRunner struct {
+	// queue holds the next snapshot while the previous one is being pushed.
+	queue  chan sinkJob
+	buffer snapshotBuffer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type sinkJob struct {
+	sink     Sink
+	snapshot Snapshot
+}
+
+// dispatch the snapshot to every sink without blocking,
+// with the counter series configured for each one.
+// If a sink is still busy, the snapshot gets buffered.
+// Runners of sinks no longer configured are stopped.
+func (fd *Forwarder) dispatch(ctx context.Context, settings settings, sinks []Sink, snapshot Snapshot) {
+	fd.sinkRunners.mu.Lock()
+	defer fd.sinkRunners.mu.Unlock()
+
+	if fd.sinkRunners.runners == nil {
+		fd.sinkRunners.runners = map[string]*sinkRunner{}
+	}
+
+	current := map[string]struct{}{}
+	for _, sink := range sinks {
+		name := sink.Name()
+		current[name] = struct{}{}
+
+		r, ok := fd.sinkRunners.runners[name]
+		if !ok {
+			r = &sinkRunner{queue: make(chan sinkJob, 1)}
+			fd.sinkRunners.runners[name] = r
+		}
+
+		// Started again if the previous Forward call is done.
+		if r.ctx == nil || r.ctx.Err() != nil {
+			r.ctx, r.cancel = context.WithCancel(ctx)
+			fd.sinkRunners.wg.Add(1)
+			go fd.runSink(r.ctx, r)
+		}
+
+		s := sinkCounterSeries(snapshot, settings.sinkCounterSeries[name])
+		select {
+		case r.queue <- sinkJob{sink: sink, snapshot: s}:
+		default:
+			r.buffer.push(s, settings.bufferSize)
+		}
+	}
+
+	for name, r := range fd.sinkRunners.runners {
+		if _, ok := current[name]; !ok {
+			r.cancel()
+			delete(fd.sinkRunners.runners, name)
+		}
+	}
+}
+
+func (fd *Forwarder) runSink(ctx context.Context, r *sinkRunner) {
+	defer fd.sinkRunners.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-r.queue:
+			settings := fd.settings()
+			pushCtx, cancel := context.WithTimeout(ctx, settings.interval)
+			fd.push(pushCtx, settings, r, job)
+			cancel()
+		}
+	}
+}
+
+// push sends the buffered snapshots first, oldest first, and then the given one.
+// Buffered snapshots stop being drained once one fails with a retryable error,
+// but the given one is still tried.
+// Snapshots that fail with a retryable error are buffered for the next interval.
+func (fd *Forwarder) push(ctx context.Context, settings settings, r *sinkRunner, job sinkJob) {
+	for {
+		buffered, ok := r.buffer.shift()
+		if !ok {
+			break
+		}
+
+		err := fd.pushWithRetry(ctx, job.sink, buffered)
+		if err != nil && shouldBuffer(err) {
+			r.buffer.unshift(buffered, settings.bufferSize)
+			break
+		}
+	}
+
+	err := fd.pushWithRetry(ctx, job.sink, job.snapshot)
+	if err != nil && shouldBuffer(err) && settings.bufferSize > 0 {
+		r.buffer.push(job.snapshot, settings.bufferSize)
+	}
+}
+
+// shouldBuffer tells whether the snapshot failed to be pushed with an error
+// that could go away by retrying later, like a network error or a 5xx.
+func shouldBuffer(err error) bool {
+	var e *SinkError
+	if errors.As(err, &e) {
+		return e.Retryable
+	}
+
+	return true
+}
+
+// pushWithRetry pushes the snapshot to the sink,
+// retrying with backoff while the error is retryable and the context allows it.
+// Each attempt is reported as an event.
+func (fd *Forwarder) pushWithRetry(ctx context.Context, sink Sink, snapshot Snapshot) error {
+	name := sink.Name()
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		result, err := sink.Push(ctx, snapshot)
+		duration := time.Since(start)
+		fd.selfMetrics.observePush(name, duration, result.PayloadSize, err, fd.now())
+		if err == nil {
+			// Readiness only tracks Cloud pushes.
+			if name == CloudSinkName {
+				fd.state.setPushed(fd.now())
+			}
+			fd.emit(Event{
+				Kind:        EventPushSucceeded,
+				Sink:        name,
+				Attempt:     attempt,
+				Inserted:    result.Inserted,
+				PayloadSize: result.PayloadSize,
+				Duration:    duration,
+			})
+			if name == CloudSinkName && fd.state.setCloudPushed() {
+				fd.emit(Event{Kind: EventPushRecovered, Sink: name})
+			}
+			return nil
+		}
+
+		pushErr := fmt.Errorf("could not push metrics to %s: %w", name, err)
+		fd.emit(Event{
+			Kind:        EventPushFailed,
+			Stage:       StagePush,
+			Sink:        name,
+			Attempt:     attempt,
+			PayloadSize: result.PayloadSize,
+			Duration:    duration,
+			Err:         pushErr,
+		})
+		if name == CloudSinkName && fd.state.setCloudPushFailed(fd.now(), fd.readyPushWindow()) {
+			fd.emit(Event{Kind: EventPushFailing, Stage: StagePush, Sink: name, Err: pushErr})
+		}
+
+		var e *SinkError
+		if !errors.As(err, &e) || !e.Retryable || attempt >= maxPushAttempts {
+			return err
+		}
+
+		wait := pushRetryBackoff * time.Duration(1<<(attempt-1))
+		if e.RetryAfter > wait {
+			wait = e.RetryAfter
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// pushPayload sent to Cloud to every PayloadSink.
+// Each push is reported as an event.
+func (fd *Forwarder) pushPayload(ctx context.Context, snapshot Snapshot, payload []byte) {
+	for _, sink := range fd.settings().sinks {
+		ps, ok := sink.(PayloadSink)
+		if !ok {
+			continue
+		}
+
+		name := sink.Name()
+		start := time.Now()
+		result, err := ps.PushPayload(ctx, snapshot, payload)
+		duration := time.Since(start)
+		fd.selfMetrics.observePush(name, duration, result.PayloadSize, err, fd.now())
+		if err != nil {
+			fd.emit(Event{
+				Kind:        EventPushFailed,
+				Stage:       StagePush,
+				Sink:        name,
+				Attempt:     1,
+				PayloadSize: result.PayloadSize,
+				Duration:    duration,
+				Err:         fmt.Errorf("could not push metrics to %s: %w", name, err),
+			})
+			continue
+		}
+
+		fd.emit(Event{
+			Kind:        EventPushSucceeded,
+			Sink:        name,
+			Attempt:     1,
+			Inserted:    result.Inserted,
+			PayloadSize: result.PayloadSize,
+			Duration:    duration,
+		})
+	}
+}
+
+// truncate every sink buffer to the given limit.
+func (s *sinkRunners) truncate(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.runners {
+		r.buffer.truncate(limit)
+	}
+}
+
+// bufferStats across all sinks.
+func (fd *Forwarder) bufferStats() (size int, dropped uint64) {
+	fd.sinkRunners.mu.Lock()
+	defer fd.sinkRunners.mu.Unlock()
+
+	for _, r := range fd.sinkRunners.runners {
+		n, d := r.buffer.stats()
+		size += n
+		dropped += d
+	}
+
+	return size, dropped
+}
@@ -0,0 +1,395 @@
+package sinks
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+// ArchiveFormat of the archive files.
+type ArchiveFormat string
+
+const (
+	// ArchiveFormatMsgPack writes each record as a msgpack map.
+	ArchiveFormatMsgPack ArchiveFormat = "msgpack"
+	// ArchiveFormatNDJSON writes each record as a JSON line.
+	ArchiveFormatNDJSON ArchiveFormat = "ndjson"
+)
+
+var ArchiveFormatMap = map[string]ArchiveFormat{
+	string(ArchiveFormatMsgPack): ArchiveFormatMsgPack,
+	string(ArchiveFormatNDJSON):  ArchiveFormatNDJSON,
+}
+
+const (
+	archiveBaseName   = "metrics"
+	archiveTimeLayout = "20060102T150405.000000000"
+)
+
+// ArchiveRecord of a payload sent to Cloud.
+type ArchiveRecord struct {
+	Time      time.Time `json:"time"`
+	MachineID string    `json:"machineID"`
+	AgentID   string    `json:"agentID,omitempty"`
+	// Payload is the cmetrics msgpack as sent, before compression.
+	Payload []byte `json:"payload"`
+}
+
+// Archive writes each payload sent to Cloud to a file per machine ID
+// on a directory, like "metrics.<machine ID>.msgpack" or ".ndjson",
+// so agents sharing the directory do not rotate each other files.
+// As a forwarder.PayloadSink, it only gets the payloads Cloud accepted.
+// Pushed a snapshot instead, it encodes it as the Cloud payload.
+// The file is rotated once it reaches a max size or age,
+// into a file named after the rotation time, like
+// "metrics.<machine ID>.20210901T000000.000000000.msgpack", optionally gzipped.
+// Rotation happens on push, using the snapshot time.
+type Archive struct {
+	Dir string
+	// Format defaults to msgpack.
+	Format ArchiveFormat
+	// MaxSize in bytes of the file before being rotated. Zero means no limit.
+	MaxSize int64
+	// MaxAge of the file before being rotated. Zero means no limit.
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files to keep,
+	// the older ones being removed. Zero keeps them all.
+	MaxFiles int
+	// Compress rotated files with gzip.
+	Compress bool
+
+	mu sync.Mutex
+	// created is the time the current file of each machine ID was created, if any.
+	created map[string]time.Time
+}
+
+func (a *Archive) Name() string {
+	return "archive:" + a.Dir
+}
+
+func (a *Archive) Push(ctx context.Context, snapshot forwarder.Snapshot) (forwarder.PushResult, error) {
+	payload, err := forwarder.EncodeCMetrics(snapshot)
+	if err != nil {
+		return forwarder.PushResult{}, &forwarder.SinkError{Err: fmt.Errorf("could not transform snapshot into cmetrics msgpack: %w", err)}
+	}
+
+	return a.PushPayload(ctx, snapshot, payload)
+}
+
+func (a *Archive) PushPayload(ctx context.Context, snapshot forwarder.Snapshot, payload []byte) (forwarder.PushResult, error) {
+	record := ArchiveRecord{
+		Time:      snapshot.Time,
+		MachineID: snapshot.MachineID,
+		AgentID:   snapshot.AgentID,
+		Payload:   payload,
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if a.format() == ArchiveFormatNDJSON {
+		b, err = json.Marshal(record)
+		if err != nil {
+			return forwarder.PushResult{}, &forwarder.SinkError{Err: fmt.Errorf("could not json marshal record: %w", err)}
+		}
+
+		b = append(b, '\n')
+	} else {
+		b = appendMsgPackRecord(nil, record)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err = os.MkdirAll(a.Dir, 0o755)
+	if err != nil {
+		return forwarder.PushResult{}, fmt.Errorf("could not create dir: %w", err)
+	}
+
+	name := archiveName(snapshot.MachineID)
+	err = a.rotate(name, snapshot.Time)
+	if err != nil {
+		return forwarder.PushResult{}, err
+	}
+
+	file, err := os.OpenFile(a.path(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return forwarder.PushResult{}, fmt.Errorf("could not open file: %w", err)
+	}
+
+	_, err = file.Write(b)
+	if err != nil {
+		_ = file.Close()
+		return forwarder.PushResult{}, fmt.Errorf("could not write file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return forwarder.PushResult{}, fmt.Errorf("could not close file: %w", err)
+	}
+
+	if a.created[name].IsZero() {
+		a.setCreated(name, snapshot.Time)
+	}
+
+	return forwarder.PushResult{PayloadSize: len(b)}, nil
+}
+
+func (a *Archive) format() ArchiveFormat {
+	if a.Format == "" {
+		return ArchiveFormatMsgPack
+	}
+
+	return a.Format
+}
+
+// archiveName of the files of the machine ID, without extension.
+// Characters other than letters, digits, "_" and "-" are replaced with "_",
+// so the name is a valid file name and "." only separates its parts.
+func archiveName(machineID string) string {
+	return archiveBaseName + "." + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, machineID)
+}
+
+// path of the current file with the given name.
+func (a *Archive) path(name string) string {
+	return filepath.Join(a.Dir, name+"."+string(a.format()))
+}
+
+func (a *Archive) setCreated(name string, t time.Time) {
+	if a.created == nil {
+		a.created = map[string]time.Time{}
+	}
+
+	a.created[name] = t
+}
+
+// rotate the current file with the given name if it reached its max size or age,
+// and remove its rotated files exceeding the retention.
+func (a *Archive) rotate(name string, now time.Time) error {
+	info, err := os.Stat(a.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		delete(a.created, name)
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not stat file: %w", err)
+	}
+
+	// A file left by a previous run is aged from now on.
+	if a.created[name].IsZero() {
+		a.setCreated(name, now)
+	}
+
+	tooBig := a.MaxSize > 0 && info.Size() >= a.MaxSize
+	tooOld := a.MaxAge > 0 && now.Sub(a.created[name]) >= a.MaxAge
+	if !tooBig && !tooOld {
+		return nil
+	}
+
+	rotated := filepath.Join(a.Dir, name+"."+now.UTC().Format(archiveTimeLayout)+"."+string(a.format()))
+	err = os.Rename(a.path(name), rotated)
+	if err != nil {
+		return fmt.Errorf("could not rotate file: %w", err)
+	}
+
+	delete(a.created, name)
+
+	if a.Compress {
+		err = gzipFile(rotated)
+		if err != nil {
+			return fmt.Errorf("could not compress rotated file: %w", err)
+		}
+	}
+
+	return a.prune(name)
+}
+
+// prune the oldest rotated files with the given name beyond MaxFiles.
+func (a *Archive) prune(name string) error {
+	if a.MaxFiles <= 0 {
+		return nil
+	}
+
+	files, err := archiveFiles(a.Dir)
+	if err != nil {
+		return err
+	}
+
+	var rotated []string
+	for _, f := range files {
+		if f != a.path(name) && strings.HasPrefix(filepath.Base(f), name+".") {
+			rotated = append(rotated, f)
+		}
+	}
+
+	for len(rotated) > a.MaxFiles {
+		err = os.Remove(rotated[0])
+		if err != nil {
+			return fmt.Errorf("could not remove rotated file: %w", err)
+		}
+
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+// gzipFile replaces the file with a gzipped one with a ".gz" suffix.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// archiveFiles on the directory from the oldest to the current one.
+func archiveFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read dir: %w", err)
+	}
+
+	var out []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, archiveBaseName) {
+			continue
+		}
+
+		if _, ok := archiveFileFormat(name); ok {
+			out = append(out, filepath.Join(dir, name))
+		}
+	}
+
+	// Rotated files sort by time, and before the current one
+	// since digits sort before the extension.
+	sort.Strings(out)
+	return out, nil
+}
+
+// archiveFileFormat from the file name extension.
+func archiveFileFormat(name string) (ArchiveFormat, bool) {
+	name = strings.TrimSuffix(name, ".gz")
+	for _, format := range ArchiveFormatMap {
+		if strings.HasSuffix(name, "."+string(format)) {
+			return format, true
+		}
+	}
+
+	return "", false
+}
+
+// ReadArchive calls fn with each record archived on the directory,
+// from the oldest file to the current one.
+// Gzipped files are decompressed.
+func ReadArchive(dir string, fn func(ArchiveRecord) error) error {
+	files, err := archiveFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		err = readArchiveFile(path, fn)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+	}
+
+	return nil
+}
+
+func readArchiveFile(path string, fn func(ArchiveRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("could not create gzip reader: %w", err)
+		}
+
+		defer zr.Close()
+		r = zr
+	}
+
+	format, _ := archiveFileFormat(filepath.Base(path))
+	br := bufio.NewReader(r)
+	for {
+		var record ArchiveRecord
+		if format == ArchiveFormatNDJSON {
+			line, err := br.ReadBytes('\n')
+			if err == io.EOF && len(line) == 0 {
+				return nil
+			}
+
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("could not read line: %w", err)
+			}
+
+			err = json.Unmarshal(line, &record)
+			if err != nil {
+				return fmt.Errorf("could not json unmarshal record: %w", err)
+			}
+		} else {
+			if _, err := br.Peek(1); err == io.EOF {
+				return nil
+			}
+
+			record, err = readMsgPackRecord(br)
+			if err != nil {
+				return fmt.Errorf("could not decode record: %w", err)
+			}
+		}
+
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package sinks_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
+)
+
+var _ forwarder.PayloadSink = (*sinks.Archive)(nil)
+
+func TestArchive(t *testing.T) {
+	for _, format := range []sinks.ArchiveFormat{sinks.ArchiveFormatMsgPack, sinks.ArchiveFormatNDJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			dir := t.TempDir()
+			sink := &sinks.Archive{
+				Dir:      dir,
+				Format:   format,
+				MaxAge:   time.Minute,
+				MaxFiles: 2,
+				Compress: true,
+			}
+
+			// One snapshot every 30 seconds, rotated every 2.
+			snapshot := testSnapshot()
+			start := snapshot.Time
+			for i := 0; i < 8; i++ {
+				snapshot.Time = start.Add(time.Duration(i) * time.Second * 30)
+				_, err := sink.Push(context.Background(), snapshot)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			matches, err := filepath.Glob(filepath.Join(dir, "metrics*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantFiles := []string{
+				filepath.Join(dir, "metrics.machine-id.20210901T000200.000000000."+string(format)+".gz"),
+				filepath.Join(dir, "metrics.machine-id.20210901T000300.000000000."+string(format)+".gz"),
+				filepath.Join(dir, "metrics.machine-id."+string(format)),
+			}
+			if want, got := wantFiles, matches; !equalStrings(want, got) {
+				t.Fatalf("want files %v; got %v", want, got)
+			}
+
+			wantPayload, err := forwarder.EncodeCMetrics(snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var records []sinks.ArchiveRecord
+			err = sinks.ReadArchive(dir, func(record sinks.ArchiveRecord) error {
+				records = append(records, record)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The first rotated file was removed.
+			if want, got := 6, len(records); want != got {
+				t.Fatalf("want %d records; got %d", want, got)
+			}
+
+			last := records[len(records)-1]
+			if want, got := snapshot.Time, last.Time; !want.Equal(got) {
+				t.Errorf("want time %v; got %v", want, got)
+			}
+
+			if want, got := "machine-id", last.MachineID; want != got {
+				t.Errorf("want machine ID %q; got %q", want, got)
+			}
+
+			if want, got := "agent-id", last.AgentID; want != got {
+				t.Errorf("want agent ID %q; got %q", want, got)
+			}
+
+			if !bytes.Equal(wantPayload, last.Payload) {
+				t.Errorf("want payload as pushed to cloud; got %d bytes", len(last.Payload))
+			}
+		})
+	}
+
+	t.Run("max_size", func(t *testing.T) {
+		dir := t.TempDir()
+		sink := &sinks.Archive{Dir: dir, MaxSize: 1}
+
+		snapshot := testSnapshot()
+		for i := 0; i < 3; i++ {
+			snapshot.Time = snapshot.Time.Add(time.Second)
+			_, err := sink.Push(context.Background(), snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := 3, len(entries); want != got {
+			t.Errorf("want %d files; got %d", want, got)
+		}
+	})
+
+	t.Run("machine_ids", func(t *testing.T) {
+		// Agents sharing the directory, each with its own sink,
+		// only rotate and prune their own files.
+		dir := t.TempDir()
+		for _, machineID := range []string{"a", "a.b", "a-b"} {
+			sink := &sinks.Archive{Dir: dir, MaxSize: 1, MaxFiles: 1}
+			snapshot := testSnapshot()
+			snapshot.MachineID = machineID
+			for i := 0; i < 3; i++ {
+				snapshot.Time = snapshot.Time.Add(time.Second)
+				_, err := sink.Push(context.Background(), snapshot)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		matches, err := filepath.Glob(filepath.Join(dir, "metrics*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantFiles := []string{
+			filepath.Join(dir, "metrics.a-b.20210901T000003.000000000.msgpack"),
+			filepath.Join(dir, "metrics.a-b.msgpack"),
+			filepath.Join(dir, "metrics.a.20210901T000003.000000000.msgpack"),
+			filepath.Join(dir, "metrics.a.msgpack"),
+			filepath.Join(dir, "metrics.a_b.20210901T000003.000000000.msgpack"),
+			filepath.Join(dir, "metrics.a_b.msgpack"),
+		}
+		if want, got := wantFiles, matches; !equalStrings(want, got) {
+			t.Fatalf("want files %v; got %v", want, got)
+		}
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,54 @@
+// Package sinks provides forwarder sinks other than Calyptia Cloud.
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+// File appends each snapshot as a JSON line to a file.
+// The file is opened on each push, so it can be rotated by moving it away.
+type File struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (f *File) Name() string {
+	return "file:" + f.Path
+}
+
+func (f *File) Push(ctx context.Context, snapshot forwarder.Snapshot) (forwarder.PushResult, error) {
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return forwarder.PushResult{}, &forwarder.SinkError{Err: fmt.Errorf("could not json marshal snapshot: %w", err)}
+	}
+
+	b = append(b, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return forwarder.PushResult{}, fmt.Errorf("could not open file: %w", err)
+	}
+
+	_, err = file.Write(b)
+	if err != nil {
+		_ = file.Close()
+		return forwarder.PushResult{}, fmt.Errorf("could not write file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return forwarder.PushResult{}, fmt.Errorf("could not close file: %w", err)
+	}
+
+	return forwarder.PushResult{PayloadSize: len(b)}, nil
+}
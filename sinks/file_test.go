@@ -0,0 +1,92 @@
+package sinks_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
+)
+
+var _ forwarder.Sink = (*sinks.File)(nil)
+
+func TestFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.ndjson")
+	sink := &sinks.File{Path: path}
+
+	snapshot := testSnapshot()
+	for i := 0; i < 2; i++ {
+		_, err := sink.Push(context.Background(), snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+
+		var got forwarder.Snapshot
+		err := json.Unmarshal(scanner.Bytes(), &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !got.Time.Equal(snapshot.Time) || got.MachineID != snapshot.MachineID || len(got.Metrics) != len(snapshot.Metrics) {
+			t.Errorf("unexpected snapshot %+v", got)
+		}
+	}
+
+	if want, got := 2, lines; want != got {
+		t.Errorf("want %d lines; got %d", want, got)
+	}
+}
+
+func testSnapshot() forwarder.Snapshot {
+	return forwarder.Snapshot{
+		Time:             time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC),
+		AgentID:          "agent-id",
+		Hostname:         "test",
+		MachineID:        "machine-id",
+		FluentBitVersion: "1.8.6",
+		Labels:           map[string]string{"env": "prod"},
+		Metrics: []forwarder.Metric{
+			{
+				Namespace: "fluentbit",
+				Subsystem: "input",
+				Name:      "records",
+				Type:      forwarder.MetricCounter,
+				LabelKeys: []string{"plugin"},
+				Samples:   []forwarder.Sample{{LabelValues: []string{"dummy.0"}, Value: 10}},
+			},
+			{
+				Namespace: "fluentbit",
+				Subsystem: "storage",
+				Name:      "mem_chunks",
+				Type:      forwarder.MetricGauge,
+				LabelKeys: []string{"plugin"},
+				Samples:   []forwarder.Sample{{LabelValues: []string{"chunks"}, Value: 2}},
+			},
+		},
+	}
+}
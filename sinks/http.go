@@ -0,0 +1,61 @@
+package sinks
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+// maxErrorBodySnippet is the max number of bytes of an error response
+// included in the error message.
+const maxErrorBodySnippet = 512
+
+// statusError of an endpoint responding with a status code >= 400.
+// 5xx, 408 and 429 are retryable, other 4xx are not.
+func statusError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySnippet))
+
+	err := fmt.Errorf("unexpected status %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	if body := strings.TrimSpace(string(b)); body != "" {
+		err = fmt.Errorf("%w: %s", err, body)
+	}
+
+	return &forwarder.SinkError{
+		Err:        err,
+		Retryable:  resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter parses a "Retry-After" header value,
+// either in seconds or as an HTTP date.
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(s); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+func httpClient(c *http.Client) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+
+	return c
+}
@@ -0,0 +1,141 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// InfluxDB writes snapshots in InfluxDB line protocol,
+// either to the HTTP write API or over UDP.
+// Each metric is written as a measurement with a single "value" field,
+// tagged with its labels along with the snapshot hostname, machine ID,
+// agent ID and labels.
+type InfluxDB struct {
+	// URL of the write endpoint, like
+	// "http://localhost:8086/api/v2/write?org=org&bucket=fluentbit",
+	// "http://localhost:8086/write?db=fluentbit" on InfluxDB 1.x,
+	// or "udp://localhost:8089" to write over UDP.
+	URL string
+	// Token sent on the "Authorization" header, as InfluxDB 2.x expects.
+	Token string
+	// Username and Password for basic auth, as InfluxDB 1.x expects.
+	Username string
+	Password string
+	// Headers added to each request.
+	Headers    map[string]string
+	HTTPClient *http.Client
+}
+
+func (i *InfluxDB) Name() string {
+	return "influxdb:" + i.URL
+}
+
+func (i *InfluxDB) Push(ctx context.Context, snapshot forwarder.Snapshot) (forwarder.PushResult, error) {
+	var result forwarder.PushResult
+
+	u, err := url.Parse(i.URL)
+	if err != nil {
+		return result, &forwarder.SinkError{Err: fmt.Errorf("could not parse url: %w", err)}
+	}
+
+	lines := encodeInfluxLines(snapshot)
+
+	if u.Scheme == "udp" {
+		result.PayloadSize, _, err = writeDatagrams(ctx, u.Host, lines)
+		if err != nil {
+			return result, err
+		}
+
+		result.Inserted = len(lines)
+		return result, nil
+	}
+
+	b := bytes.Join(lines, []byte("\n"))
+	result.PayloadSize = len(b)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.URL, bytes.NewReader(b))
+	if err != nil {
+		return result, &forwarder.SinkError{Err: fmt.Errorf("could not create request: %w", err)}
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	for k, v := range i.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if i.Token != "" {
+		req.Header.Set("Authorization", "Token "+i.Token)
+	} else if i.Username != "" || i.Password != "" {
+		req.SetBasicAuth(i.Username, i.Password)
+	}
+
+	resp, err := httpClient(i.HTTPClient).Do(req)
+	if err != nil {
+		return result, fmt.Errorf("could not do request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return result, statusError(resp)
+	}
+
+	result.Inserted = len(lines)
+	return result, nil
+}
+
+// encodeInfluxLines encodes each sample of the snapshot as a line,
+// with tags sorted by key and a timestamp in nanoseconds.
+// Empty tags are left out since InfluxDB does not accept them,
+// as are NaN and infinite values.
+func encodeInfluxLines(snapshot forwarder.Snapshot) [][]byte {
+	common := commonLabels(snapshot)
+	timestamp := strconv.FormatInt(snapshot.Time.UnixNano(), 10)
+
+	var out [][]byte
+	for _, m := range snapshot.Metrics {
+		measurement := influxMeasurementEscaper.Replace(m.FullName())
+		for _, sample := range m.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue
+			}
+
+			var line bytes.Buffer
+			line.WriteString(measurement)
+
+			labels := sampleLabels(common, m, sample)
+			for _, k := range sortedKeys(labels) {
+				if k == "" || labels[k] == "" {
+					continue
+				}
+
+				line.WriteByte(',')
+				line.WriteString(influxTagEscaper.Replace(k))
+				line.WriteByte('=')
+				line.WriteString(influxTagEscaper.Replace(labels[k]))
+			}
+
+			line.WriteString(" value=")
+			line.WriteString(strconv.FormatFloat(sample.Value, 'f', -1, 64))
+			line.WriteByte(' ')
+			line.WriteString(timestamp)
+
+			out = append(out, line.Bytes())
+		}
+	}
+
+	return out
+}
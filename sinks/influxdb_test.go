@@ -0,0 +1,127 @@
+package sinks_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
+)
+
+var _ forwarder.Sink = (*sinks.InfluxDB)(nil)
+
+const wantInfluxLines = `fluentbit_input_records,agent_id=agent-id,env=prod,hostname=test,machine_id=machine-id,plugin=dummy.0 value=10 1630454400000000000
+fluentbit_storage_mem_chunks,agent_id=agent-id,env=prod,hostname=test,machine_id=machine-id,plugin=chunks value=2 1630454400000000000`
+
+func TestInfluxDB(t *testing.T) {
+	t.Run("http", func(t *testing.T) {
+		var (
+			gotAuth string
+			gotBody string
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "fluentbit" {
+				http.NotFound(w, r)
+				return
+			}
+
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			gotAuth = r.Header.Get("Authorization")
+			gotBody = string(b)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		sink := &sinks.InfluxDB{
+			URL:        srv.URL + "/api/v2/write?org=org&bucket=fluentbit",
+			Token:      "secret",
+			HTTPClient: srv.Client(),
+		}
+
+		result, err := sink.Push(context.Background(), testSnapshot())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := 2, result.Inserted; want != got {
+			t.Errorf("want %d inserted; got %d", want, got)
+		}
+
+		if want, got := "Token secret", gotAuth; want != got {
+			t.Errorf("want authorization %q; got %q", want, got)
+		}
+
+		if want, got := wantInfluxLines, gotBody; want != got {
+			t.Errorf("want body\n%s\ngot\n%s", want, got)
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		sink := &sinks.InfluxDB{URL: "udp://" + conn.LocalAddr().String()}
+		_, err = sink.Push(context.Background(), testSnapshot())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := wantInfluxLines, readPacket(t, conn); want != got {
+			t.Errorf("want packet\n%s\ngot\n%s", want, got)
+		}
+	})
+
+	t.Run("escaping", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		snapshot := testSnapshot()
+		snapshot.Labels = map[string]string{"team name": "a,b=c", "empty": ""}
+		snapshot.Metrics = snapshot.Metrics[:1]
+
+		sink := &sinks.InfluxDB{URL: "udp://" + conn.LocalAddr().String()}
+		_, err = sink.Push(context.Background(), snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readPacket(t, conn); !strings.Contains(got, `,team\ name=a\,b\=c value=10`) || strings.Contains(got, "empty") {
+			t.Errorf("unexpected tags on %q", got)
+		}
+	})
+}
+
+func readPacket(t *testing.T, conn net.PacketConn) string {
+	t.Helper()
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 65536)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b[:n])
+}
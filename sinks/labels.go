@@ -0,0 +1,51 @@
+package sinks
+
+import (
+	"regexp"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// sanitizeName of a metric or label to match [a-zA-Z_][a-zA-Z0-9_]*,
+// as Prometheus requires, replacing invalid characters with underscores.
+func sanitizeName(name string) string {
+	name = invalidNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// commonLabels of every series of the snapshot:
+// the agent labels along with its hostname, machine ID and agent ID.
+func commonLabels(snapshot forwarder.Snapshot) map[string]string {
+	out := make(map[string]string, len(snapshot.Labels)+3)
+	for k, v := range snapshot.Labels {
+		out[k] = v
+	}
+	out["hostname"] = snapshot.Hostname
+	out["machine_id"] = snapshot.MachineID
+	if snapshot.AgentID != "" {
+		out["agent_id"] = snapshot.AgentID
+	}
+
+	return out
+}
+
+// sampleLabels merges the common labels with the labels of a metric sample.
+func sampleLabels(common map[string]string, m forwarder.Metric, sample forwarder.Sample) map[string]string {
+	out := make(map[string]string, len(common)+len(m.LabelKeys)+1)
+	for k, v := range common {
+		out[k] = v
+	}
+	for i, k := range m.LabelKeys {
+		if i < len(sample.LabelValues) {
+			out[k] = sample.LabelValues[i]
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,174 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// appendMsgPackRecord encodes the archive record as a msgpack map
+// with "time" in unix nanoseconds, "machine_id", "agent_id" and "payload".
+func appendMsgPackRecord(b []byte, record ArchiveRecord) []byte {
+	b = append(b, 0x84)
+	b = appendMsgPackString(b, "time")
+	b = append(b, 0xd3)
+	b = appendUint(b, uint64(record.Time.UnixNano()), 8)
+	b = appendMsgPackString(b, "machine_id")
+	b = appendMsgPackString(b, record.MachineID)
+	b = appendMsgPackString(b, "agent_id")
+	b = appendMsgPackString(b, record.AgentID)
+	b = appendMsgPackString(b, "payload")
+	b = append(b, 0xc6)
+	b = appendUint(b, uint64(len(record.Payload)), 4)
+	return append(b, record.Payload...)
+}
+
+func appendMsgPackString(b []byte, s string) []byte {
+	switch {
+	case len(s) < 32:
+		b = append(b, 0xa0|byte(len(s)))
+	case len(s) <= 0xff:
+		b = append(b, 0xd9, byte(len(s)))
+	case len(s) <= 0xffff:
+		b = append(b, 0xda)
+		b = appendUint(b, uint64(len(s)), 2)
+	default:
+		b = append(b, 0xdb)
+		b = appendUint(b, uint64(len(s)), 4)
+	}
+
+	return append(b, s...)
+}
+
+// appendUint appends the n lower bytes of v in big endian.
+func appendUint(b []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+
+	return b
+}
+
+// readMsgPackRecord decodes an archive record encoded by appendMsgPackRecord.
+// Unknown keys with string or binary values are skipped.
+func readMsgPackRecord(r *bufio.Reader) (ArchiveRecord, error) {
+	var record ArchiveRecord
+
+	c, err := r.ReadByte()
+	if err != nil {
+		return record, err
+	}
+
+	if c&0xf0 != 0x80 {
+		return record, fmt.Errorf("unexpected msgpack type 0x%02x; want map", c)
+	}
+
+	for n := int(c & 0x0f); n > 0; n-- {
+		key, err := readMsgPackBytes(r)
+		if err != nil {
+			return record, err
+		}
+
+		if string(key) == "time" {
+			ns, err := readMsgPackInt(r)
+			if err != nil {
+				return record, err
+			}
+
+			record.Time = time.Unix(0, ns).UTC()
+			continue
+		}
+
+		v, err := readMsgPackBytes(r)
+		if err != nil {
+			return record, err
+		}
+
+		switch string(key) {
+		case "machine_id":
+			record.MachineID = string(v)
+		case "agent_id":
+			record.AgentID = string(v)
+		case "payload":
+			record.Payload = v
+		}
+	}
+
+	return record, nil
+}
+
+func readMsgPackInt(r *bufio.Reader) (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c == 0xcf, c == 0xd3:
+		b, err := readN(r, 8)
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(binary.BigEndian.Uint64(b)), nil
+	}
+
+	return 0, fmt.Errorf("unexpected msgpack type 0x%02x; want int", c)
+}
+
+// readMsgPackBytes reads either a string or binary value.
+func readMsgPackBytes(r *bufio.Reader) ([]byte, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	var n int
+	switch {
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c == 0xd9, c == 0xc4:
+		b, err := readN(r, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		n = int(b[0])
+	case c == 0xda, c == 0xc5:
+		b, err := readN(r, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		n = int(binary.BigEndian.Uint16(b))
+	case c == 0xdb, c == 0xc6:
+		b, err := readN(r, 4)
+		if err != nil {
+			return nil, err
+		}
+
+		n = int(binary.BigEndian.Uint32(b))
+	default:
+		return nil, fmt.Errorf("unexpected msgpack type 0x%02x; want string or binary", c)
+	}
+
+	return readN(r, n)
+}
+
+func readN(r *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, unexpectedEOF(err)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,240 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks/internal/pb"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLPScope is the instrumentation scope name of the exported metrics.
+const OTLPScope = "github.com/calyptia/fluent-bit-cloud-forwarder"
+
+// OTLP exports snapshots as OpenTelemetry metrics to an OTLP/HTTP endpoint
+// using protobuf encoding.
+// Counters are exported as monotonic cumulative sums and levels as gauges.
+// The start time of a sum is reset once its counter goes down,
+// like when Fluent Bit restarts.
+// The snapshot hostname, machine ID, agent ID, Fluent Bit version and labels
+// are exported as resource attributes.
+type OTLP struct {
+	// URL of the metrics endpoint, like "http://localhost:4318/v1/metrics".
+	URL string
+	// Headers added to each request, like an API key.
+	Headers    map[string]string
+	HTTPClient *http.Client
+
+	mu sync.Mutex
+	// sums by series, to track their start time.
+	sums map[string]otlpSum
+}
+
+// otlpSum is the last point of a cumulative sum.
+type otlpSum struct {
+	start time.Time
+	time  time.Time
+	value float64
+}
+
+func (o *OTLP) Name() string {
+	return "otlp:" + o.URL
+}
+
+func (o *OTLP) Push(ctx context.Context, snapshot forwarder.Snapshot) (forwarder.PushResult, error) {
+	var result forwarder.PushResult
+
+	b, points, err := o.encode(snapshot)
+	if err != nil {
+		return result, &forwarder.SinkError{Err: fmt.Errorf("could not encode snapshot: %w", err)}
+	}
+
+	result.PayloadSize = len(b)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.URL, bytes.NewReader(b))
+	if err != nil {
+		return result, &forwarder.SinkError{Err: fmt.Errorf("could not create request: %w", err)}
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range o.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient(o.HTTPClient).Do(req)
+	if err != nil {
+		return result, fmt.Errorf("could not do request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return result, statusError(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return result, fmt.Errorf("could not read response: %w", err)
+	}
+
+	// A partial success must not be retried.
+	result.Inserted = points - int(otlpRejectedDataPoints(body))
+	return result, nil
+}
+
+// startTime of the cumulative sum of the series at the snapshot time.
+// It is the time the series was first seen,
+// or the time of its previous point if its counter went down since.
+// Must be called with mu held.
+func (o *OTLP) startTime(series string, t time.Time, value float64, sums map[string]otlpSum) time.Time {
+	start := t
+	if prev, ok := o.sums[series]; ok {
+		start = prev.start
+		if value < prev.value {
+			start = prev.time
+		}
+	}
+
+	sums[series] = otlpSum{start: start, time: t, value: value}
+	return start
+}
+
+// encode the snapshot as an ExportMetricsServiceRequest.
+// It also returns the number of data points.
+func (o *OTLP) encode(snapshot forwarder.Snapshot) ([]byte, int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	resourceAttrs := []*commonpb.KeyValue{
+		stringKeyValue("host.name", snapshot.Hostname),
+		stringKeyValue("host.id", snapshot.MachineID),
+		stringKeyValue("service.name", "fluent-bit"),
+	}
+	if snapshot.FluentBitVersion != "" {
+		resourceAttrs = append(resourceAttrs, stringKeyValue("service.version", snapshot.FluentBitVersion))
+	}
+	if snapshot.AgentID != "" {
+		resourceAttrs = append(resourceAttrs, stringKeyValue("service.instance.id", snapshot.AgentID))
+	}
+	for _, k := range sortedKeys(snapshot.Labels) {
+		resourceAttrs = append(resourceAttrs, stringKeyValue(k, snapshot.Labels[k]))
+	}
+
+	scopeMetrics := &metricspb.InstrumentationLibraryMetrics{
+		InstrumentationLibrary: &commonpb.InstrumentationLibrary{Name: OTLPScope},
+	}
+
+	// Series not in the snapshot are forgotten.
+	sums := map[string]otlpSum{}
+	now := uint64(snapshot.Time.UnixNano())
+
+	var points int
+	for _, m := range snapshot.Metrics {
+		if len(m.Samples) == 0 {
+			continue
+		}
+
+		name := m.FullName()
+		dataPoints := make([]*metricspb.NumberDataPoint, 0, len(m.Samples))
+		for _, sample := range m.Samples {
+			dp := &metricspb.NumberDataPoint{
+				TimeUnixNano: now,
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: sample.Value},
+			}
+			for i, k := range m.LabelKeys {
+				var v string
+				if i < len(sample.LabelValues) {
+					v = sample.LabelValues[i]
+				}
+				dp.Attributes = append(dp.Attributes, stringKeyValue(k, v))
+			}
+			if m.Type == forwarder.MetricCounter {
+				series := name + "\xff" + strings.Join(sample.LabelValues, "\xff")
+				dp.StartTimeUnixNano = uint64(o.startTime(series, snapshot.Time, sample.Value, sums).UnixNano())
+			}
+
+			dataPoints = append(dataPoints, dp)
+			points++
+		}
+
+		metric := &metricspb.Metric{Name: name, Description: m.Help}
+		if m.Type == forwarder.MetricCounter {
+			metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             dataPoints,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		} else {
+			metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: dataPoints}}
+		}
+
+		scopeMetrics.Metrics = append(scopeMetrics.Metrics, metric)
+	}
+
+	o.sums = sums
+
+	resourceMetrics, err := proto.Marshal(&metricspb.ResourceMetrics{
+		Resource:                      &resourcepb.Resource{Attributes: resourceAttrs},
+		InstrumentationLibraryMetrics: []*metricspb.InstrumentationLibraryMetrics{scopeMetrics},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// ExportMetricsServiceRequest only has the resource metrics field.
+	// Its generated package is not used since it pulls gRPC.
+	var out []byte
+	out = protowire.AppendTag(out, 1, protowire.BytesType)
+	out = protowire.AppendBytes(out, resourceMetrics)
+	return out, points, nil
+}
+
+// otlpRejectedDataPoints from an ExportMetricsServiceResponse partial success,
+// newer than the generated OTLP types in use.
+// Zero if the response cannot be decoded.
+func otlpRejectedDataPoints(b []byte) int64 {
+	var rejected int64
+	_ = pb.Walk(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+
+		return pb.Walk(v, func(num protowire.Number, typ protowire.Type, _ []byte, n uint64) error {
+			if num == 1 && typ == protowire.VarintType {
+				rejected = int64(n)
+			}
+			return nil
+		})
+	})
+
+	return rejected
+}
+
+func stringKeyValue(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
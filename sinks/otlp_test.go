@@ -0,0 +1,134 @@
+package sinks_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks/otlptest"
+)
+
+var _ forwarder.Sink = (*sinks.OTLP)(nil)
+
+func TestOTLP(t *testing.T) {
+	collector := otlptest.NewServer()
+	defer collector.Close()
+
+	sink := &sinks.OTLP{
+		URL:        collector.URL + "/v1/metrics",
+		Headers:    map[string]string{"X-Api-Key": "key"},
+		HTTPClient: collector.Client(),
+	}
+
+	snapshot := testSnapshot()
+	result, err := sink.Push(context.Background(), snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 2, result.Inserted; want != got {
+		t.Errorf("want %d inserted; got %d", want, got)
+	}
+
+	exports := collector.Exports()
+	if want, got := 1, len(exports); want != got {
+		t.Fatalf("want %d exports; got %d", want, got)
+	}
+
+	export := exports[0]
+	if want, got := "key", export.Header.Get("X-Api-Key"); want != got {
+		t.Errorf("want api key header %q; got %q", want, got)
+	}
+
+	for k, want := range map[string]string{
+		"host.name":           "test",
+		"host.id":             "machine-id",
+		"service.name":        "fluent-bit",
+		"service.version":     "1.8.6",
+		"service.instance.id": "agent-id",
+		"env":                 "prod",
+	} {
+		if got := export.Resource[k]; want != got {
+			t.Errorf("want resource attribute %s=%q; got %q", k, want, got)
+		}
+	}
+
+	if want, got := 2, len(export.Metrics); want != got {
+		t.Fatalf("want %d metrics; got %d", want, got)
+	}
+
+	records, chunks := export.Metrics[0], export.Metrics[1]
+	if records.Name != "fluentbit_input_records" || records.Type != "sum" || records.Temporality != 2 || !records.Monotonic {
+		t.Errorf("want cumulative monotonic sum for records; got %+v", records)
+	}
+
+	if len(records.DataPoints) != 1 || records.DataPoints[0].Value != 10 || records.DataPoints[0].Attributes["plugin"] != "dummy.0" || !records.DataPoints[0].Time.Equal(snapshot.Time) {
+		t.Errorf("unexpected records data points %+v", records.DataPoints)
+	}
+
+	if chunks.Name != "fluentbit_storage_mem_chunks" || chunks.Type != "gauge" || len(chunks.DataPoints) != 1 || chunks.DataPoints[0].Value != 2 {
+		t.Errorf("want gauge for chunks; got %+v", chunks)
+	}
+
+	t.Run("reset", func(t *testing.T) {
+		collector := otlptest.NewServer()
+		defer collector.Close()
+
+		sink := &sinks.OTLP{URL: collector.URL + "/v1/metrics", HTTPClient: collector.Client()}
+
+		// Records go up, and then down as if Fluent Bit restarted.
+		start := snapshot.Time
+		var times []time.Time
+		for i, records := range []float64{10, 20, 5, 8} {
+			s := testSnapshot()
+			s.Time = start.Add(time.Duration(i) * time.Minute)
+			s.Metrics[0].Samples[0].Value = records
+			times = append(times, s.Time)
+
+			if _, err := sink.Push(context.Background(), s); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		exports := collector.Exports()
+		if want, got := len(times), len(exports); want != got {
+			t.Fatalf("want %d exports; got %d", want, got)
+		}
+
+		want := []time.Time{times[0], times[0], times[1], times[1]}
+		for i, export := range exports {
+			if got := export.Metrics[0].DataPoints[0].StartTime; !want[i].Equal(got) {
+				t.Errorf("export %d: want start time %v; got %v", i, want[i], got)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tt := []struct {
+			statusCode    int
+			wantRetryable bool
+		}{
+			{statusCode: http.StatusServiceUnavailable, wantRetryable: true},
+			{statusCode: http.StatusTooManyRequests, wantRetryable: true},
+			{statusCode: http.StatusBadRequest, wantRetryable: false},
+		}
+		for _, tc := range tt {
+			collector.InjectFailure(otlptest.Failure{StatusCode: tc.statusCode, Times: 1})
+
+			_, err := sink.Push(context.Background(), snapshot)
+
+			var sinkErr *forwarder.SinkError
+			if !errors.As(err, &sinkErr) {
+				t.Fatalf("status %d: want sink error; got %v", tc.statusCode, err)
+			}
+
+			if want, got := tc.wantRetryable, sinkErr.Retryable; want != got {
+				t.Errorf("status %d: want retryable %v; got %v", tc.statusCode, want, got)
+			}
+		}
+	})
+}
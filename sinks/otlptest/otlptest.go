@@ -0,0 +1,235 @@
+// Package otlptest provides an in-process stand-in for an OpenTelemetry
+// collector receiving metrics over OTLP/HTTP, to be used on tests.
+package otlptest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks/internal/pb"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Export request received by the fake collector.
+type Export struct {
+	Header   http.Header
+	Resource map[string]string
+	Scope    string
+	Metrics  []Metric
+}
+
+// Metric decoded from an export request.
+type Metric struct {
+	Name        string
+	Description string
+	// Type is either "sum" or "gauge".
+	Type string
+	// Temporality of sums. 2 means cumulative.
+	Temporality int
+	Monotonic   bool
+	DataPoints  []DataPoint
+}
+
+type DataPoint struct {
+	Attributes map[string]string
+	StartTime  time.Time
+	Time       time.Time
+	Value      float64
+}
+
+// Failure to respond with instead of accepting the export.
+type Failure struct {
+	StatusCode int
+	Header     http.Header
+	// Times the failure is injected. Zero means forever.
+	Times int
+}
+
+// Handler implementing the OTLP/HTTP metrics endpoint at "/v1/metrics".
+// Use NewHandler to create one.
+type Handler struct {
+	mu       sync.Mutex
+	exports  []Export
+	failures []*Failure
+}
+
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Server is a fake collector listening on a system-chosen port on the local
+// loopback interface.
+type Server struct {
+	*Handler
+	*httptest.Server
+}
+
+// NewServer starts and returns a new fake collector.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	h := NewHandler()
+	return &Server{
+		Handler: h,
+		Server:  httptest.NewServer(h),
+	}
+}
+
+// Exports received so far.
+func (h *Handler) Exports() []Export {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]Export(nil), h.exports...)
+}
+
+// InjectFailure makes the next exports fail.
+func (h *Handler) InjectFailure(f Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures = append(h.failures, &f)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		http.Error(w, fmt.Sprintf("unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if f := h.failure(); f != nil {
+		for k, v := range f.Header {
+			w.Header()[k] = v
+		}
+		http.Error(w, http.StatusText(f.StatusCode), f.StatusCode)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	exports, err := decodeRequest(b)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	for _, export := range exports {
+		export.Header = r.Header.Clone()
+		h.exports = append(h.exports, export)
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) failure() *Failure {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.failures) == 0 {
+		return nil
+	}
+
+	f := h.failures[0]
+	if f.Times > 0 {
+		f.Times--
+		if f.Times == 0 {
+			h.failures = h.failures[1:]
+		}
+	}
+
+	return f
+}
+
+// decodeRequest decodes an ExportMetricsServiceRequest
+// into one export per resource.
+func decodeRequest(b []byte) ([]Export, error) {
+	var out []Export
+	err := pb.Walk(b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+
+		var rm metricspb.ResourceMetrics
+		err := proto.Unmarshal(v, &rm)
+		if err != nil {
+			return err
+		}
+
+		export := Export{Resource: attributes(rm.GetResource().GetAttributes())}
+		for _, sm := range rm.InstrumentationLibraryMetrics {
+			export.Scope = sm.GetInstrumentationLibrary().GetName()
+			for _, m := range sm.Metrics {
+				export.Metrics = append(export.Metrics, decodeMetric(m))
+			}
+		}
+
+		out = append(out, export)
+		return nil
+	})
+
+	return out, err
+}
+
+func decodeMetric(m *metricspb.Metric) Metric {
+	out := Metric{Name: m.Name, Description: m.Description}
+
+	var dataPoints []*metricspb.NumberDataPoint
+	switch data := m.Data.(type) {
+	case *metricspb.Metric_Sum:
+		out.Type = "sum"
+		out.Temporality = int(data.Sum.AggregationTemporality)
+		out.Monotonic = data.Sum.IsMonotonic
+		dataPoints = data.Sum.DataPoints
+	case *metricspb.Metric_Gauge:
+		out.Type = "gauge"
+		dataPoints = data.Gauge.DataPoints
+	}
+
+	for _, dp := range dataPoints {
+		point := DataPoint{
+			Attributes: attributes(dp.Attributes),
+			Time:       time.Unix(0, int64(dp.TimeUnixNano)).UTC(),
+		}
+		if dp.StartTimeUnixNano != 0 {
+			point.StartTime = time.Unix(0, int64(dp.StartTimeUnixNano)).UTC()
+		}
+		switch v := dp.Value.(type) {
+		case *metricspb.NumberDataPoint_AsDouble:
+			point.Value = v.AsDouble
+		case *metricspb.NumberDataPoint_AsInt:
+			point.Value = float64(v.AsInt)
+		}
+
+		out.DataPoints = append(out.DataPoints, point)
+	}
+
+	return out
+}
+
+// attributes with a string value.
+func attributes(kvs []*commonpb.KeyValue) map[string]string {
+	out := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		out[kv.Key] = kv.GetValue().GetStringValue()
+	}
+
+	return out
+}
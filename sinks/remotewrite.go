@@ -0,0 +1,155 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Metric types as in prometheus/prompb.
+const (
+	remoteWriteTypeCounter = 1
+	remoteWriteTypeGauge   = 2
+)
+
+// RemoteWrite pushes snapshots to a Prometheus remote-write endpoint,
+// like Mimir, Thanos receive or Cortex,
+// as a snappy-compressed protobuf WriteRequest.
+// Each series gets the snapshot hostname, machine ID, agent ID and labels.
+// As per the remote-write spec, 5xx and 429 responses are retried
+// and other 4xx are dropped, except for 408 timeouts.
+type RemoteWrite struct {
+	// URL of the endpoint, like "http://localhost:9009/api/v1/push".
+	URL string
+	// Username and Password for basic auth.
+	Username string
+	Password string
+	// BearerToken sent on the "Authorization" header.
+	BearerToken string
+	// Headers added to each request, like a tenant ID.
+	Headers    map[string]string
+	HTTPClient *http.Client
+}
+
+func (rw *RemoteWrite) Name() string {
+	return "remote_write:" + rw.URL
+}
+
+func (rw *RemoteWrite) Push(ctx context.Context, snapshot forwarder.Snapshot) (forwarder.PushResult, error) {
+	var result forwarder.PushResult
+
+	b, series := encodeWriteRequest(snapshot)
+	result.PayloadSize = len(b)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rw.URL, bytes.NewReader(snappy.Encode(nil, b)))
+	if err != nil {
+		return result, &forwarder.SinkError{Err: fmt.Errorf("could not create request: %w", err)}
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range rw.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if rw.Username != "" || rw.Password != "" {
+		req.SetBasicAuth(rw.Username, rw.Password)
+	} else if rw.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rw.BearerToken)
+	}
+
+	resp, err := httpClient(rw.HTTPClient).Do(req)
+	if err != nil {
+		return result, fmt.Errorf("could not do request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return result, statusError(resp)
+	}
+
+	result.Inserted = series
+	return result, nil
+}
+
+// encodeWriteRequest encodes the snapshot as a prompb WriteRequest
+// with a series per sample, along with the metrics metadata.
+// It also returns the number of series.
+func encodeWriteRequest(snapshot forwarder.Snapshot) ([]byte, int) {
+	common := commonLabels(snapshot)
+	timestamp := snapshot.Time.UnixNano() / int64(1e6)
+
+	var (
+		out    []byte
+		series int
+	)
+	for _, m := range snapshot.Metrics {
+		name := sanitizeName(m.FullName())
+		for _, sample := range m.Samples {
+			labels := map[string]string{}
+			for k, v := range sampleLabels(common, m, sample) {
+				labels[sanitizeName(k)] = v
+			}
+			labels["__name__"] = name
+
+			var ts []byte
+			for _, k := range sortedKeys(labels) {
+				var label []byte
+				label = protowire.AppendTag(label, 1, protowire.BytesType)
+				label = protowire.AppendString(label, k)
+				label = protowire.AppendTag(label, 2, protowire.BytesType)
+				label = protowire.AppendString(label, labels[k])
+
+				ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+				ts = protowire.AppendBytes(ts, label)
+			}
+
+			var s []byte
+			s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+			s = protowire.AppendFixed64(s, math.Float64bits(sample.Value))
+			s = protowire.AppendTag(s, 2, protowire.VarintType)
+			s = protowire.AppendVarint(s, uint64(timestamp))
+
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, s)
+
+			out = protowire.AppendTag(out, 1, protowire.BytesType)
+			out = protowire.AppendBytes(out, ts)
+			series++
+		}
+	}
+
+	for _, m := range snapshot.Metrics {
+		if len(m.Samples) == 0 {
+			continue
+		}
+
+		typ := remoteWriteTypeCounter
+		if m.Type == forwarder.MetricGauge {
+			typ = remoteWriteTypeGauge
+		}
+
+		var metadata []byte
+		metadata = protowire.AppendTag(metadata, 1, protowire.VarintType)
+		metadata = protowire.AppendVarint(metadata, uint64(typ))
+		metadata = protowire.AppendTag(metadata, 2, protowire.BytesType)
+		metadata = protowire.AppendString(metadata, sanitizeName(m.FullName()))
+		if m.Help != "" {
+			metadata = protowire.AppendTag(metadata, 4, protowire.BytesType)
+			metadata = protowire.AppendString(metadata, m.Help)
+		}
+
+		out = protowire.AppendTag(out, 3, protowire.BytesType)
+		out = protowire.AppendBytes(out, metadata)
+	}
+
+	return out, series
+}
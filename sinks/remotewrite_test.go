@@ -0,0 +1,120 @@
+package sinks_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks/remotewritetest"
+)
+
+var _ forwarder.Sink = (*sinks.RemoteWrite)(nil)
+
+func TestRemoteWrite(t *testing.T) {
+	receiver := remotewritetest.NewServer()
+	defer receiver.Close()
+
+	receiver.Username = "user"
+	receiver.Password = "pass"
+
+	sink := &sinks.RemoteWrite{
+		URL:        receiver.URL + "/api/v1/push",
+		Username:   "user",
+		Password:   "pass",
+		Headers:    map[string]string{"X-Scope-OrgID": "team"},
+		HTTPClient: receiver.Client(),
+	}
+
+	// Agent label keys invalid as Prometheus label names get sanitized.
+	snapshot := testSnapshot()
+	snapshot.Labels["team-name"] = "obs"
+	snapshot.Labels["1zone"] = "a"
+
+	result, err := sink.Push(context.Background(), snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 2, result.Inserted; want != got {
+		t.Errorf("want %d inserted; got %d", want, got)
+	}
+
+	requests := receiver.Requests()
+	if want, got := 1, len(requests); want != got {
+		t.Fatalf("want %d requests; got %d", want, got)
+	}
+
+	req := requests[0]
+	if want, got := "team", req.Header.Get("X-Scope-OrgID"); want != got {
+		t.Errorf("want tenant header %q; got %q", want, got)
+	}
+
+	if want, got := 2, len(req.Series); want != got {
+		t.Fatalf("want %d series; got %d", want, got)
+	}
+
+	series := req.Series[0]
+	for k, want := range map[string]string{
+		"__name__":   "fluentbit_input_records",
+		"plugin":     "dummy.0",
+		"hostname":   "test",
+		"machine_id": "machine-id",
+		"agent_id":   "agent-id",
+		"env":        "prod",
+		"team_name":  "obs",
+		"_1zone":     "a",
+	} {
+		if got := series.Labels[k]; want != got {
+			t.Errorf("want label %s=%q; got %q", k, want, got)
+		}
+	}
+
+	if len(series.Samples) != 1 || series.Samples[0].Value != 10 || !series.Samples[0].Time.Equal(snapshot.Time) {
+		t.Errorf("unexpected samples %+v", series.Samples)
+	}
+
+	if want, got := 2, len(req.Metadata); want != got {
+		t.Fatalf("want %d metadata; got %d", want, got)
+	}
+
+	if req.Metadata[0].Type != 1 || req.Metadata[1].Type != 2 {
+		t.Errorf("want counter and gauge metadata; got %+v", req.Metadata)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		tt := []struct {
+			statusCode    int
+			wantRetryable bool
+		}{
+			{statusCode: http.StatusInternalServerError, wantRetryable: true},
+			{statusCode: http.StatusTooManyRequests, wantRetryable: true},
+			{statusCode: http.StatusBadRequest, wantRetryable: false},
+		}
+		for _, tc := range tt {
+			receiver.InjectFailure(remotewritetest.Failure{StatusCode: tc.statusCode, Times: 1})
+
+			_, err := sink.Push(context.Background(), snapshot)
+
+			var sinkErr *forwarder.SinkError
+			if !errors.As(err, &sinkErr) {
+				t.Fatalf("status %d: want sink error; got %v", tc.statusCode, err)
+			}
+
+			if want, got := tc.wantRetryable, sinkErr.Retryable; want != got {
+				t.Errorf("status %d: want retryable %v; got %v", tc.statusCode, want, got)
+			}
+		}
+
+		unauthorized := *sink
+		unauthorized.Password = "wrong"
+		_, err := unauthorized.Push(context.Background(), snapshot)
+
+		var sinkErr *forwarder.SinkError
+		if !errors.As(err, &sinkErr) || sinkErr.Retryable {
+			t.Errorf("want non retryable error on wrong credentials; got %v", err)
+		}
+	})
+}
@@ -0,0 +1,265 @@
+// Package remotewritetest provides an in-process stand-in for a Prometheus
+// remote-write receiver, to be used on tests.
+package remotewritetest
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks/internal/pb"
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Series received by the fake receiver.
+type Series struct {
+	Labels  map[string]string
+	Samples []Sample
+}
+
+type Sample struct {
+	Value float64
+	Time  time.Time
+}
+
+// Metadata of a metric family.
+type Metadata struct {
+	// Type is 1 for counters and 2 for gauges.
+	Type int
+	Name string
+	Help string
+}
+
+// WriteRequest received by the fake receiver.
+type WriteRequest struct {
+	Header   http.Header
+	Series   []Series
+	Metadata []Metadata
+}
+
+// Failure to respond with instead of accepting the write.
+type Failure struct {
+	StatusCode int
+	Header     http.Header
+	// Times the failure is injected. Zero means forever.
+	Times int
+}
+
+// Handler implementing a remote-write endpoint at "/api/v1/push".
+// Use NewHandler to create one.
+type Handler struct {
+	// Username and Password for basic auth. If empty, any is accepted.
+	Username string
+	Password string
+	// BearerToken expected on the "Authorization" header.
+	// If empty, any is accepted.
+	BearerToken string
+
+	mu       sync.Mutex
+	requests []WriteRequest
+	failures []*Failure
+}
+
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Server is a fake receiver listening on a system-chosen port on the local
+// loopback interface.
+type Server struct {
+	*Handler
+	*httptest.Server
+}
+
+// NewServer starts and returns a new fake receiver.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	h := NewHandler()
+	return &Server{
+		Handler: h,
+		Server:  httptest.NewServer(h),
+	}
+}
+
+// Requests received so far.
+func (h *Handler) Requests() []WriteRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]WriteRequest(nil), h.requests...)
+}
+
+// InjectFailure makes the next writes fail.
+func (h *Handler) InjectFailure(f Failure) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures = append(h.failures, &f)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v1/push" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.authorized(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if enc := r.Header.Get("Content-Encoding"); enc != "snappy" {
+		http.Error(w, fmt.Sprintf("unsupported content encoding %q", enc), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if f := h.failure(); f != nil {
+		for k, v := range f.Header {
+			w.Header()[k] = v
+		}
+		http.Error(w, http.StatusText(f.StatusCode), f.StatusCode)
+		return
+	}
+
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decompress request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req, err := decodeWriteRequest(b)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req.Header = r.Header.Clone()
+
+	h.mu.Lock()
+	h.requests = append(h.requests, req)
+	h.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.Username != "" || h.Password != "" {
+		username, password, ok := r.BasicAuth()
+		return ok && username == h.Username && password == h.Password
+	}
+
+	if h.BearerToken != "" {
+		return r.Header.Get("Authorization") == "Bearer "+h.BearerToken
+	}
+
+	return true
+}
+
+func (h *Handler) failure() *Failure {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.failures) == 0 {
+		return nil
+	}
+
+	f := h.failures[0]
+	if f.Times > 0 {
+		f.Times--
+		if f.Times == 0 {
+			h.failures = h.failures[1:]
+		}
+	}
+
+	return f
+}
+
+func decodeWriteRequest(b []byte) (WriteRequest, error) {
+	var out WriteRequest
+	err := pb.Walk(b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			series, err := decodeSeries(v)
+			if err != nil {
+				return err
+			}
+
+			out.Series = append(out.Series, series)
+		case 3:
+			var metadata Metadata
+			err := pb.Walk(v, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) error {
+				switch num {
+				case 1:
+					metadata.Type = int(n)
+				case 2:
+					metadata.Name = string(v)
+				case 4:
+					metadata.Help = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			out.Metadata = append(out.Metadata, metadata)
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+func decodeSeries(b []byte) (Series, error) {
+	series := Series{Labels: map[string]string{}}
+	err := pb.Walk(b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			var name, value string
+			err := pb.Walk(v, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					name = string(v)
+				case 2:
+					value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			series.Labels[name] = value
+		case 2:
+			var sample Sample
+			err := pb.Walk(v, func(num protowire.Number, _ protowire.Type, _ []byte, n uint64) error {
+				switch num {
+				case 1:
+					sample.Value = math.Float64frombits(n)
+				case 2:
+					sample.Time = time.Unix(0, int64(n)*int64(time.Millisecond)).UTC()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			series.Samples = append(series.Samples, sample)
+		}
+		return nil
+	})
+
+	return series, err
+}
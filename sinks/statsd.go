@@ -0,0 +1,155 @@
+package sinks
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+)
+
+// statsdSanitizer replaces the characters with a meaning on the StatsD
+// protocol and its tag extensions.
+var statsdSanitizer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "=", "_", " ", "_", "\n", "_")
+
+// StatsD sends snapshots as StatsD gauges and counters over UDP.
+// Since Fluent Bit counters are cumulative and StatsD counters are not,
+// counters are sent as the increment since the previous push,
+// starting from the second one. A counter that went down, like after
+// Fluent Bit restarted, is sent with its whole value.
+// Each metric is tagged with its labels along with the snapshot hostname,
+// machine ID, agent ID and labels.
+type StatsD struct {
+	// Addr of the StatsD server, like "localhost:8125".
+	Addr string
+	// DogStatsD sends tags using the "|#key:value" DogStatsD extension.
+	// Otherwise tags are added to the metric name like "name,key=value",
+	// as understood by the Telegraf StatsD input.
+	DogStatsD bool
+
+	mu sync.Mutex
+	// counters last value, by metric name and tags.
+	counters map[string]float64
+}
+
+func (s *StatsD) Name() string {
+	if s.DogStatsD {
+		return "dogstatsd:" + s.Addr
+	}
+
+	return "statsd:" + s.Addr
+}
+
+func (s *StatsD) Push(ctx context.Context, snapshot forwarder.Snapshot) (forwarder.PushResult, error) {
+	var result forwarder.PushResult
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines, seen := s.encode(snapshot)
+	if s.counters == nil {
+		s.counters = map[string]float64{}
+	}
+
+	// First seen counters are not sent, but set the base of the next increments.
+	for k, v := range seen {
+		s.counters[k] = v
+	}
+
+	b := make([][]byte, len(lines))
+	for i, l := range lines {
+		b[i] = l.b
+	}
+
+	var (
+		sent int
+		err  error
+	)
+	if len(b) != 0 {
+		result.PayloadSize, sent, err = writeDatagrams(ctx, s.Addr, b)
+	}
+
+	// Each counter is only moved forward once its line was sent,
+	// so the increments of the lines not sent are sent on the next push
+	// and those sent are not sent twice.
+	for _, l := range lines[:sent] {
+		if l.counter != "" {
+			s.counters[l.counter] = l.value
+		}
+	}
+
+	result.Inserted = sent
+	return result, err
+}
+
+// statsdLine to send.
+// Counter lines carry their series and current value.
+type statsdLine struct {
+	b       []byte
+	counter string
+	value   float64
+}
+
+// encode the snapshot as StatsD lines.
+// It also returns the value of the counters seen for the first time, by series.
+func (s *StatsD) encode(snapshot forwarder.Snapshot) ([]statsdLine, map[string]float64) {
+	common := commonLabels(snapshot)
+
+	var (
+		out  []statsdLine
+		seen = map[string]float64{}
+	)
+	for _, m := range snapshot.Metrics {
+		name := statsdSanitizer.Replace(m.FullName())
+		for _, sample := range m.Samples {
+			labels := sampleLabels(common, m, sample)
+			tags := make([]string, 0, len(labels))
+			for _, k := range sortedKeys(labels) {
+				if labels[k] == "" {
+					continue
+				}
+
+				sep := "="
+				if s.DogStatsD {
+					sep = ":"
+				}
+				tags = append(tags, statsdSanitizer.Replace(k)+sep+statsdSanitizer.Replace(labels[k]))
+			}
+
+			line := func(value float64, typ string) []byte {
+				v := strconv.FormatFloat(value, 'f', -1, 64)
+				if s.DogStatsD {
+					return []byte(name + ":" + v + "|" + typ + "|#" + strings.Join(tags, ","))
+				}
+
+				return []byte(strings.Join(append([]string{name}, tags...), ",") + ":" + v + "|" + typ)
+			}
+
+			if m.Type != forwarder.MetricCounter {
+				// A signed gauge value is a relative change on StatsD,
+				// so negative values are set by resetting it first.
+				if sample.Value < 0 {
+					out = append(out, statsdLine{b: line(0, "g")})
+				}
+				out = append(out, statsdLine{b: line(sample.Value, "g")})
+				continue
+			}
+
+			key := name + "," + strings.Join(tags, ",")
+			last, ok := s.counters[key]
+			if !ok {
+				seen[key] = sample.Value
+				continue
+			}
+
+			delta := sample.Value - last
+			if delta < 0 {
+				delta = sample.Value
+			}
+			out = append(out, statsdLine{b: line(delta, "c"), counter: key, value: sample.Value})
+		}
+	}
+
+	return out, seen
+}
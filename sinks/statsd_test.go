@@ -0,0 +1,127 @@
+package sinks_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	forwarder "github.com/calyptia/fluent-bit-cloud-forwarder"
+	"github.com/calyptia/fluent-bit-cloud-forwarder/sinks"
+)
+
+var _ forwarder.Sink = (*sinks.StatsD)(nil)
+
+func TestStatsD(t *testing.T) {
+	tt := []struct {
+		name      string
+		dogStatsD bool
+		wantFirst string
+		wantNext  string
+	}{
+		{
+			name:      "telegraf",
+			wantFirst: "fluentbit_storage_mem_chunks,agent_id=agent-id,env=prod,hostname=test,machine_id=machine-id,plugin=chunks:2|g",
+			wantNext: "fluentbit_input_records,agent_id=agent-id,env=prod,hostname=test,machine_id=machine-id,plugin=dummy.0:5|c\n" +
+				"fluentbit_storage_mem_chunks,agent_id=agent-id,env=prod,hostname=test,machine_id=machine-id,plugin=chunks:2|g",
+		},
+		{
+			name:      "dogstatsd",
+			dogStatsD: true,
+			wantFirst: "fluentbit_storage_mem_chunks:2|g|#agent_id:agent-id,env:prod,hostname:test,machine_id:machine-id,plugin:chunks",
+			wantNext: "fluentbit_input_records:5|c|#agent_id:agent-id,env:prod,hostname:test,machine_id:machine-id,plugin:dummy.0\n" +
+				"fluentbit_storage_mem_chunks:2|g|#agent_id:agent-id,env:prod,hostname:test,machine_id:machine-id,plugin:chunks",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer conn.Close()
+
+			sink := &sinks.StatsD{Addr: conn.LocalAddr().String(), DogStatsD: tc.dogStatsD}
+			snapshot := testSnapshot()
+
+			// Counters are only sent from the second push on.
+			result, err := sink.Push(context.Background(), snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want, got := 1, result.Inserted; want != got {
+				t.Errorf("want %d inserted; got %d", want, got)
+			}
+
+			if want, got := tc.wantFirst, readPacket(t, conn); want != got {
+				t.Errorf("want packet\n%s\ngot\n%s", want, got)
+			}
+
+			snapshot.Metrics[0].Samples[0].Value = 15
+			_, err = sink.Push(context.Background(), snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want, got := tc.wantNext, readPacket(t, conn); want != got {
+				t.Errorf("want packet\n%s\ngot\n%s", want, got)
+			}
+		})
+	}
+}
+
+func TestStatsD_partialSend(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	sink := &sinks.StatsD{Addr: conn.LocalAddr().String()}
+
+	// The second series is too big for a UDP packet, so it always fails to be sent
+	// after the first one was.
+	snapshot := forwarder.Snapshot{
+		Hostname:  "test",
+		MachineID: "machine-id",
+		Metrics: []forwarder.Metric{{
+			Namespace: "fluentbit",
+			Subsystem: "input",
+			Name:      "records",
+			Type:      forwarder.MetricCounter,
+			LabelKeys: []string{"plugin"},
+			Samples: []forwarder.Sample{
+				{LabelValues: []string{"dummy.0"}, Value: 10},
+				{LabelValues: []string{strings.Repeat("x", 1<<16)}, Value: 10},
+			},
+		}},
+	}
+
+	// Counters are only sent from the second push on.
+	if _, err := sink.Push(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, records := range []float64{20, 30} {
+		snapshot.Metrics[0].Samples[0].Value = records
+		snapshot.Metrics[0].Samples[1].Value = records
+
+		result, err := sink.Push(context.Background(), snapshot)
+		if err == nil {
+			t.Fatalf("push %d: want error sending the big series", i)
+		}
+
+		if want, got := 1, result.Inserted; want != got {
+			t.Errorf("push %d: want %d inserted; got %d", i, want, got)
+		}
+
+		// The increment of the sent series is not sent twice.
+		want := "fluentbit_input_records,hostname=test,machine_id=machine-id,plugin=dummy.0:10|c"
+		if got := readPacket(t, conn); want != got {
+			t.Errorf("push %d: want packet\n%s\ngot\n%s", i, want, got)
+		}
+	}
+}
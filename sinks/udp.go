@@ -0,0 +1,77 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+)
+
+// maxDatagramSize is the max size of the UDP packets sent by the sinks,
+// so they are not fragmented on a regular ethernet MTU.
+// Lines are batched into packets up to this size.
+const maxDatagramSize = 1432
+
+// writeDatagrams sends the lines to a UDP address,
+// batched into as few packets as possible and separated by a new line.
+// It returns the number of bytes sent, and the number of lines sent
+// in full, which are always the first ones.
+func writeDatagrams(ctx context.Context, addr string, lines [][]byte) (int, int, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not dial: %w", err)
+	}
+
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return 0, 0, fmt.Errorf("could not set write deadline: %w", err)
+		}
+	}
+
+	var (
+		packet bytes.Buffer
+		sent   int
+		// packed lines on the packet, and sentLines before it.
+		packed    int
+		sentLines int
+	)
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+
+		n, err := conn.Write(packet.Bytes())
+		sent += n
+		packet.Reset()
+		if err != nil {
+			return err
+		}
+
+		sentLines += packed
+		packed = 0
+		return nil
+	}
+
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxDatagramSize {
+			if err := flush(); err != nil {
+				return sent, sentLines, fmt.Errorf("could not write packet: %w", err)
+			}
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.Write(line)
+		packed++
+	}
+
+	if err := flush(); err != nil {
+		return sent, sentLines, fmt.Errorf("could not write packet: %w", err)
+	}
+
+	return sent, sentLines, nil
+}
@@ -0,0 +1,164 @@
+package forwarder
+
+import (
+	"strings"
+	"time"
+
+	fluentbit "github.com/calyptia/go-fluent-bit-metrics"
+)
+
+// MetricType of a snapshot metric.
+type MetricType string
+
+const (
+	MetricCounter MetricType = "counter"
+	MetricGauge   MetricType = "gauge"
+)
+
+// Snapshot of the metrics collected from the Fluent Bit agent on one interval.
+// The same snapshot is pushed to every sink.
+type Snapshot struct {
+	Time             time.Time         `json:"time"`
+	AgentID          string            `json:"agentID,omitempty"`
+	Hostname         string            `json:"hostname"`
+	MachineID        string            `json:"machineID"`
+	FluentBitVersion string            `json:"fluentBitVersion,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Metrics          []Metric          `json:"metrics"`
+}
+
+// Metric named like cmetrics does: namespace_subsystem_name.
+type Metric struct {
+	Namespace string     `json:"namespace"`
+	Subsystem string     `json:"subsystem"`
+	Name      string     `json:"name"`
+	Help      string     `json:"help,omitempty"`
+	Type      MetricType `json:"type"`
+	LabelKeys []string   `json:"labelKeys,omitempty"`
+	Samples   []Sample   `json:"samples"`
+}
+
+// Sample with a value for each of the metric label keys.
+type Sample struct {
+	LabelValues []string `json:"labelValues,omitempty"`
+	Value       float64  `json:"value"`
+}
+
+// FullName of the metric, like "fluentbit_input_records".
+func (m Metric) FullName() string {
+	parts := make([]string, 0, 3)
+	for _, s := range []string{m.Namespace, m.Subsystem, m.Name} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+
+	return strings.Join(parts, "_")
+}
+
+// pluginMetric with one sample per plugin.
+func pluginMetric(typ MetricType, subsystem, name string) Metric {
+	return Metric{
+		Namespace: "fluentbit",
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      name,
+		Type:      typ,
+		LabelKeys: []string{"plugin"},
+	}
+}
+
+func (m *Metric) add(value float64, labelValues ...string) {
+	m.Samples = append(m.Samples, Sample{LabelValues: labelValues, Value: value})
+}
+
+// snapshot of the Fluent Bit metrics, along with the forwarder own metrics
+// if enabled.
+func (fd *Forwarder) snapshot(settings settings, metrics *fluentbit.Metrics, storageMetrics *fluentbit.StorageMetrics) Snapshot {
+	out := Snapshot{
+		Time:      fd.now(),
+		Hostname:  settings.hostname,
+		MachineID: fd.MachineID,
+		Labels:    settings.labels,
+	}
+
+	fd.state.mu.Lock()
+	out.AgentID = fd.state.agentID
+	out.FluentBitVersion = fd.state.fluentBitVersion
+	fd.state.mu.Unlock()
+
+	chunks := storageMetrics.StorageLayer.Chunks
+	for _, m := range []struct {
+		name  string
+		value uint64
+	}{
+		{"total_chunks", chunks.TotalChunks},
+		{"mem_chunks", chunks.MemChunks},
+		{"fs_chunks", chunks.FsChunks},
+		{"fs_chunks_up", chunks.FsChunksUp},
+		{"fs_chunks_down", chunks.FsChunksDown},
+	} {
+		metric := pluginMetric(MetricGauge, "storage", m.name)
+		metric.add(float64(m.value), "chunks")
+		out.Metrics = append(out.Metrics, metric)
+	}
+
+	var (
+		storageTotal    = pluginMetric(MetricGauge, "storage", "total")
+		storageUp       = pluginMetric(MetricGauge, "storage", "up")
+		storageDown     = pluginMetric(MetricGauge, "storage", "down")
+		storageBusy     = pluginMetric(MetricGauge, "storage", "busy")
+		storageBusySize = pluginMetric(MetricGauge, "storage", "busy_size")
+		// storageOverlimit is 1 while the input is paused for reaching its mem_buf_limit.
+		// It is left out of the Cloud payload.
+		storageOverlimit = pluginMetric(MetricGauge, "storage", "overlimit")
+	)
+	for pluginName, metric := range storageMetrics.InputChunks {
+		storageTotal.add(float64(metric.Chunks.Total), pluginName)
+		storageUp.add(float64(metric.Chunks.Up), pluginName)
+		storageDown.add(float64(metric.Chunks.Down), pluginName)
+		storageBusy.add(float64(metric.Chunks.Busy), pluginName)
+
+		var overlimit float64
+		if metric.Status.Overlimit {
+			overlimit = 1
+		}
+		storageOverlimit.add(overlimit, pluginName)
+	}
+
+	var (
+		inputRecords = pluginMetric(MetricCounter, "input", "records")
+		inputBytes   = pluginMetric(MetricCounter, "input", "bytes")
+	)
+	for pluginName, metric := range metrics.Input {
+		inputRecords.add(float64(metric.Records), pluginName)
+		inputBytes.add(float64(metric.Bytes), pluginName)
+	}
+
+	var (
+		outputProcRecords   = pluginMetric(MetricCounter, "output", "proc_records")
+		outputProcBytes     = pluginMetric(MetricCounter, "output", "proc_bytes")
+		outputErrors        = pluginMetric(MetricCounter, "output", "errors")
+		outputRetries       = pluginMetric(MetricCounter, "output", "retries")
+		outputRetriesFailed = pluginMetric(MetricCounter, "output", "retries_failed")
+	)
+	for pluginName, metric := range metrics.Output {
+		outputProcRecords.add(float64(metric.ProcRecords), pluginName)
+		outputProcBytes.add(float64(metric.ProcBytes), pluginName)
+		outputErrors.add(float64(metric.Errors), pluginName)
+		outputRetries.add(float64(metric.Retries), pluginName)
+		outputRetriesFailed.add(float64(metric.RetriesFailed), pluginName)
+	}
+
+	out.Metrics = append(out.Metrics,
+		storageTotal, storageUp, storageDown, storageBusy, storageBusySize, storageOverlimit,
+		inputRecords, inputBytes,
+		outputProcRecords, outputProcBytes, outputErrors, outputRetries, outputRetriesFailed,
+	)
+
+	if settings.includeSelfMetrics {
+		out.Metrics = fd.selfMetrics.appendTo(out.Metrics)
+	}
+
+	return out
+}
@@ -0,0 +1,187 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// Status of the forwarder as reported by GET /status.
+type Status struct {
+	Registered       bool              `json:"registered"`
+	AgentID          string            `json:"agentID,omitempty"`
+	AgentName        string            `json:"agentName,omitempty"`
+	MachineID        string            `json:"machineID"`
+	Hostname         string            `json:"hostname"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	FluentBitVersion string            `json:"fluentBitVersion,omitempty"`
+	RegisteredAt     *time.Time        `json:"registeredAt"`
+	LastPushAt       *time.Time        `json:"lastPushAt"`
+	LastError        string            `json:"lastError,omitempty"`
+	LastErrorAt      *time.Time        `json:"lastErrorAt"`
+	// ConfigVersion of the last desired config processed, applied or not.
+	ConfigVersion string `json:"configVersion,omitempty"`
+}
+
+// state tracked by the forwarder while running.
+// The zero value is ready to use.
+type state struct {
+	mu               sync.Mutex
+	agentID          string
+	agentToken       string
+	agentName        string
+	fluentBitVersion string
+	registeredAt     time.Time
+	lastPushAt       time.Time
+	lastErr          error
+	lastErrAt        time.Time
+	fluentBitDown    bool
+	// cloudFailingSince is the time of the first failed Cloud push
+	// since the last successful one.
+	cloudFailingSince time.Time
+	// cloudFailing is set once Cloud pushes are reported as failing.
+	cloudFailing bool
+	// desiredConfigVersion is the last desired config version processed.
+	desiredConfigVersion string
+}
+
+func (s *state) setFluentBitVersion(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fluentBitVersion = version
+}
+
+func (s *state) setRegistered(payload StorePayload, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.agentID = payload.AgentID
+	s.agentToken = payload.AgentToken
+	s.agentName = payload.AgentName
+	s.registeredAt = now
+}
+
+func (s *state) setPushed(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastPushAt = now
+}
+
+func (s *state) setErr(err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastErr = err
+	s.lastErrAt = now
+}
+
+// setFluentBitReachable reports whether Fluent Bit just recovered.
+func (s *state) setFluentBitReachable(reachable bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recovered := reachable && s.fluentBitDown
+	s.fluentBitDown = !reachable
+	return recovered
+}
+
+// setCloudPushFailed reports whether Cloud pushes just became failing
+// for longer than the given duration.
+func (s *state) setCloudPushFailed(now time.Time, after time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cloudFailingSince.IsZero() {
+		s.cloudFailingSince = now
+	}
+
+	if s.cloudFailing || now.Sub(s.cloudFailingSince) < after {
+		return false
+	}
+
+	s.cloudFailing = true
+	return true
+}
+
+// setCloudPushed reports whether Cloud pushes just recovered
+// after being reported as failing.
+func (s *state) setCloudPushed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recovered := s.cloudFailing
+	s.cloudFailingSince = time.Time{}
+	s.cloudFailing = false
+	return recovered
+}
+
+func (s *state) setConfigVersion(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.desiredConfigVersion = version
+}
+
+func (s *state) configVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.desiredConfigVersion
+}
+
+func (s *state) lastPush() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastPushAt
+}
+
+func (s *state) agent() (id, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.agentID, s.agentToken
+}
+
+func (s *state) registered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.registeredAt.IsZero()
+}
+
+// Status of the forwarder.
+func (fd *Forwarder) Status() Status {
+	settings := fd.settings()
+
+	fd.state.mu.Lock()
+	defer fd.state.mu.Unlock()
+
+	out := Status{
+		Registered:       !fd.state.registeredAt.IsZero(),
+		AgentID:          fd.state.agentID,
+		AgentName:        fd.state.agentName,
+		MachineID:        fd.MachineID,
+		Hostname:         settings.hostname,
+		Labels:           settings.labels,
+		FluentBitVersion: fd.state.fluentBitVersion,
+		RegisteredAt:     timePtr(fd.state.registeredAt),
+		LastPushAt:       timePtr(fd.state.lastPushAt),
+		LastErrorAt:      timePtr(fd.state.lastErrAt),
+		ConfigVersion:    fd.state.desiredConfigVersion,
+	}
+	if fd.state.lastErr != nil {
+		out.LastError = fd.state.lastErr.Error()
+	}
+
+	return out
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}